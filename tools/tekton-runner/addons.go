@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Addon is a backing service (database, cache, queue, object store) run as a
+// StatefulSet in a workspace. Its connection settings are injected into every
+// app of the workspace as <NAME>_* env vars.
+type Addon struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	Storage string `json:"storage"`
+}
+
+// addonKind describes how one addon type is run and reached.
+type addonKind struct {
+	Image    string
+	Version  string
+	Port     int
+	DataPath string
+	Database bool
+	Args     []string
+	// Env maps container env vars to keys of the addon Secret.
+	Env map[string]string
+	// Extra is set on the container as plain env.
+	Extra  map[string]string
+	Scheme string
+}
+
+var addonKinds = map[string]addonKind{
+	"postgres": {
+		Image: "postgres", Version: "16", Port: 5432, DataPath: "/var/lib/postgresql/data", Database: true,
+		Env:    map[string]string{"POSTGRES_USER": "USER", "POSTGRES_PASSWORD": "PASSWORD", "POSTGRES_DB": "DATABASE"},
+		Extra:  map[string]string{"PGDATA": "/var/lib/postgresql/data/pgdata"},
+		Scheme: "postgres",
+	},
+	"mysql": {
+		Image: "mysql", Version: "8.4", Port: 3306, DataPath: "/var/lib/mysql", Database: true,
+		Env:    map[string]string{"MYSQL_USER": "USER", "MYSQL_PASSWORD": "PASSWORD", "MYSQL_ROOT_PASSWORD": "PASSWORD", "MYSQL_DATABASE": "DATABASE"},
+		Scheme: "mysql",
+	},
+	"redis": {
+		Image: "redis", Version: "7", Port: 6379, DataPath: "/data",
+		Args:   []string{"redis-server", "--requirepass", "$(REDIS_PASSWORD)", "--appendonly", "yes"},
+		Env:    map[string]string{"REDIS_PASSWORD": "PASSWORD"},
+		Scheme: "redis",
+	},
+	"rabbitmq": {
+		Image: "rabbitmq", Version: "3.13", Port: 5672, DataPath: "/var/lib/rabbitmq",
+		Env:    map[string]string{"RABBITMQ_DEFAULT_USER": "USER", "RABBITMQ_DEFAULT_PASS": "PASSWORD"},
+		Scheme: "amqp",
+	},
+	"minio": {
+		Image: "minio/minio", Version: "RELEASE.2024-10-13T13-34-11Z", Port: 9000, DataPath: "/data",
+		Args:   []string{"server", "/data"},
+		Env:    map[string]string{"MINIO_ROOT_USER": "USER", "MINIO_ROOT_PASSWORD": "PASSWORD"},
+		Scheme: "http",
+	},
+}
+
+const (
+	addonLabel      = "tekton-runner/addon"
+	addonTypeLabel  = "tekton-runner/addon-type"
+	addonTimeout    = 5 * time.Minute
+	defaultAddonPVC = "1Gi"
+)
+
+var errAddonNotFound = fmt.Errorf("addon not found")
+
+var addonNameRe = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// addonVersionRe matches a valid image tag.
+var addonVersionRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+
+func addonTypes() []string {
+	out := make([]string, 0, len(addonKinds))
+	for t := range addonKinds {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func setAddonDefaults(addons []Addon) {
+	for i := range addons {
+		a := &addons[i]
+		a.Type = strings.ToLower(a.Type)
+		if a.Name == "" {
+			a.Name = a.Type
+		}
+		if a.Version == "" {
+			a.Version = addonKinds[a.Type].Version
+		}
+		if a.Storage == "" {
+			a.Storage = defaultAddonPVC
+		}
+	}
+}
+
+func validateAddons(addons []Addon, app string) error {
+	names := map[string]bool{}
+	for i, a := range addons {
+		field := fmt.Sprintf("addons[%d]", i)
+		if _, ok := addonKinds[a.Type]; !ok {
+			return fmt.Errorf("%s: type must be one of %s", field, strings.Join(addonTypes(), ", "))
+		}
+		if len(a.Name) > 40 || !addonNameRe.MatchString(a.Name) {
+			return fmt.Errorf("%s: name must be a lowercase DNS label", field)
+		}
+		if a.Name == app {
+			return fmt.Errorf("%s: name %s is used by the app", field, a.Name)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("%s: name %s is duplicated", field, a.Name)
+		}
+		names[a.Name] = true
+		if !addonVersionRe.MatchString(a.Version) {
+			return fmt.Errorf("%s: invalid version %q", field, a.Version)
+		}
+		if !quantityRe.MatchString(a.Storage) {
+			return fmt.Errorf("%s: invalid storage %q", field, a.Storage)
+		}
+	}
+	return nil
+}
+
+// addonEnvPrefix turns an addon name into its env var prefix (my-db -> MY_DB).
+func addonEnvPrefix(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func addonImage(a Addon) string {
+	return addonKinds[a.Type].Image + ":" + a.Version
+}
+
+func addonSecretName(name string) string {
+	return name + "-addon"
+}
+
+// ensureAddons creates or updates the addons of a workspace and waits until
+// they are ready. Credentials are generated once and kept on later applies.
+func ensureAddons(kubeconfig, ns string, addons []Addon) error {
+	if len(addons) == 0 {
+		return nil
+	}
+	images := make([]string, 0, len(addons))
+	for _, a := range addons {
+		images = append(images, addonImage(a))
+	}
+	if _, err := verifyImages(images); err != nil {
+		return fmt.Errorf("addons: %v", err)
+	}
+	if err := kubectlApplyTo(kubeconfig, mustRender("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: {{.}}\n", ns)); err != nil {
+		return err
+	}
+	for _, a := range addons {
+		if !resourceExists(kubeconfig, ns, "secret", addonSecretName(a.Name)) {
+			if err := kubectlApplyTo(kubeconfig, renderAddonSecret(ns, a, randomPassword())); err != nil {
+				return fmt.Errorf("addon %s credentials: %v", a.Name, err)
+			}
+		}
+		if err := kubectlApplyTo(kubeconfig, renderAddon(ns, a)); err != nil {
+			return fmt.Errorf("addon %s: %v", a.Name, err)
+		}
+	}
+	for _, a := range addons {
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "rollout", "status", "statefulset/"+a.Name, "--timeout", addonTimeout.String())
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("addon %s not ready: %v", a.Name, err)
+		}
+	}
+	return nil
+}
+
+func randomPassword() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// renderAddonSecret renders the connection Secret of an addon. Its keys are
+// the env vars apps receive.
+func renderAddonSecret(ns string, a Addon, password string) string {
+	k := addonKinds[a.Type]
+	p := addonEnvPrefix(a.Name)
+	user := "app"
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", a.Name, ns)
+	data := map[string]string{
+		p + "_HOST":     host,
+		p + "_PORT":     fmt.Sprint(k.Port),
+		p + "_PASSWORD": password,
+	}
+	var url string
+	switch a.Type {
+	case "redis":
+		url = fmt.Sprintf("redis://:%s@%s:%d/0", password, host, k.Port)
+	case "minio":
+		data[p+"_USER"] = user
+		url = fmt.Sprintf("http://%s:%d", host, k.Port)
+	default:
+		data[p+"_USER"] = user
+		url = fmt.Sprintf("%s://%s:%s@%s:%d/", k.Scheme, user, password, host, k.Port)
+	}
+	if k.Database {
+		data[p+"_DATABASE"] = "app"
+		url += "app"
+	}
+	data[p+"_URL"] = url
+
+	tpl := `apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    {{.Label}}: {{.Addon}}
+    {{.TypeLabel}}: {{.Type}}
+type: Opaque
+stringData:
+{{- range .Data }}
+  {{.Key}}: {{.Value}}
+{{- end }}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      addonSecretName(a.Name),
+		"Namespace": ns,
+		"Label":     addonLabel,
+		"TypeLabel": addonTypeLabel,
+		"Addon":     a.Name,
+		"Type":      a.Type,
+		"Data":      sortedKV(data),
+	})
+}
+
+// renderAddon renders the Service and StatefulSet of an addon. The Service is
+// marked with a role so the addon is not listed as an app.
+func renderAddon(ns string, a Addon) string {
+	k := addonKinds[a.Type]
+	p := addonEnvPrefix(a.Name)
+	var env []kv
+	for name, key := range k.Env {
+		env = append(env, kv{Key: name, Value: p + "_" + key})
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Key < env[j].Key })
+
+	tpl := `apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    {{.Label}}: {{.Name}}
+    tekton-runner/role: addon
+spec:
+  selector:
+    {{.Label}}: {{.Name}}
+  ports:
+    - name: {{.Type}}
+      port: {{.Port}}
+      targetPort: {{.Port}}
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    {{.Label}}: {{.Name}}
+    {{.TypeLabel}}: {{.Type}}
+spec:
+  serviceName: {{.Name}}
+  replicas: 1
+  selector:
+    matchLabels:
+      {{.Label}}: {{.Name}}
+  template:
+    metadata:
+      labels:
+        {{.Label}}: {{.Name}}
+        {{.TypeLabel}}: {{.Type}}
+    spec:
+      containers:
+        - name: {{.Type}}
+          image: {{.Image}}
+{{- if .Args }}
+          args: {{.Args}}
+{{- end }}
+          ports:
+            - name: {{.Type}}
+              containerPort: {{.Port}}
+          readinessProbe:
+            tcpSocket:
+              port: {{.Port}}
+            periodSeconds: 5
+          env:
+{{- range .Env }}
+            - name: {{.Key}}
+              valueFrom:
+                secretKeyRef:
+                  name: {{$.Secret}}
+                  key: {{.Value}}
+{{- end }}
+{{- range .Extra }}
+            - name: {{.Key}}
+              value: {{.Value}}
+{{- end }}
+          volumeMounts:
+            - name: data
+              mountPath: {{.DataPath}}
+  volumeClaimTemplates:
+    - metadata:
+        name: data
+        labels:
+          {{.Label}}: {{.Name}}
+      spec:
+        accessModes: ["ReadWriteOnce"]
+        resources:
+          requests:
+            storage: {{.Storage}}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      a.Name,
+		"Namespace": ns,
+		"Label":     addonLabel,
+		"TypeLabel": addonTypeLabel,
+		"Type":      a.Type,
+		"Image":     addonImage(a),
+		"Args":      yamlList(k.Args),
+		"Port":      k.Port,
+		"DataPath":  k.DataPath,
+		"Secret":    addonSecretName(a.Name),
+		"Env":       env,
+		"Extra":     sortedKV(k.Extra),
+		"Storage":   a.Storage,
+	})
+}
+
+// addonEnv returns the connection env vars of all addons in a workspace.
+func addonEnv(kubeconfig, ns string) (map[string]string, error) {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", "secret", "-l", addonLabel, "-o", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("read addon secrets: %v", err)
+	}
+	var list struct {
+		Items []struct {
+			Data map[string]string `json:"data"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parse addon secrets: %v", err)
+	}
+	env := map[string]string{}
+	for _, item := range list.Items {
+		for k, v := range item.Data {
+			val, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("decode addon secret %s: %v", k, err)
+			}
+			env[k] = string(val)
+		}
+	}
+	return env, nil
+}
+
+// appSecretEnv resolves the secret env of an app and adds the addon
+// connection vars of its workspace. Values set by the app win.
+func appSecretEnv(kubeconfig, ws, ns string, env map[string]string, secrets map[string]SecretEnv) (map[string]string, error) {
+	values, err := resolveSecretEnv(ns, secrets)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := addonEnv(kubeconfig, ws)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if _, ok := env[k]; ok {
+			continue
+		}
+		if _, ok := values[k]; !ok {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+// listAddons returns the addons of a workspace with their readiness and the
+// env vars they inject.
+func listAddons(kubeconfig, ns string) ([]map[string]any, error) {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", "statefulset", "-l", addonLabel, "-o", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("get addons failed: %v", err)
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Spec struct {
+				Template struct {
+					Spec struct {
+						Containers []struct {
+							Image string `json:"image"`
+						} `json:"containers"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+			Status struct {
+				ReadyReplicas int `json:"readyReplicas"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, err
+	}
+	addons := []map[string]any{}
+	for _, item := range list.Items {
+		name := item.Metadata.Name
+		typ := item.Metadata.Labels[addonTypeLabel]
+		version := ""
+		if cs := item.Spec.Template.Spec.Containers; len(cs) > 0 {
+			if i := strings.LastIndex(cs[0].Image, ":"); i >= 0 {
+				version = cs[0].Image[i+1:]
+			}
+		}
+		p := addonEnvPrefix(name)
+		var env []string
+		for _, key := range []string{"HOST", "PORT", "USER", "PASSWORD", "DATABASE", "URL"} {
+			if key == "USER" && typ == "redis" || key == "DATABASE" && !addonKinds[typ].Database {
+				continue
+			}
+			env = append(env, p+"_"+key)
+		}
+		addons = append(addons, map[string]any{
+			"name":    name,
+			"type":    typ,
+			"version": version,
+			"host":    fmt.Sprintf("%s.%s.svc.cluster.local", name, ns),
+			"port":    addonKinds[typ].Port,
+			"ready":   item.Status.ReadyReplicas > 0,
+			"env":     env,
+		})
+	}
+	return addons, nil
+}
+
+// provisionAddons creates the workspace cluster if needed and ensures the
+// given addons in it.
+func provisionAddons(workspace string, addons []Addon) error {
+	kcfgDir := "/home/beko/kubeconfigs"
+	if err := os.MkdirAll(kcfgDir, 0o755); err != nil {
+		return err
+	}
+	kcfg := filepath.Join(kcfgDir, workspace+".yaml")
+	if err := ensureKindCluster(workspace, kcfg); err != nil {
+		return err
+	}
+	return ensureAddons(kcfg, workspace, addons)
+}
+
+// deleteAddon removes an addon with its credentials and data.
+func deleteAddon(workspace, name string) error {
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	if !resourceExists(kcfg, workspace, "statefulset", name) {
+		return fmt.Errorf("%w: %s", errAddonNotFound, name)
+	}
+	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "delete", "statefulset,service,secret,pvc", "-l", addonLabel+"="+name, "--ignore-not-found")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("delete addon %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestValidateAddons(t *testing.T) {
+	tests := []struct {
+		name    string
+		addons  []Addon
+		wantErr bool
+	}{
+		{"defaults", []Addon{{Type: "postgres"}, {Type: "redis", Name: "cache"}, {Type: "minio"}}, false},
+		{"version", []Addon{{Type: "postgres", Version: "16.4-alpine"}}, false},
+		{"unknown type", []Addon{{Type: "mongodb"}}, true},
+		{"name used by the app", []Addon{{Type: "redis", Name: "web"}}, true},
+		{"duplicate name", []Addon{{Type: "redis"}, {Type: "redis"}}, true},
+		{"uppercase name", []Addon{{Type: "redis", Name: "Cache"}}, true},
+		{"version with a registry", []Addon{{Type: "redis", Version: "evil.io/redis:7"}}, true},
+		{"version with a digest", []Addon{{Type: "redis", Version: "7@sha256:abc"}}, true},
+		{"version with a newline", []Addon{{Type: "redis", Version: "7\n  privileged: true"}}, true},
+		{"version starting with a dot", []Addon{{Type: "redis", Version: ".7"}}, true},
+		{"bad storage", []Addon{{Type: "redis", Storage: "lots"}}, true},
+	}
+	for _, tt := range tests {
+		setAddonDefaults(tt.addons)
+		if err := validateAddons(tt.addons, "web"); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateAddons() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SecretEnv is a secret environment value. It is either given inline or read
+// from a Secret in the runner namespace.
+type SecretEnv struct {
+	Value  string `json:"value"`
+	Secret string `json:"secret"`
+	Key    string `json:"key"`
+}
+
+// ConfigFile is a file mounted into the app container from a ConfigMap.
+type ConfigFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// AppConfig is the body of POST /app/config. Omitted fields are left as they
+// are; an empty value clears them.
+type AppConfig struct {
+	Namespace     string               `json:"namespace"`
+	Env           map[string]string    `json:"env"`
+	EnvFromSecret map[string]SecretEnv `json:"env_from_secret"`
+	ConfigFiles   []ConfigFile         `json:"config_files"`
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateAppConfig(env map[string]string, secretEnv map[string]SecretEnv, files []ConfigFile) error {
+	for k := range env {
+		if !envNameRe.MatchString(k) {
+			return fmt.Errorf("deploy.env: invalid variable name %q", k)
+		}
+	}
+	for k, v := range secretEnv {
+		if !envNameRe.MatchString(k) {
+			return fmt.Errorf("deploy.env_from_secret: invalid variable name %q", k)
+		}
+		if _, dup := env[k]; dup {
+			return fmt.Errorf("deploy.env_from_secret: %s is also set in deploy.env", k)
+		}
+		if v.Secret == "" && v.Key != "" {
+			return fmt.Errorf("deploy.env_from_secret %s: key requires secret", k)
+		}
+		if v.Secret != "" && (v.Key == "" || v.Value != "") {
+			return fmt.Errorf("deploy.env_from_secret %s: use either value or secret+key", k)
+		}
+		if isRunnerSecret(v.Secret) {
+			return fmt.Errorf("deploy.env_from_secret %s: secret %s is reserved for the runner", k, v.Secret)
+		}
+	}
+	paths := map[string]bool{}
+	for _, f := range files {
+		if !path.IsAbs(f.Path) || strings.HasSuffix(f.Path, "/") || path.Clean(f.Path) == "/" || strings.ContainsFunc(f.Path, unicode.IsControl) {
+			return fmt.Errorf("deploy.config_files: path %q must be an absolute file path", f.Path)
+		}
+		if paths[path.Clean(f.Path)] {
+			return fmt.Errorf("deploy.config_files: path %s is duplicated", f.Path)
+		}
+		paths[path.Clean(f.Path)] = true
+	}
+	return nil
+}
+
+// Apps may only read Secrets of the runner namespace that are named with
+// appSecretPrefix or labeled appSecretLabel=true.
+const (
+	appSecretPrefix = "app-"
+	appSecretLabel  = "tekton-runner/app-secret"
+)
+
+// runnerSecrets are the Secrets of the runner itself, which apps never get.
+func runnerSecrets() []string {
+	return []string{signingKeySecret(), registrySecret()}
+}
+
+func isRunnerSecret(name string) bool {
+	for _, s := range runnerSecrets() {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecretEnv returns the plain values of secret env entries, reading
+// referenced keys from the app Secrets of the runner namespace.
+func resolveSecretEnv(ns string, in map[string]SecretEnv) (map[string]string, error) {
+	out := map[string]string{}
+	for name, v := range in {
+		if v.Secret == "" {
+			out[name] = v.Value
+			continue
+		}
+		if isRunnerSecret(v.Secret) {
+			return nil, fmt.Errorf("secret %s/%s is reserved for the runner", ns, v.Secret)
+		}
+		labels, data, err := readSecret(ns, v.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(v.Secret, appSecretPrefix) && labels[appSecretLabel] != "true" {
+			return nil, fmt.Errorf("secret %s/%s is not an app secret: name it %s* or label it %s=true", ns, v.Secret, appSecretPrefix, appSecretLabel)
+		}
+		val, ok := data[v.Key]
+		if !ok {
+			return nil, fmt.Errorf("secret %s/%s has no key %s", ns, v.Secret, v.Key)
+		}
+		out[name] = val
+	}
+	return out, nil
+}
+
+// readSecret returns the labels and decoded data of a Secret.
+func readSecret(ns, name string) (map[string]string, map[string]string, error) {
+	b, err := kubectlCmd("-n", ns, "get", "secret", name, "-o", "json").Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read secret %s/%s: %v", ns, name, err)
+	}
+	var secret struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(b, &secret); err != nil {
+		return nil, nil, fmt.Errorf("parse secret %s/%s: %v", ns, name, err)
+	}
+	data, err := decodeSecretData(ns, name, secret.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret.Metadata.Labels, data, nil
+}
+
+// workspaceSecretData returns the decoded data of a Secret in a workspace
+// cluster.
+func workspaceSecretData(kubeconfig, ns, name string) (map[string]string, error) {
+	b, err := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", "secret", name, "-o", "jsonpath={.data}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("read secret %s/%s: %v", ns, name, err)
+	}
+	enc := map[string]string{}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &enc); err != nil {
+			return nil, fmt.Errorf("parse secret %s/%s: %v", ns, name, err)
+		}
+	}
+	return decodeSecretData(ns, name, enc)
+}
+
+func decodeSecretData(ns, name string, enc map[string]string) (map[string]string, error) {
+	data := make(map[string]string, len(enc))
+	for k, v := range enc {
+		val, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("decode secret %s/%s: %v", ns, name, err)
+		}
+		data[k] = string(val)
+	}
+	return data, nil
+}
+
+type kv struct {
+	Key   string
+	Value string
+}
+
+// sortedKV returns map entries ordered by key with values quoted for YAML.
+func sortedKV(m map[string]string) []kv {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]kv, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, kv{Key: k, Value: yamlQuote(m[k])})
+	}
+	return out
+}
+
+// yamlQuote quotes a string as JSON, which is valid YAML for any content.
+func yamlQuote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func envConfigName(app string) string {
+	return app + "-env"
+}
+
+func filesConfigName(app string) string {
+	return app + "-files"
+}
+
+func renderEnvConfigMap(ns, app string, env map[string]string) string {
+	tpl := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+data:
+{{- range .Data }}
+  {{.Key}}: {{.Value}}
+{{- else }} {}
+{{- end }}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      envConfigName(app),
+		"Namespace": ns,
+		"App":       app,
+		"Data":      sortedKV(env),
+	})
+}
+
+func renderEnvSecret(ns, app string, values map[string]string) string {
+	tpl := `apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+type: Opaque
+stringData:
+{{- range .Data }}
+  {{.Key}}: {{.Value}}
+{{- else }} {}
+{{- end }}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      envConfigName(app),
+		"Namespace": ns,
+		"App":       app,
+		"Data":      sortedKV(values),
+	})
+}
+
+type configFileMount struct {
+	Key  string
+	Path string
+	// MountPath and Content are quoted for the templates.
+	MountPath string
+	Content   string
+}
+
+var configKeyRe = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+
+func configFileMounts(files []ConfigFile) []configFileMount {
+	out := make([]configFileMount, 0, len(files))
+	for i, f := range files {
+		base := configKeyRe.ReplaceAllString(path.Base(f.Path), "_")
+		out = append(out, configFileMount{
+			Key:       fmt.Sprintf("%d-%s", i, base),
+			Path:      path.Clean(f.Path),
+			MountPath: yamlQuote(path.Clean(f.Path)),
+			Content:   yamlQuote(f.Content),
+		})
+	}
+	return out
+}
+
+func renderFilesConfigMap(ns, app string, files []ConfigFile) string {
+	tpl := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+data:
+{{- range .Files }}
+  {{.Key}}: {{.Content}}
+{{- end }}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      filesConfigName(app),
+		"Namespace": ns,
+		"App":       app,
+		"Files":     configFileMounts(files),
+	})
+}
+
+// configHash fingerprints the rendered config objects so that a changed
+// config rolls the Deployment on the next apply.
+func configHash(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// configOwner returns the workload name the config objects of an app are
+// named after. Blue/green slots have their own config objects.
+func configOwner(kubeconfig, workspace, app string) string {
+	if isJobKind(appKind(workspace, app)) {
+		return app
+	}
+	_, name := appWorkload(kubeconfig, workspace, app)
+	return name
+}
+
+// updateAppConfig applies new env, secret env or config files to a deployed
+// app and rolls it out.
+func updateAppConfig(workspace, app string, cfg AppConfig) error {
+	if cfg.Namespace == "" {
+		cfg.Namespace = "tekton-pipelines"
+	}
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	jobApp := isJobKind(appKind(workspace, app))
+	if jobApp && cfg.ConfigFiles != nil {
+		return fmt.Errorf("config_files of job and cronjob apps change with the next deploy")
+	}
+	resource, name := "", app
+	if !jobApp {
+		resource, name = appWorkload(kcfg, workspace, app)
+	}
+	var manifests []string
+	if cfg.Env != nil {
+		manifests = append(manifests, renderEnvConfigMap(workspace, name, cfg.Env))
+	}
+	if cfg.EnvFromSecret != nil {
+		values, err := appSecretEnv(kcfg, workspace, cfg.Namespace, cfg.Env, cfg.EnvFromSecret)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, renderEnvSecret(workspace, name, values))
+	}
+	if len(cfg.ConfigFiles) > 0 {
+		manifests = append(manifests, renderFilesConfigMap(workspace, name, cfg.ConfigFiles))
+	}
+	if len(manifests) > 0 {
+		cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "apply", "-f", "-")
+		cmd.Stdin = strings.NewReader(strings.Join(manifests, "---\n"))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("apply app config: %v", err)
+		}
+	}
+	if cfg.ConfigFiles != nil {
+		if err := patchConfigMounts(kcfg, workspace, resource, name, cfg.ConfigFiles); err != nil {
+			return err
+		}
+	}
+	if jobApp {
+		// The next Job picks the new env up.
+		return nil
+	}
+	// envFrom and subPath mounts are only read at container start.
+	return rolloutRestart(workspace, app)
+}
+
+// patchConfigMounts swaps the config file volume and mounts of a Deployment
+// or StatefulSet for those of files. The other volumes and mounts of the pod
+// are left alone: old config file entries are removed by index and the new
+// ones appended.
+func patchConfigMounts(kubeconfig, workspace, resource, name string, files []ConfigFile) error {
+	out, err := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "get", resource, name, "-o", "json").Output()
+	if err != nil {
+		return fmt.Errorf("get %s %s: %v", resource, name, err)
+	}
+	type named struct {
+		Name string `json:"name"`
+	}
+	var obj struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					Volumes    []named `json:"volumes"`
+					Containers []struct {
+						VolumeMounts []named `json:"volumeMounts"`
+					} `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(out, &obj); err != nil {
+		return fmt.Errorf("parse %s %s: %v", resource, name, err)
+	}
+	pod := obj.Spec.Template.Spec
+	if len(pod.Containers) == 0 {
+		return fmt.Errorf("%s %s has no containers", resource, name)
+	}
+	const volumesPath = "/spec/template/spec/volumes"
+	const mountsPath = "/spec/template/spec/containers/0/volumeMounts"
+
+	var ops []map[string]any
+	// Removing from the end keeps the indexes of earlier entries valid.
+	remove := func(base string, entries []named) {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].Name == "config-files" {
+				ops = append(ops, map[string]any{"op": "remove", "path": fmt.Sprintf("%s/%d", base, i)})
+			}
+		}
+	}
+	remove(volumesPath, pod.Volumes)
+	remove(mountsPath, pod.Containers[0].VolumeMounts)
+	if len(files) > 0 {
+		if pod.Volumes == nil {
+			ops = append(ops, map[string]any{"op": "add", "path": volumesPath, "value": []any{}})
+		}
+		if pod.Containers[0].VolumeMounts == nil {
+			ops = append(ops, map[string]any{"op": "add", "path": mountsPath, "value": []any{}})
+		}
+		ops = append(ops, map[string]any{"op": "add", "path": volumesPath + "/-", "value": map[string]any{
+			"name":      "config-files",
+			"configMap": map[string]any{"name": filesConfigName(name)},
+		}})
+		for _, m := range configFileMounts(files) {
+			ops = append(ops, map[string]any{"op": "add", "path": mountsPath + "/-", "value": map[string]any{
+				"name": "config-files", "mountPath": m.Path, "subPath": m.Key,
+			}})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	patch, _ := json.Marshal(ops)
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "patch", resource, name, "--type", "json", "-p", string(patch))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("patch config files: %v", err)
+	}
+	return nil
+}
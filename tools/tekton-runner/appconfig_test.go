@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestValidateAppConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		secretEnv map[string]SecretEnv
+		files     []ConfigFile
+		wantErr   bool
+	}{
+		{"empty", nil, nil, nil, false},
+		{
+			"valid",
+			map[string]string{"LOG_LEVEL": "debug", "_PRIVATE": "1"},
+			map[string]SecretEnv{"DB_PASSWORD": {Secret: "app-db", Key: "password"}, "TOKEN": {Value: "t"}},
+			[]ConfigFile{{Path: "/etc/app/config.yaml"}, {Path: "/etc/app/other.yaml"}},
+			false,
+		},
+		{"env name with dash", map[string]string{"LOG-LEVEL": "debug"}, nil, nil, true},
+		{"env name starting with a digit", map[string]string{"1VAR": "x"}, nil, nil, true},
+		{"secret env name", nil, map[string]SecretEnv{"A B": {Value: "x"}}, nil, true},
+		{"set twice", map[string]string{"TOKEN": "a"}, map[string]SecretEnv{"TOKEN": {Value: "b"}}, nil, true},
+		{"key without secret", nil, map[string]SecretEnv{"TOKEN": {Key: "token"}}, nil, true},
+		{"secret without key", nil, map[string]SecretEnv{"TOKEN": {Secret: "app-token"}}, nil, true},
+		{"secret and value", nil, map[string]SecretEnv{"TOKEN": {Secret: "app-token", Key: "token", Value: "x"}}, nil, true},
+		{"runner secret", nil, map[string]SecretEnv{"CREDS": {Secret: "harbor-creds", Key: ".dockerconfigjson"}}, nil, true},
+		{"relative path", nil, nil, []ConfigFile{{Path: "etc/app.conf"}}, true},
+		{"directory path", nil, nil, []ConfigFile{{Path: "/etc/app/"}}, true},
+		{"root path", nil, nil, []ConfigFile{{Path: "/"}}, true},
+		{"control character", nil, nil, []ConfigFile{{Path: "/etc/app\n.conf"}}, true},
+		{"duplicate path", nil, nil, []ConfigFile{{Path: "/etc/app.conf"}, {Path: "/etc//app.conf"}}, true},
+	}
+	for _, tt := range tests {
+		if err := validateAppConfig(tt.env, tt.secretEnv, tt.files); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateAppConfig() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Autoscale runs a HorizontalPodAutoscaler for the app that keeps the average
+// CPU use at TargetCPU percent of the container's CPU request.
+type Autoscale struct {
+	Min       int `json:"min"`
+	Max       int `json:"max"`
+	TargetCPU int `json:"target_cpu"`
+}
+
+const (
+	defaultTargetCPU      = 80
+	defaultMetricsServer  = "https://github.com/kubernetes-sigs/metrics-server/releases/download/v0.7.2/components.yaml"
+	metricsServerAPI      = "v1beta1.metrics.k8s.io"
+	metricsServerInsecure = `[{"op":"add","path":"/spec/template/spec/containers/0/args/-","value":"--kubelet-insecure-tls"}]`
+)
+
+var errAutoscaled = errors.New("app is autoscaled; change deploy.autoscale instead")
+
+func setAutoscaleDefaults(a *Autoscale) {
+	if a == nil {
+		return
+	}
+	if a.Min == 0 {
+		a.Min = 1
+	}
+	if a.TargetCPU == 0 {
+		a.TargetCPU = defaultTargetCPU
+	}
+}
+
+func validateAutoscale(d Deploy) error {
+	a := d.Autoscale
+	if a == nil {
+		return nil
+	}
+	if !usesDeployment(d) || isJobKind(d.Kind) {
+		return fmt.Errorf("deploy.autoscale is only supported for deployment and statefulset apps")
+	}
+	if d.Strategy != "" && d.Strategy != strategyRolling {
+		return fmt.Errorf("deploy.autoscale is only supported with the rolling strategy")
+	}
+	if a.Min < 1 {
+		return fmt.Errorf("deploy.autoscale.min must be at least 1")
+	}
+	if a.Max < a.Min {
+		return fmt.Errorf("deploy.autoscale.max must be at least min")
+	}
+	if a.TargetCPU < 1 || a.TargetCPU > 1000 {
+		return fmt.Errorf("deploy.autoscale.target_cpu must be between 1 and 1000 percent")
+	}
+	if d.Resources == nil || d.Resources.CPURequest == "" {
+		return fmt.Errorf("deploy.autoscale needs deploy.resources.cpu_request")
+	}
+	if d.Replicas > 0 {
+		return fmt.Errorf("deploy.replicas is set by deploy.autoscale; use autoscale.min")
+	}
+	return nil
+}
+
+func metricsServerManifest() string {
+	if v := strings.TrimSpace(os.Getenv("METRICS_SERVER_MANIFEST")); v != "" {
+		return v
+	}
+	return defaultMetricsServer
+}
+
+// ensureMetricsServer installs metrics-server into a workspace cluster. kind
+// kubelets serve self-signed certificates, so it skips their verification.
+func ensureMetricsServer(kubeconfig string) error {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "get", "apiservice", metricsServerAPI, "-o", "name")
+	if cmd.Run() == nil {
+		return nil
+	}
+	steps := [][]string{
+		{"apply", "-f", metricsServerManifest()},
+		{"-n", "kube-system", "patch", "deployment", "metrics-server", "--type", "json", "-p", metricsServerInsecure},
+		{"-n", "kube-system", "rollout", "status", "deployment/metrics-server", "--timeout", rolloutTimeout.String()},
+	}
+	for _, args := range steps {
+		cmd := exec.Command("kubectl", append([]string{"--kubeconfig", kubeconfig}, args...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("install metrics-server: %v", err)
+		}
+	}
+	return nil
+}
+
+// syncAutoscale applies the HPA of an app, or removes it when the deploy has
+// no autoscale.
+func syncAutoscale(kubeconfig, ns, app string, d Deploy) error {
+	if d.Autoscale == nil {
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "delete", "hpa", app, "--ignore-not-found")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("delete autoscaler: %v", err)
+		}
+		return nil
+	}
+	if err := ensureMetricsServer(kubeconfig); err != nil {
+		return err
+	}
+	kind := "Deployment"
+	if d.Kind == kindStatefulSet {
+		kind = "StatefulSet"
+	}
+	return kubectlApplyTo(kubeconfig, renderAutoscaler(ns, app, kind, *d.Autoscale))
+}
+
+func renderAutoscaler(ns, app, kind string, a Autoscale) string {
+	tpl := `apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.Name}}
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: {{.Kind}}
+    name: {{.Name}}
+  minReplicas: {{.Min}}
+  maxReplicas: {{.Max}}
+  metrics:
+    - type: Resource
+      resource:
+        name: cpu
+        target:
+          type: Utilization
+          averageUtilization: {{.TargetCPU}}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      app,
+		"Namespace": ns,
+		"Kind":      kind,
+		"Min":       a.Min,
+		"Max":       a.Max,
+		"TargetCPU": a.TargetCPU,
+	})
+}
+
+// autoscaleStatus reads the HPA of an app. ok is false if it has none.
+func autoscaleStatus(kubeconfig, ns, app string) (map[string]any, bool) {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", "hpa", app, "-o", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, false
+	}
+	var hpa struct {
+		Spec struct {
+			MinReplicas int `json:"minReplicas"`
+			MaxReplicas int `json:"maxReplicas"`
+			Metrics     []struct {
+				Resource struct {
+					Target struct {
+						AverageUtilization int `json:"averageUtilization"`
+					} `json:"target"`
+				} `json:"resource"`
+			} `json:"metrics"`
+		} `json:"spec"`
+		Status struct {
+			CurrentReplicas int `json:"currentReplicas"`
+			DesiredReplicas int `json:"desiredReplicas"`
+			CurrentMetrics  []struct {
+				Resource struct {
+					Current struct {
+						AverageUtilization *int `json:"averageUtilization"`
+					} `json:"current"`
+				} `json:"resource"`
+			} `json:"currentMetrics"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &hpa); err != nil {
+		return nil, false
+	}
+	status := map[string]any{
+		"min":              hpa.Spec.MinReplicas,
+		"max":              hpa.Spec.MaxReplicas,
+		"current_replicas": hpa.Status.CurrentReplicas,
+		"desired_replicas": hpa.Status.DesiredReplicas,
+	}
+	if len(hpa.Spec.Metrics) > 0 {
+		status["target_cpu"] = hpa.Spec.Metrics[0].Resource.Target.AverageUtilization
+	}
+	if len(hpa.Status.CurrentMetrics) > 0 && hpa.Status.CurrentMetrics[0].Resource.Current.AverageUtilization != nil {
+		status["current_cpu"] = *hpa.Status.CurrentMetrics[0].Resource.Current.AverageUtilization
+	}
+	return status, true
+}
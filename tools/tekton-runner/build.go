@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var (
+	buildArgRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	targetRe   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	labelKeyRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	platformRe = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/v[0-9]+)?$`)
+	// buildPathRe keeps context_dir and dockerfile safe to substitute into
+	// the build script of the Task.
+	buildPathRe = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+)
+
+// platformsAnnotation lists the platforms a build Task can build, e.g.
+// "linux/amd64,linux/arm64".
+const platformsAnnotation = "tekton-runner/platforms"
+
+// PlatformImage is one image of the manifest list of a multi-platform build.
+type PlatformImage struct {
+	Platform string `json:"platform"`
+	Digest   string `json:"digest"`
+}
+
+// buildParam is a TaskRun param for a build option. List params are Tekton
+// array params.
+type buildParam struct {
+	Name  string
+	Value string
+	List  []string
+	Field string
+}
+
+func validateBuildOptions(img Image) error {
+	for field, p := range map[string]string{"image.context_dir": img.ContextDir, "image.dockerfile": img.Dockerfile} {
+		if p == "" {
+			continue
+		}
+		if !buildPathRe.MatchString(p) {
+			return fmt.Errorf("%s may only contain letters, digits, '.', '_', '-' and '/'", field)
+		}
+		if path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+			return fmt.Errorf("%s must be a relative path inside the source", field)
+		}
+	}
+	for k := range img.BuildArgs {
+		if !buildArgRe.MatchString(k) {
+			return fmt.Errorf("image.build_args: invalid name %q", k)
+		}
+	}
+	if img.Target != "" && !targetRe.MatchString(img.Target) {
+		return fmt.Errorf("image.target: invalid stage name %q", img.Target)
+	}
+	for k := range img.Labels {
+		if !labelKeyRe.MatchString(k) {
+			return fmt.Errorf("image.labels: invalid key %q", k)
+		}
+	}
+	return nil
+}
+
+// platformList splits a comma separated platform list.
+func platformList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// nodePlatform is the platform of the nodes an app of workspace runs on. A
+// workspace without a cluster yet gets a kind cluster on the runner host, so
+// the nodes of the runner cluster stand in for it; the runner's own
+// architecture is the last resort.
+func nodePlatform(workspace string) string {
+	args := []string{"get", "nodes", "-o", "jsonpath={..architecture}"}
+	cmds := []*exec.Cmd{kubectlCmd(args...)}
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	if _, err := os.Stat(kcfg); err == nil {
+		cmds = append([]*exec.Cmd{exec.Command("kubectl", append([]string{"--kubeconfig", kcfg}, args...)...)}, cmds...)
+	}
+	for _, cmd := range cmds {
+		out, err := cmd.Output()
+		if err != nil {
+			continue
+		}
+		if arch := strings.Fields(string(out)); len(arch) > 0 {
+			return "linux/" + arch[0]
+		}
+	}
+	return "linux/" + runtime.GOARCH
+}
+
+func validatePlatforms(in *Input) error {
+	platforms := platformList(in.Image.Platforms)
+	if len(platforms) == 0 {
+		return nil
+	}
+	if in.Source.Type == "image" {
+		return fmt.Errorf("image.platforms is only used when the image is built")
+	}
+	if in.Pipeline != nil {
+		return fmt.Errorf("image.platforms is not supported with pipeline")
+	}
+	seen := map[string]bool{}
+	for _, p := range platforms {
+		if !platformRe.MatchString(p) {
+			return fmt.Errorf("image.platforms: invalid platform %q", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("image.platforms: %s is listed twice", p)
+		}
+		seen[p] = true
+	}
+	if in.AppName != "" {
+		if node := nodePlatform(workspaceName(*in)); !seen[node] {
+			return fmt.Errorf("image.platforms must include %s to deploy to the workspace cluster", node)
+		}
+	}
+	return nil
+}
+
+// parsePlatformImages parses the IMAGE_PLATFORMS result of a build:
+// platform=digest pairs separated by commas.
+func parsePlatformImages(s string) []PlatformImage {
+	var out []PlatformImage
+	for _, pair := range strings.Split(s, ",") {
+		platform, digest, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && platformRe.MatchString(platform) && digestRe.MatchString(digest) {
+			out = append(out, PlatformImage{Platform: platform, Digest: digest})
+		}
+	}
+	return out
+}
+
+// buildParams returns the TaskRun params of the build options that are set.
+func buildParams(img Image) []buildParam {
+	var params []buildParam
+	if img.ContextDir != "" {
+		params = append(params, buildParam{Name: "context-dir", Value: yamlQuote(path.Clean(img.ContextDir)), Field: "image.context_dir"})
+	}
+	if img.Dockerfile != "" {
+		params = append(params, buildParam{Name: "dockerfile", Value: yamlQuote(path.Clean(img.Dockerfile)), Field: "image.dockerfile"})
+	}
+	if len(img.BuildArgs) > 0 {
+		params = append(params, buildParam{Name: "build-args", List: pairList(img.BuildArgs), Field: "image.build_args"})
+	}
+	if img.Target != "" {
+		params = append(params, buildParam{Name: "target", Value: yamlQuote(img.Target), Field: "image.target"})
+	}
+	if len(img.Labels) > 0 {
+		params = append(params, buildParam{Name: "labels", List: pairList(img.Labels), Field: "image.labels"})
+	}
+	if img.Platforms != "" {
+		params = append(params, buildParam{Name: "platforms", Value: yamlQuote(img.Platforms), Field: "image.platforms"})
+	}
+	params = append(params, buildModeParam(img)...)
+	return append(params, cacheParams(img)...)
+}
+
+func pairList(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for _, p := range sortedKV(m) {
+		out = append(out, yamlQuote(p.Key+"="+m[p.Key]))
+	}
+	return out
+}
+
+// checkTaskParams fails if the Task does not declare a param that the build
+// options of the request need, has no cache workspace for a pvc cache, or
+// cannot build a requested platform, so the TaskRun is not created at all.
+func checkTaskParams(in Input) error {
+	params := buildParams(in.Image)
+	if in.Source.Type == "image" || (len(params) == 0 && cacheClaim(in) == "") {
+		return nil
+	}
+	task := buildTask(in)
+	out, err := kubectlCmd("-n", in.Namespace, "get", "task", task, "-o", "json").Output()
+	if err != nil {
+		return fmt.Errorf("get task %s: %v", task, err)
+	}
+	var spec struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Params []struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"params"`
+			Workspaces []struct {
+				Name string `json:"name"`
+			} `json:"workspaces"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(out, &spec); err != nil {
+		return fmt.Errorf("parse task %s: %v", task, err)
+	}
+	declared := map[string]string{}
+	for _, p := range spec.Spec.Params {
+		declared[p.Name] = p.Type
+	}
+	for _, p := range params {
+		typ, ok := declared[p.Name]
+		if !ok {
+			return fmt.Errorf("%s: task %s has no %s param", p.Field, task, p.Name)
+		}
+		if p.List != nil && typ != "array" {
+			return fmt.Errorf("%s: param %s of task %s must be an array", p.Field, p.Name, task)
+		}
+		if p.List == nil && typ == "array" {
+			return fmt.Errorf("%s: param %s of task %s must be a string", p.Field, p.Name, task)
+		}
+	}
+	if cacheClaim(in) != "" {
+		found := false
+		for _, w := range spec.Spec.Workspaces {
+			found = found || w.Name == "cache"
+		}
+		if !found {
+			return fmt.Errorf("image.cache: task %s has no cache workspace", task)
+		}
+	}
+	if in.Image.Platforms == "" {
+		return nil
+	}
+	supported := map[string]bool{}
+	for _, p := range platformList(spec.Metadata.Annotations[platformsAnnotation]) {
+		supported[p] = true
+	}
+	if len(supported) == 0 {
+		return fmt.Errorf("image.platforms: task %s does not list its platforms in the %s annotation", task, platformsAnnotation)
+	}
+	for _, p := range platformList(in.Image.Platforms) {
+		if !supported[p] {
+			return fmt.Errorf("image.platforms: task %s does not support %s", task, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildCache keeps build caches of a project between builds: a PVC managed
+// by the runner (pvc) or a layer cache repository in the registry
+// (registry).
+type BuildCache struct {
+	Type string `json:"type"`
+	Size string `json:"size"`
+}
+
+// ProjectCache is the cache record of a project and the build durations of
+// its builds, by cache type ("none" for builds without a cache).
+type ProjectCache struct {
+	Project   string    `json:"project"`
+	Namespace string    `json:"namespace"`
+	Claim     string    `json:"claim,omitempty"`
+	ClaimSize string    `json:"claim_size,omitempty"`
+	Repo      string    `json:"repo,omitempty"`
+	LastUsed  time.Time `json:"last_used"`
+	// InUse counts the builds running with the cache. Caches in use are
+	// neither cleared nor evicted.
+	InUse  int                    `json:"in_use,omitempty"`
+	Builds map[string]*BuildStats `json:"builds"`
+}
+
+type BuildStats struct {
+	Count        int `json:"count"`
+	TotalSeconds int `json:"total_seconds"`
+	AvgSeconds   int `json:"avg_seconds"`
+	LastSeconds  int `json:"last_seconds"`
+}
+
+const (
+	cacheTypePVC      = "pvc"
+	cacheTypeRegistry = "registry"
+	cacheNone         = "none"
+
+	buildCacheLabel = "tekton-runner/build-cache"
+	cacheMountPath  = "/workspace/cache"
+)
+
+// cacheEnv points the usual package manager caches of test and lint stages
+// to the cache workspace. The env of the stage wins.
+var cacheEnv = map[string]string{
+	"XDG_CACHE_HOME":   cacheMountPath + "/xdg",
+	"GOMODCACHE":       cacheMountPath + "/go/mod",
+	"GOCACHE":          cacheMountPath + "/go/build",
+	"npm_config_cache": cacheMountPath + "/npm",
+	"PIP_CACHE_DIR":    cacheMountPath + "/pip",
+	"GRADLE_USER_HOME": cacheMountPath + "/gradle",
+}
+
+func envOr(name, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
+
+// buildCacheTTL is how long an unused cache is kept; registry layers older
+// than it are not reused.
+func buildCacheTTL() time.Duration {
+	d, err := time.ParseDuration(envOr("BUILD_CACHE_TTL", "336h"))
+	if err != nil || d <= 0 {
+		return 336 * time.Hour
+	}
+	return d
+}
+
+// quantityBytes converts a Kubernetes quantity to bytes.
+func quantityBytes(q string) (float64, bool) {
+	if !quantityRe.MatchString(q) {
+		return 0, false
+	}
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12}, {"m", 1e-3},
+	}
+	mult := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(q, u.suffix) {
+			q, mult = strings.TrimSuffix(q, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(q, 64)
+	return n * mult, err == nil
+}
+
+func setCacheDefaults(in *Input) {
+	c := in.Image.Cache
+	if c == nil {
+		return
+	}
+	c.Type = strings.ToLower(c.Type)
+	if c.Type == "" {
+		c.Type = cacheTypePVC
+	}
+	if c.Type == cacheTypePVC && c.Size == "" {
+		c.Size = envOr("BUILD_CACHE_SIZE", "5Gi")
+	}
+}
+
+func validateCache(in *Input) error {
+	c := in.Image.Cache
+	if c == nil {
+		return nil
+	}
+	if in.Source.Type == "image" {
+		return fmt.Errorf("image.cache is only used when the image is built")
+	}
+	switch c.Type {
+	case cacheTypePVC:
+		size, ok := quantityBytes(c.Size)
+		if !ok {
+			return fmt.Errorf("image.cache.size: invalid size %q", c.Size)
+		}
+		limit := envOr("BUILD_CACHE_MAX_SIZE", "20Gi")
+		if max, ok := quantityBytes(limit); ok && size > max {
+			return fmt.Errorf("image.cache.size must be at most %s", limit)
+		}
+	case cacheTypeRegistry:
+		if c.Size != "" {
+			return fmt.Errorf("image.cache.size is only used by pvc caches")
+		}
+	default:
+		return fmt.Errorf("image.cache.type must be pvc or registry")
+	}
+	return nil
+}
+
+// cacheType is the cache type of a build, "none" without a cache.
+func cacheType(in Input) string {
+	if in.Image.Cache == nil {
+		return cacheNone
+	}
+	return in.Image.Cache.Type
+}
+
+func cacheClaimName(project string) string {
+	return "build-cache-" + sanitizeName(project)
+}
+
+// cacheRepo is the registry repository with the layer cache of a project.
+func cacheRepo(img Image) string {
+	proj := strings.ToLower(img.Project)
+	return fmt.Sprintf("%s/%s/%s-cache", img.Registry, proj, proj)
+}
+
+// cacheClaim returns the PVC bound to the cache workspace of a build, or ""
+// without a pvc cache.
+func cacheClaim(in Input) string {
+	if in.Image.Cache == nil || in.Image.Cache.Type != cacheTypePVC {
+		return ""
+	}
+	return cacheClaimName(in.Image.Project)
+}
+
+// cacheParams are the build Task params of a registry cache.
+func cacheParams(img Image) []buildParam {
+	if img.Cache == nil || img.Cache.Type != cacheTypeRegistry {
+		return nil
+	}
+	return []buildParam{
+		{Name: "cache-repo", Value: yamlQuote(cacheRepo(img)), Field: "image.cache"},
+		{Name: "cache-ttl", Value: yamlQuote(buildCacheTTL().String()), Field: "image.cache"},
+	}
+}
+
+// renderCacheClaim renders the PVC of a pvc cache. The size of an existing
+// claim can only grow, and only if its StorageClass allows expansion.
+func renderCacheClaim(in Input) string {
+	tpl := `apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    {{.Label}}: {{.Project}}
+spec:
+  accessModes:
+    - ReadWriteOnce
+  resources:
+    requests:
+      storage: {{.Size}}
+`
+	return mustRender(tpl, map[string]string{
+		"Name":      cacheClaimName(in.Image.Project),
+		"Namespace": in.Namespace,
+		"Label":     buildCacheLabel,
+		"Project":   sanitizeName(in.Image.Project),
+		"Size":      in.Image.Cache.Size,
+	})
+}
+
+// withCacheEnv adds the cache env of test and lint stages to env.
+func withCacheEnv(env map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range cacheEnv {
+		out[k] = v
+	}
+	for k, v := range env {
+		out[k] = v
+	}
+	return out
+}
+
+type CacheStore struct {
+	mu     sync.Mutex
+	path   string
+	caches []ProjectCache
+}
+
+var cacheStore = &CacheStore{path: "/home/beko/build-caches.json"}
+
+func (s *CacheStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.caches = []ProjectCache{}
+			return nil
+		}
+		return err
+	}
+	if len(data) == 0 {
+		s.caches = []ProjectCache{}
+		return nil
+	}
+	var caches []ProjectCache
+	if err := json.Unmarshal(data, &caches); err != nil {
+		return err
+	}
+	// Builds are not followed across restarts.
+	for i := range caches {
+		caches[i].InUse = 0
+	}
+	s.caches = caches
+	return nil
+}
+
+func (s *CacheStore) get(ns, project string) (ProjectCache, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.caches {
+		if c.Namespace == ns && c.Project == project {
+			return c, true
+		}
+	}
+	return ProjectCache{}, false
+}
+
+func (s *CacheStore) list() []ProjectCache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ProjectCache(nil), s.caches...)
+}
+
+// update applies fn to the record of a project, creating it if needed.
+func (s *CacheStore) update(ns, project string, fn func(*ProjectCache)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := -1
+	for i, c := range s.caches {
+		if c.Namespace == ns && c.Project == project {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		s.caches = append(s.caches, ProjectCache{Project: project, Namespace: ns, Builds: map[string]*BuildStats{}})
+		idx = len(s.caches) - 1
+	}
+	if s.caches[idx].Builds == nil {
+		s.caches[idx].Builds = map[string]*BuildStats{}
+	}
+	fn(&s.caches[idx])
+	return s.save()
+}
+
+func (s *CacheStore) save() error {
+	b, err := json.MarshalIndent(s.caches, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// buildSeconds returns how long a finished TaskRun or PipelineRun ran.
+func buildSeconds(in Input, name string) (int, error) {
+	kind := "taskrun"
+	if in.Pipeline != nil {
+		kind = "pipelinerun"
+	}
+	out, err := kubectlCmd("-n", in.Namespace, "get", kind, name, "-o", "jsonpath={.status.startTime} {.status.completionTime}").Output()
+	if err != nil {
+		return 0, fmt.Errorf("get %s %s: %v", kind, name, err)
+	}
+	f := strings.Fields(string(out))
+	if len(f) != 2 {
+		return 0, fmt.Errorf("%s %s has no start or completion time", kind, name)
+	}
+	start, err1 := time.Parse(time.RFC3339, f[0])
+	end, err2 := time.Parse(time.RFC3339, f[1])
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("%s %s: invalid start or completion time", kind, name)
+	}
+	return int(end.Sub(start).Seconds()), nil
+}
+
+// acquireCache marks the cache of a build as used and in use until
+// releaseCache is called for it. Builds acquire it before their claim and
+// build run are submitted, so that eviction and clearing never delete a
+// cache a submitted build is about to mount.
+func acquireCache(in Input) {
+	typ := cacheType(in)
+	if typ == cacheNone {
+		return
+	}
+	project := strings.ToLower(in.Image.Project)
+	err := cacheStore.update(in.Namespace, project, func(c *ProjectCache) {
+		c.InUse++
+		c.LastUsed = time.Now().UTC()
+		switch typ {
+		case cacheTypePVC:
+			c.Claim = cacheClaimName(project)
+			c.ClaimSize = in.Image.Cache.Size
+		case cacheTypeRegistry:
+			c.Repo = cacheRepo(in.Image)
+		}
+	})
+	if err != nil {
+		log.Printf("build cache store: %v", err)
+	}
+}
+
+func releaseCache(in Input) {
+	if cacheType(in) == cacheNone {
+		return
+	}
+	err := cacheStore.update(in.Namespace, strings.ToLower(in.Image.Project), func(c *ProjectCache) {
+		if c.InUse > 0 {
+			c.InUse--
+		}
+	})
+	if err != nil {
+		log.Printf("build cache store: %v", err)
+	}
+}
+
+// recordBuild records the duration of a successful build on the run and in
+// the build stats of the project, and marks its cache as used.
+func recordBuild(in Input, name, runID string) {
+	secs, err := buildSeconds(in, name)
+	if err != nil {
+		log.Printf("run %s: build duration: %v", runID, err)
+		return
+	}
+	typ := cacheType(in)
+	if err := runStore.update(runID, func(r *Run) {
+		r.BuildSeconds = secs
+		r.Cache = typ
+	}); err != nil {
+		logRunError(runID, err)
+	}
+	project := strings.ToLower(in.Image.Project)
+	err = cacheStore.update(in.Namespace, project, func(c *ProjectCache) {
+		st := c.Builds[typ]
+		if st == nil {
+			st = &BuildStats{}
+			c.Builds[typ] = st
+		}
+		st.Count++
+		st.TotalSeconds += secs
+		st.AvgSeconds = st.TotalSeconds / st.Count
+		st.LastSeconds = secs
+		switch typ {
+		case cacheTypePVC:
+			c.Claim = cacheClaimName(project)
+			c.ClaimSize = in.Image.Cache.Size
+			c.LastUsed = time.Now().UTC()
+		case cacheTypeRegistry:
+			c.Repo = cacheRepo(in.Image)
+			c.LastUsed = time.Now().UTC()
+		}
+	})
+	if err != nil {
+		log.Printf("run %s: build cache store: %v", runID, err)
+	}
+}
+
+// clearCache deletes the caches of a project and returns what was deleted.
+// The build stats are kept.
+func clearCache(ns, project string) ([]string, error) {
+	c, ok := cacheStore.get(ns, project)
+	if !ok || (c.Claim == "" && c.Repo == "") {
+		return nil, errCacheNotFound
+	}
+	if c.InUse > 0 {
+		return nil, errCacheInUse
+	}
+	var cleared []string
+	if c.Claim != "" {
+		out, err := kubectlCmd("-n", ns, "delete", "pvc", c.Claim, "--ignore-not-found", "--wait=false").CombinedOutput()
+		if err != nil {
+			return cleared, fmt.Errorf("delete pvc %s: %v: %s", c.Claim, err, strings.TrimSpace(string(out)))
+		}
+		cleared = append(cleared, cacheTypePVC)
+	}
+	if c.Repo != "" {
+		if err := deleteRegistryRepo(ns, c.Repo); err != nil {
+			return cleared, err
+		}
+		cleared = append(cleared, cacheTypeRegistry)
+	}
+	err := cacheStore.update(ns, project, func(c *ProjectCache) {
+		c.Claim, c.ClaimSize, c.Repo = "", "", ""
+	})
+	return cleared, err
+}
+
+var (
+	errCacheNotFound = fmt.Errorf("project has no build cache")
+	errCacheInUse    = fmt.Errorf("build cache is used by a running build")
+)
+
+// deleteRegistryRepo deletes a repository through the Harbor API with the
+// credentials of the registry secret in the runner namespace.
+func deleteRegistryRepo(ns, repo string) error {
+	host, rest, _ := strings.Cut(repo, "/")
+	project, name, _ := strings.Cut(rest, "/")
+	user, pass, err := registryLogin(ns, host)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("https://%s/api/v2.0/projects/%s/repositories/%s", host, url.PathEscape(project), url.PathEscape(url.PathEscape(name)))
+	req, err := http.NewRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, pass)
+	tlsConfig, err := registryTLSConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("delete %s: %v", repo, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("delete %s: registry returned %s", repo, resp.Status)
+	}
+	return nil
+}
+
+// registryTLSConfig trusts the system CAs and the PEM certificates in
+// REGISTRY_CA_FILE, for registries with a private CA.
+func registryTLSConfig() (*tls.Config, error) {
+	file := strings.TrimSpace(os.Getenv("REGISTRY_CA_FILE"))
+	if file == "" {
+		return &tls.Config{}, nil
+	}
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("REGISTRY_CA_FILE: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("REGISTRY_CA_FILE: no certificates in %s", file)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// registrySecret is the docker config Secret the build Tasks push with.
+func registrySecret() string {
+	return envOr("REGISTRY_SECRET", "harbor-creds")
+}
+
+// registryLogin reads the login of host from the registry secret.
+func registryLogin(ns, host string) (string, string, error) {
+	secret := registrySecret()
+	_, data, err := readSecret(ns, secret)
+	if err != nil {
+		return "", "", err
+	}
+	config, ok := data[".dockerconfigjson"]
+	if !ok {
+		return "", "", fmt.Errorf("secret %s/%s has no key .dockerconfigjson", ns, secret)
+	}
+	var cfg struct {
+		Auths map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Auth     string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal([]byte(config), &cfg); err != nil {
+		return "", "", fmt.Errorf("parse secret %s/%s: %v", ns, secret, err)
+	}
+	a, ok := cfg.Auths[host]
+	if !ok {
+		return "", "", fmt.Errorf("secret %s/%s has no login for %s", ns, secret, host)
+	}
+	if a.Username == "" && a.Auth != "" {
+		b, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err == nil {
+			a.Username, a.Password, _ = strings.Cut(string(b), ":")
+		}
+	}
+	return a.Username, a.Password, nil
+}
+
+// evictBuildCaches deletes caches that were not used for BUILD_CACHE_TTL, then
+// the least recently used pvc caches while their total size is above
+// BUILD_CACHE_TOTAL_SIZE. Caches of running builds are kept but count
+// towards the total.
+func evictBuildCaches() {
+	ttl := buildCacheTTL()
+	var total float64
+	var claims []ProjectCache
+	for _, c := range cacheStore.list() {
+		if c.Claim == "" && c.Repo == "" {
+			continue
+		}
+		if c.InUse == 0 && time.Since(c.LastUsed) > ttl {
+			if _, err := clearCache(c.Namespace, c.Project); err != nil {
+				log.Printf("evict build cache of %s: %v", c.Project, err)
+			} else {
+				log.Printf("evicted build cache of %s, unused since %s", c.Project, c.LastUsed.Format(time.RFC3339))
+			}
+			continue
+		}
+		if c.Claim != "" {
+			size, _ := quantityBytes(c.ClaimSize)
+			total += size
+			if c.InUse == 0 {
+				claims = append(claims, c)
+			}
+		}
+	}
+	limit := envOr("BUILD_CACHE_TOTAL_SIZE", "100Gi")
+	max, ok := quantityBytes(limit)
+	if !ok {
+		return
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].LastUsed.Before(claims[j].LastUsed) })
+	for _, c := range claims {
+		if total <= max {
+			break
+		}
+		if _, err := clearCache(c.Namespace, c.Project); err != nil {
+			log.Printf("evict build cache of %s: %v", c.Project, err)
+			continue
+		}
+		size, _ := quantityBytes(c.ClaimSize)
+		total -= size
+		log.Printf("evicted build cache of %s, pvc caches are above %s", c.Project, limit)
+	}
+}
+
+// startCacheEviction runs evictBuildCaches every hour.
+func startCacheEviction() {
+	go func() {
+		for {
+			evictBuildCaches()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// projectCacheRoute splits /projects/{name}/cache[/clear].
+func projectCacheRoute(p string) (project, action string, ok bool) {
+	parts := strings.Split(strings.Trim(path.Clean(p), "/"), "/")
+	if len(parts) < 3 || parts[0] != "projects" || parts[2] != "cache" || len(parts) > 4 {
+		return "", "", false
+	}
+	if len(parts) == 4 {
+		action = parts[3]
+	}
+	return strings.ToLower(parts[1]), action, true
+}
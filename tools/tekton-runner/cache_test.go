@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuantityBytes(t *testing.T) {
+	tests := []struct {
+		q      string
+		want   float64
+		wantOK bool
+	}{
+		{"5Gi", 5 << 30, true},
+		{"512Mi", 512 << 20, true},
+		{"1.5Gi", 1.5 * (1 << 30), true},
+		{"2Ti", 2 << 40, true},
+		{"100", 100, true},
+		{"10G", 10e9, true},
+		{"500m", 0.5, true},
+		{"", 0, false},
+		{"Gi", 0, false},
+		{"5GB", 0, false},
+		{"-1Gi", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := quantityBytes(tt.q)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("quantityBytes(%q) = %v, %v, want %v, %v", tt.q, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestProjectCacheRoute(t *testing.T) {
+	tests := []struct {
+		path    string
+		project string
+		action  string
+		ok      bool
+	}{
+		{"/projects/Shop/cache", "shop", "", true},
+		{"/projects/shop/cache/", "shop", "", true},
+		{"/projects/shop/cache/clear", "shop", "clear", true},
+		{"/projects/shop", "", "", false},
+		{"/projects/shop/builds", "", "", false},
+		{"/projects/shop/cache/clear/now", "", "", false},
+		{"/projects/shop/../other/cache", "other", "", true},
+	}
+	for _, tt := range tests {
+		project, action, ok := projectCacheRoute(tt.path)
+		if project != tt.project || action != tt.action || ok != tt.ok {
+			t.Errorf("projectCacheRoute(%q) = %q, %q, %v, want %q, %q, %v", tt.path, project, action, ok, tt.project, tt.action, tt.ok)
+		}
+	}
+}
+
+func TestRegistryTLSConfig(t *testing.T) {
+	t.Setenv("REGISTRY_CA_FILE", "")
+	if c, err := registryTLSConfig(); err != nil || c.InsecureSkipVerify || c.RootCAs != nil {
+		t.Errorf("without a CA file: %+v, %v", c, err)
+	}
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(bad, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{bad, filepath.Join(dir, "missing.pem")} {
+		t.Setenv("REGISTRY_CA_FILE", f)
+		if _, err := registryTLSConfig(); err == nil {
+			t.Errorf("REGISTRY_CA_FILE=%s: no error", f)
+		}
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGISTRY_CA_FILE", ca)
+	c, err := registryTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("registry with the configured CA: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ComposeImport is the JSON body of POST /workspace/import-compose. The
+// compose file is given inline or read from the git/zip source, which is
+// also what services with a build section are built from.
+type ComposeImport struct {
+	Workspace   string `json:"workspace"`
+	Namespace   string `json:"namespace"`
+	Compose     string `json:"compose"`
+	ComposePath string `json:"compose_path"`
+	Source      Source `json:"source"`
+	Image       Image  `json:"image"`
+}
+
+var composeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// composeIgnored are service keys that have no workspace equivalent. They
+// are reported as warnings.
+var composeIgnored = map[string]string{
+	"restart":        "pods are always restarted",
+	"container_name": "the service name is used",
+	"hostname":       "the service name is used",
+	"networks":       "all apps of a workspace share one network",
+	"healthcheck":    "use deploy.readiness_probe",
+	"env_file":       "use environment",
+	"labels":         "not applied",
+	"logging":        "not applied",
+	"privileged":     "not allowed",
+	"cap_add":        "not allowed",
+	"network_mode":   "not supported",
+	"links":          "use the service name as host",
+	"extra_hosts":    "not supported",
+	"profiles":       "all services are imported",
+}
+
+// composeToStack translates a compose file into a workspace request. It
+// returns warnings for everything that is not carried over.
+func composeToStack(imp ComposeImport, data []byte) (StackRequest, []string, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return StackRequest{}, nil, fmt.Errorf("parse compose file: %v", err)
+	}
+	req := StackRequest{Workspace: imp.Workspace, Namespace: imp.Namespace}
+	var warnings []string
+	for _, key := range sortedKeys(doc) {
+		switch {
+		case key == "services", key == "volumes", key == "version", key == "name", strings.HasPrefix(key, "x-"):
+		default:
+			warnings = append(warnings, fmt.Sprintf("%s: not supported, ignored", key))
+		}
+	}
+	services, ok := doc["services"].(map[string]any)
+	if !ok || len(services) == 0 {
+		return req, warnings, fmt.Errorf("compose file has no services")
+	}
+	for _, name := range sortedKeys(services) {
+		svc, ok := services[name].(map[string]any)
+		if !ok {
+			return req, warnings, fmt.Errorf("services.%s: must be a mapping", name)
+		}
+		app, w, err := composeService(imp, name, svc)
+		warnings = append(warnings, w...)
+		if err != nil {
+			return req, warnings, err
+		}
+		req.Apps = append(req.Apps, app)
+	}
+	return req, warnings, nil
+}
+
+func composeService(imp ComposeImport, name string, svc map[string]any) (StackApp, []string, error) {
+	field := "services." + name
+	app := StackApp{Input: Input{AppName: sanitizeName(name)}}
+	var warnings []string
+	warn := func(key, format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf("%s.%s: %s", field, key, fmt.Sprintf(format, args...)))
+	}
+
+	image, _ := svc["image"].(string)
+	if build, ok := svc["build"]; ok {
+		if imp.Source.Type == "" || imp.Source.Type == "image" {
+			return app, warnings, fmt.Errorf("%s: build needs a git, zip or local source", field)
+		}
+		app.Source = imp.Source
+		app.Image = Image{Project: app.AppName, Registry: imp.Image.Registry, Tag: imp.Image.Tag}
+		context := "."
+		switch b := build.(type) {
+		case string:
+			context = b
+		case map[string]any:
+			for _, k := range sortedKeys(b) {
+				switch k {
+				case "context":
+					context = fmt.Sprint(b[k])
+				case "dockerfile":
+					app.Image.Dockerfile = fmt.Sprint(b[k])
+				case "target":
+					app.Image.Target = fmt.Sprint(b[k])
+				case "args":
+					app.Image.BuildArgs = composeMap(b[k])
+				case "labels":
+					app.Image.Labels = composeMap(b[k])
+				case "platforms":
+					if list, ok := b[k].([]any); ok {
+						var platforms []string
+						for _, p := range list {
+							platforms = append(platforms, fmt.Sprint(p))
+						}
+						app.Image.Platforms = strings.Join(platforms, ",")
+					}
+				default:
+					warn("build."+k, "not supported, the Task defaults are used")
+				}
+			}
+		}
+		dir := path.Join(path.Dir(imp.ComposePath), context)
+		if app.Source.Type == "local" {
+			app.Source.LocalPath = path.Join(app.Source.LocalPath, dir)
+		} else if dir != "." {
+			app.Image.ContextDir = dir
+		}
+		if image != "" {
+			warn("image", "%s ignored, the built image is pushed as %s", image, app.AppName)
+		}
+	} else if image != "" {
+		app.Source = Source{Type: "image", Image: image}
+	} else {
+		return app, warnings, fmt.Errorf("%s: image or build is required", field)
+	}
+
+	for _, key := range sortedKeys(svc) {
+		val := svc[key]
+		switch key {
+		case "image", "build":
+		case "ports", "expose":
+			items, _ := val.([]any)
+			for _, item := range items {
+				p, published, err := composePort(item)
+				if err != nil {
+					warn(key, "%v, skipped", err)
+					continue
+				}
+				if published != "" {
+					warn(key, "published port %s is not bound; use /external-map", published)
+				}
+				if !hasDeployPort(app.Deploy.Ports, p) {
+					app.Deploy.Ports = append(app.Deploy.Ports, p)
+				}
+			}
+		case "environment":
+			app.Deploy.Env = map[string]string{}
+			switch env := val.(type) {
+			case map[string]any:
+				for _, k := range sortedKeys(env) {
+					v := env[k]
+					if v == nil {
+						warn(key, "%s has no value, skipped", k)
+						continue
+					}
+					app.Deploy.Env[k] = fmt.Sprint(v)
+				}
+			case []any:
+				for _, e := range env {
+					k, v, ok := strings.Cut(fmt.Sprint(e), "=")
+					if !ok {
+						warn(key, "%s has no value, skipped", k)
+						continue
+					}
+					app.Deploy.Env[k] = v
+				}
+			}
+		case "command":
+			app.Deploy.Args = composeCommand(val)
+		case "entrypoint":
+			app.Deploy.Command = composeCommand(val)
+		case "working_dir":
+			app.Deploy.WorkingDir = fmt.Sprint(val)
+		case "depends_on":
+			switch deps := val.(type) {
+			case []any:
+				for _, d := range deps {
+					app.DependsOn = append(app.DependsOn, sanitizeName(fmt.Sprint(d)))
+				}
+			case map[string]any:
+				for _, d := range sortedKeys(deps) {
+					app.DependsOn = append(app.DependsOn, sanitizeName(d))
+				}
+			}
+		case "volumes":
+			items, _ := val.([]any)
+			for i, item := range items {
+				v, err := composeVolume(item)
+				if err != nil {
+					warn(key, "%v, skipped", err)
+					continue
+				}
+				if v.Name == "" {
+					v.Name = fmt.Sprintf("%s-data-%d", app.AppName, i)
+				}
+				app.Deploy.Volumes = append(app.Deploy.Volumes, v)
+			}
+		case "deploy":
+			d, _ := val.(map[string]any)
+			for _, k := range sortedKeys(d) {
+				if r, ok := d[k].(int); ok && k == "replicas" {
+					app.Deploy.Replicas = r
+					continue
+				}
+				warn("deploy."+k, "not supported, ignored")
+			}
+		default:
+			if reason, ok := composeIgnored[key]; ok {
+				warn(key, "ignored, %s", reason)
+			} else {
+				warn(key, "not supported, ignored")
+			}
+		}
+	}
+	if len(app.Deploy.Ports) == 0 {
+		warn("ports", "none given, the app is exposed on 8080")
+	}
+	return app, warnings, nil
+}
+
+// composePort parses a short ("8080:80/udp") or long port entry. It returns
+// the container port and the published host port, if any.
+func composePort(item any) (DeployPort, string, error) {
+	p := DeployPort{Protocol: "TCP"}
+	var target, published string
+	switch v := item.(type) {
+	case int:
+		target = strconv.Itoa(v)
+	case string:
+		spec := v
+		if s, proto, ok := strings.Cut(spec, "/"); ok {
+			spec = s
+			p.Protocol = strings.ToUpper(proto)
+		}
+		parts := strings.Split(spec, ":")
+		target = parts[len(parts)-1]
+		if len(parts) > 1 {
+			published = parts[len(parts)-2]
+		}
+	case map[string]any:
+		target = fmt.Sprint(v["target"])
+		if pub, ok := v["published"]; ok {
+			published = fmt.Sprint(pub)
+		}
+		if proto, ok := v["protocol"].(string); ok {
+			p.Protocol = strings.ToUpper(proto)
+		}
+	default:
+		return p, "", fmt.Errorf("invalid port %v", item)
+	}
+	n, err := strconv.Atoi(target)
+	if err != nil || n < 1 || n > 65535 {
+		return p, "", fmt.Errorf("port %v is not a single container port", item)
+	}
+	p.ContainerPort = n
+	return p, published, nil
+}
+
+func hasDeployPort(ports []DeployPort, p DeployPort) bool {
+	for _, q := range ports {
+		if q.ContainerPort == p.ContainerPort && q.Protocol == p.Protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// composeMap reads a mapping given either as a map or as a KEY=VALUE list.
+// Keys without a value are left out.
+func composeMap(val any) map[string]string {
+	out := map[string]string{}
+	switch m := val.(type) {
+	case map[string]any:
+		for k, v := range m {
+			if v != nil {
+				out[k] = fmt.Sprint(v)
+			}
+		}
+	case []any:
+		for _, e := range m {
+			if k, v, ok := strings.Cut(fmt.Sprint(e), "="); ok {
+				out[k] = v
+			}
+		}
+	}
+	return out
+}
+
+func composeCommand(val any) []string {
+	switch v := val.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			out = append(out, fmt.Sprint(s))
+		}
+		return out
+	}
+	return nil
+}
+
+// composeVolume parses a volume entry. Named volumes become claims; an
+// anonymous volume is returned without a name. Bind mounts are rejected.
+func composeVolume(item any) (Volume, error) {
+	var source, target string
+	switch v := item.(type) {
+	case string:
+		parts := strings.Split(v, ":")
+		if len(parts) == 1 {
+			target = parts[0]
+		} else {
+			source, target = parts[0], parts[1]
+		}
+	case map[string]any:
+		if t, ok := v["type"].(string); ok && t != "volume" {
+			return Volume{}, fmt.Errorf("%s mount %v is not supported", t, v["target"])
+		}
+		source, _ = v["source"].(string)
+		target, _ = v["target"].(string)
+	default:
+		return Volume{}, fmt.Errorf("invalid volume %v", item)
+	}
+	if strings.HasPrefix(source, ".") || strings.HasPrefix(source, "/") || strings.HasPrefix(source, "~") {
+		return Volume{}, fmt.Errorf("bind mount %s is not supported", source)
+	}
+	v := Volume{MountPath: target}
+	if source != "" {
+		v.Name = sanitizeName(source)
+	}
+	return v, nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadComposeFile reads the compose file from the zip or git source of an
+// import. Without compose_path the usual file names are tried.
+func loadComposeFile(imp *ComposeImport) ([]byte, error) {
+	names := composeFileNames
+	if imp.ComposePath != "" {
+		p := path.Clean(imp.ComposePath)
+		if strings.HasPrefix(p, "..") || path.IsAbs(p) {
+			return nil, fmt.Errorf("compose_path must be inside the source")
+		}
+		names = []string{p}
+	}
+	if imp.Source.Type != "git" && imp.Source.Type != "zip" {
+		return nil, fmt.Errorf("compose is required for %q sources", imp.Source.Type)
+	}
+	dir, err := fetchSource(imp.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	root := sourceRoot(dir)
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err == nil {
+			imp.ComposePath = name
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("no compose file found in source (tried %s)", strings.Join(names, ", "))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComposePort(t *testing.T) {
+	tests := []struct {
+		item          any
+		want          DeployPort
+		wantPublished string
+		wantErr       bool
+	}{
+		{8080, DeployPort{ContainerPort: 8080, Protocol: "TCP"}, "", false},
+		{"80", DeployPort{ContainerPort: 80, Protocol: "TCP"}, "", false},
+		{"8080:80", DeployPort{ContainerPort: 80, Protocol: "TCP"}, "8080", false},
+		{"127.0.0.1:5353:53/udp", DeployPort{ContainerPort: 53, Protocol: "UDP"}, "5353", false},
+		{map[string]any{"target": 9000, "published": 19000, "protocol": "tcp"}, DeployPort{ContainerPort: 9000, Protocol: "TCP"}, "19000", false},
+		{"3000-3005", DeployPort{}, "", true},
+		{"70000", DeployPort{}, "", true},
+		{[]any{80}, DeployPort{}, "", true},
+	}
+	for _, tt := range tests {
+		got, published, err := composePort(tt.item)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("composePort(%v) error = %v, want error %v", tt.item, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (got != tt.want || published != tt.wantPublished) {
+			t.Errorf("composePort(%v) = %+v, %q, want %+v, %q", tt.item, got, published, tt.want, tt.wantPublished)
+		}
+	}
+}
+
+func TestComposeVolume(t *testing.T) {
+	tests := []struct {
+		item    any
+		want    Volume
+		wantErr bool
+	}{
+		{"db-data:/var/lib/postgresql/data", Volume{Name: "db-data", MountPath: "/var/lib/postgresql/data"}, false},
+		{"db_data:/data:ro", Volume{Name: "db-data", MountPath: "/data"}, false},
+		{"/cache", Volume{MountPath: "/cache"}, false},
+		{map[string]any{"type": "volume", "source": "uploads", "target": "/uploads"}, Volume{Name: "uploads", MountPath: "/uploads"}, false},
+		{"./src:/app", Volume{}, true},
+		{"/etc/passwd:/etc/passwd", Volume{}, true},
+		{"~/.ssh:/root/.ssh", Volume{}, true},
+		{map[string]any{"type": "bind", "source": "/var/run/docker.sock", "target": "/var/run/docker.sock"}, Volume{}, true},
+		{42, Volume{}, true},
+	}
+	for _, tt := range tests {
+		got, err := composeVolume(tt.item)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("composeVolume(%v) error = %v, want error %v", tt.item, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("composeVolume(%v) = %+v, want %+v", tt.item, got, tt.want)
+		}
+	}
+}
+
+func TestComposeToStack(t *testing.T) {
+	compose := `
+version: "3.9"
+services:
+  web:
+    build:
+      context: ./web
+      dockerfile: Dockerfile.prod
+      args:
+        GO_VERSION: "1.22"
+    ports:
+      - "8080:8080"
+    environment:
+      DB_HOST: db
+      EMPTY:
+    depends_on:
+      - db
+    restart: always
+  db:
+    image: postgres:16
+    environment:
+      - POSTGRES_PASSWORD=secret
+    volumes:
+      - db-data:/var/lib/postgresql/data
+    deploy:
+      replicas: 2
+volumes:
+  db-data: {}
+networks:
+  default: {}
+`
+	imp := ComposeImport{
+		Workspace:   "ws-demo",
+		ComposePath: "deploy/compose.yaml",
+		Source:      Source{Type: "git", RepoURL: "https://example.com/demo.git"},
+		Image:       Image{Registry: "registry.local", Tag: "v1"},
+	}
+	req, warnings, err := composeToStack(imp, []byte(compose))
+	if err != nil {
+		t.Fatalf("composeToStack() error = %v", err)
+	}
+	if req.Workspace != "ws-demo" || len(req.Apps) != 2 {
+		t.Fatalf("composeToStack() = %+v, want two apps in ws-demo", req)
+	}
+	db, web := req.Apps[0], req.Apps[1]
+
+	if db.AppName != "db" || db.Source.Type != "image" || db.Source.Image != "postgres:16" {
+		t.Errorf("db source = %+v", db.Source)
+	}
+	if db.Deploy.Replicas != 2 || db.Deploy.Env["POSTGRES_PASSWORD"] != "secret" {
+		t.Errorf("db deploy = %+v", db.Deploy)
+	}
+	if want := []Volume{{Name: "db-data", MountPath: "/var/lib/postgresql/data"}}; !reflect.DeepEqual(db.Deploy.Volumes, want) {
+		t.Errorf("db volumes = %+v, want %+v", db.Deploy.Volumes, want)
+	}
+
+	if web.Source.Type != "git" || web.Image.Project != "web" || web.Image.Registry != "registry.local" || web.Image.Tag != "v1" {
+		t.Errorf("web build = %+v %+v", web.Source, web.Image)
+	}
+	if web.Image.ContextDir != "deploy/web" || web.Image.Dockerfile != "Dockerfile.prod" || web.Image.BuildArgs["GO_VERSION"] != "1.22" {
+		t.Errorf("web image = %+v", web.Image)
+	}
+	if want := []DeployPort{{ContainerPort: 8080, Protocol: "TCP"}}; !reflect.DeepEqual(web.Deploy.Ports, want) {
+		t.Errorf("web ports = %+v, want %+v", web.Deploy.Ports, want)
+	}
+	if want := map[string]string{"DB_HOST": "db"}; !reflect.DeepEqual(web.Deploy.Env, want) {
+		t.Errorf("web env = %v, want %v", web.Deploy.Env, want)
+	}
+	if !reflect.DeepEqual(web.DependsOn, []string{"db"}) {
+		t.Errorf("web depends_on = %v", web.DependsOn)
+	}
+
+	for _, want := range []string{
+		"networks: not supported, ignored",
+		"services.web.environment: EMPTY has no value, skipped",
+		"services.web.restart: ignored, pods are always restarted",
+		"services.web.ports: published port 8080 is not bound; use /external-map",
+		"services.db.ports: none given, the app is exposed on 8080",
+	} {
+		found := false
+		for _, w := range warnings {
+			if w == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing warning %q in %q", want, warnings)
+		}
+	}
+}
+
+func TestComposeToStackErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		imp     ComposeImport
+		compose string
+	}{
+		{"no services", ComposeImport{}, "version: '3'\n"},
+		{"invalid yaml", ComposeImport{}, "services: [\n"},
+		{"build without a source", ComposeImport{}, "services:\n  web:\n    build: .\n"},
+		{"no image or build", ComposeImport{}, "services:\n  web:\n    ports: [\"80\"]\n"},
+	}
+	for _, tt := range tests {
+		if _, _, err := composeToStack(tt.imp, []byte(tt.compose)); err == nil {
+			t.Errorf("%s: composeToStack() succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestLoadComposeFilePath(t *testing.T) {
+	for _, p := range []string{"../../../home/beko/port-map.json", "/home/beko/port-map.json", "deploy/../../compose.yaml"} {
+		imp := ComposeImport{ComposePath: p, Source: Source{Type: "git", RepoURL: "https://example.com/demo.git"}}
+		if _, err := loadComposeFile(&imp); err == nil || err.Error() != "compose_path must be inside the source" {
+			t.Errorf("loadComposeFile(%q) error = %v, want compose_path rejected", p, err)
+		}
+	}
+}
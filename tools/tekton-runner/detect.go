@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// BuildDetection is what an auto build found in the source: the language of
+// the project (dockerfile when the source has its own Dockerfile) and the
+// port the image listens on.
+type BuildDetection struct {
+	Language     string `json:"language"`
+	Generated    bool   `json:"generated"`
+	Port         int    `json:"port,omitempty"`
+	PortInferred bool   `json:"port_inferred,omitempty"`
+}
+
+const (
+	buildModeDockerfile = "dockerfile"
+	buildModeAuto       = "auto"
+
+	languageDockerfile = "dockerfile"
+)
+
+// setBuildModeDefaults must run before deploy.container_port gets its
+// default: auto builds without ports take the port from the build.
+func setBuildModeDefaults(in *Input) {
+	in.Image.BuildMode = strings.ToLower(in.Image.BuildMode)
+	if in.Image.BuildMode == "" {
+		in.Image.BuildMode = buildModeDockerfile
+	}
+	if in.Image.BuildMode == buildModeAuto && in.Deploy.ContainerPort == 0 && len(in.Deploy.Ports) == 0 {
+		in.InferPort = true
+	}
+}
+
+func validateBuildMode(in *Input) error {
+	switch in.Image.BuildMode {
+	case buildModeDockerfile:
+		return nil
+	case buildModeAuto:
+		if in.Source.Type == "image" {
+			return fmt.Errorf("image.build_mode is only used when the image is built")
+		}
+		return nil
+	}
+	return fmt.Errorf("image.build_mode must be dockerfile or auto")
+}
+
+// buildModeParam is the build-mode param of auto builds.
+func buildModeParam(img Image) []buildParam {
+	if img.BuildMode != buildModeAuto {
+		return nil
+	}
+	return []buildParam{{Name: "build-mode", Value: yamlQuote(buildModeAuto), Field: "image.build_mode"}}
+}
+
+// applyDetection reads the DETECTED_LANGUAGE and DETECTED_PORT results of an
+// auto build and records them on the run. Without deploy ports in the
+// request the app is deployed on the detected port.
+func applyDetection(in *Input, buildRun, runID string) {
+	if in.Image.BuildMode != buildModeAuto {
+		return
+	}
+	results, err := buildResults(*in, buildRun)
+	if err != nil {
+		log.Printf("run %s: %v", runID, err)
+		return
+	}
+	lang := results["DETECTED_LANGUAGE"]
+	if lang == "" {
+		log.Printf("run %s: %s has no DETECTED_LANGUAGE result", runID, buildRun)
+		return
+	}
+	d := BuildDetection{Language: lang, Generated: lang != languageDockerfile}
+	if p, err := strconv.Atoi(results["DETECTED_PORT"]); err == nil && p > 0 && p <= 65535 {
+		d.Port = p
+	}
+	if in.InferPort && d.Port != 0 {
+		in.Deploy.ContainerPort = d.Port
+		in.Deploy.Ports = defaultPorts(d.Port)
+		d.PortInferred = true
+	}
+	if err := runStore.update(runID, func(r *Run) { r.Detection = &d }); err != nil {
+		logRunError(runID, err)
+	}
+}
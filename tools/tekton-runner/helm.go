@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	deployTypeDeployment = "deployment"
+	deployTypeHelm       = "helm"
+)
+
+// HelmChart deploys an app as a Helm release. Chart is an oci:// reference,
+// an absolute path to a .tgz on the runner host, or a chart directory in the
+// git/zip source. The deployed image is set through the two value keys.
+type HelmChart struct {
+	Chart              string         `json:"chart"`
+	Version            string         `json:"version"`
+	Release            string         `json:"release"`
+	Values             map[string]any `json:"values"`
+	ImageRepositoryKey string         `json:"image_repository_key"`
+	ImageTagKey        string         `json:"image_tag_key"`
+	SkipImage          bool           `json:"skip_image"`
+}
+
+const (
+	helmChartDir = "/home/beko/charts"
+	// helmChartGrace keeps fresh chart archives of deploys that are still
+	// running when an older deploy of the app prunes the directory.
+	helmChartGrace = time.Hour
+)
+
+// usesDeployment reports whether the app is rendered by the runner itself.
+func usesDeployment(d Deploy) bool {
+	return d.Type == "" || d.Type == deployTypeDeployment
+}
+
+func setHelmDefaults(in *Input) {
+	h := in.Deploy.Helm
+	if h == nil {
+		return
+	}
+	if h.Release == "" {
+		h.Release = sanitizeName(in.AppName)
+	}
+	if h.ImageRepositoryKey == "" {
+		h.ImageRepositoryKey = "image.repository"
+	}
+	if h.ImageTagKey == "" {
+		h.ImageTagKey = "image.tag"
+	}
+}
+
+func validateHelm(in *Input) error {
+	h := in.Deploy.Helm
+	if h == nil || h.Chart == "" {
+		return fmt.Errorf("deploy.helm.chart is required for deploy.type=helm")
+	}
+	if len(h.Release) > 53 || !addonNameRe.MatchString(h.Release) {
+		return fmt.Errorf("deploy.helm.release must be a lowercase DNS label of at most 53 characters")
+	}
+	switch {
+	case strings.HasPrefix(h.Chart, "oci://"):
+	case filepath.IsAbs(h.Chart):
+		if !strings.HasSuffix(h.Chart, ".tgz") {
+			return fmt.Errorf("deploy.helm.chart: local charts must be .tgz files")
+		}
+		if h.Version != "" {
+			return fmt.Errorf("deploy.helm.version is only used for oci:// charts")
+		}
+	default:
+		if in.Source.Type != "git" && in.Source.Type != "zip" {
+			return fmt.Errorf("deploy.helm.chart: a chart path needs a git or zip source")
+		}
+		if strings.HasPrefix(path.Clean(h.Chart), "..") {
+			return fmt.Errorf("deploy.helm.chart must be inside the source")
+		}
+		if h.Version != "" {
+			return fmt.Errorf("deploy.helm.version is only used for oci:// charts")
+		}
+	}
+	if in.Deploy.Strategy != "" && in.Deploy.Strategy != strategyRolling {
+		return fmt.Errorf("deploy.strategy is not supported for helm")
+	}
+	if len(in.Deploy.SmokeTests) > 0 {
+		return fmt.Errorf("deploy.smoke_tests is not supported for helm")
+	}
+	return nil
+}
+
+// resolveHelmChart packages a chart directory from the app source so the
+// deploy, and later rollbacks, install a fixed .tgz. Other inputs are
+// returned as they are.
+func resolveHelmChart(in Input) (Input, error) {
+	h := in.Deploy.Helm
+	if in.Deploy.Type != deployTypeHelm || h == nil || strings.HasPrefix(h.Chart, "oci://") || filepath.IsAbs(h.Chart) {
+		return in, nil
+	}
+	src, err := fetchSource(in.Source)
+	if err != nil {
+		return in, err
+	}
+	defer os.RemoveAll(src)
+	chartDir := filepath.Join(sourceRoot(src), filepath.FromSlash(path.Clean(h.Chart)))
+	if _, err := os.Stat(filepath.Join(chartDir, "Chart.yaml")); err != nil {
+		return in, fmt.Errorf("deploy.helm.chart: no Chart.yaml in %s", h.Chart)
+	}
+	dest := filepath.Join(helmChartDir, workspaceName(in), sanitizeName(in.AppName), fmt.Sprint(time.Now().UnixNano()))
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return in, err
+	}
+	cmd := exec.Command("helm", "package", chartDir, "--dependency-update", "-d", dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return in, fmt.Errorf("helm package: %v", err)
+	}
+	pkgs, _ := filepath.Glob(filepath.Join(dest, "*.tgz"))
+	if len(pkgs) != 1 {
+		return in, fmt.Errorf("helm package: no chart archive in %s", dest)
+	}
+	resolved := *h
+	resolved.Chart = pkgs[0]
+	in.Deploy.Helm = &resolved
+	return in, nil
+}
+
+// pruneHelmCharts removes the chart archives of an app that no recorded
+// revision installs. Archives are packaged per deploy and kept only as long
+// as a rollback can still use them.
+func pruneHelmCharts(workspace, app string) {
+	dir := filepath.Join(helmChartDir, workspace, app)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	used := map[string]bool{}
+	for _, rev := range historyStore.list(workspace, app) {
+		if h := rev.Deploy.Helm; h != nil && strings.HasPrefix(h.Chart, dir+string(os.PathSeparator)) {
+			used[filepath.Dir(h.Chart)] = true
+		}
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		info, err := e.Info()
+		if err != nil || used[p] || time.Since(info.ModTime()) < helmChartGrace {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			log.Printf("prune chart %s: %v", p, err)
+		}
+	}
+}
+
+// helmValueArgs writes the values of a chart to a temporary file and returns
+// the version, values and image args of helm upgrade and helm template. The
+// caller removes the file.
+func helmValueArgs(image string, h HelmChart) ([]string, string, error) {
+	values, err := os.CreateTemp("", "values-*.json")
+	if err != nil {
+		return nil, "", err
+	}
+	if h.Values == nil {
+		h.Values = map[string]any{}
+	}
+	if err := json.NewEncoder(values).Encode(h.Values); err != nil {
+		values.Close()
+		os.Remove(values.Name())
+		return nil, "", err
+	}
+	values.Close()
+
+	args := []string{"-f", values.Name()}
+	if h.Version != "" {
+		args = append(args, "--version", h.Version)
+	}
+	if !h.SkipImage {
+		repo, tag := splitImageRef(image)
+		args = append(args, "--set-string", h.ImageRepositoryKey+"="+repo, "--set-string", h.ImageTagKey+"="+tag)
+	}
+	return args, values.Name(), nil
+}
+
+// deployHelm installs or upgrades the release of an app and waits for it.
+func deployHelm(kubeconfig, ns, image string, h HelmChart) error {
+	extra, values, err := helmValueArgs(image, h)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(values)
+
+	args := []string{"upgrade", "--install", h.Release, h.Chart,
+		"--kubeconfig", kubeconfig, "-n", ns, "--create-namespace",
+		"--wait", "--timeout", rolloutTimeout.String(),
+		// Keep as many release revisions as the deploy history, so that
+		// a rollback finds the values of any recorded revision.
+		"--history-max", strconv.Itoa(maxRevisions)}
+	cmd := exec.Command("helm", append(args, extra...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("helm upgrade %s: %v", h.Release, err)
+	}
+	return nil
+}
+
+// helmReleaseRevision returns the current revision of a release.
+func helmReleaseRevision(kubeconfig, ns, release string) (int, error) {
+	out, err := exec.Command("helm", "status", release, "--kubeconfig", kubeconfig, "-n", ns, "-o", "json").Output()
+	if err != nil {
+		return 0, fmt.Errorf("helm status %s: %v", release, err)
+	}
+	var rel struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(out, &rel); err != nil {
+		return 0, fmt.Errorf("parse helm status: %v", err)
+	}
+	return rel.Version, nil
+}
+
+// helmReleaseValues returns the values a release revision was installed
+// with.
+func helmReleaseValues(kubeconfig, ns, release string, revision int) (map[string]any, error) {
+	cmd := exec.Command("helm", "get", "values", release, "--revision", strconv.Itoa(revision), "--kubeconfig", kubeconfig, "-n", ns, "-o", "json")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("helm get values %s --revision %d: %v: %s", release, revision, err, strings.TrimSpace(stderr.String()))
+	}
+	var values map[string]any
+	if err := json.Unmarshal(out, &values); err != nil {
+		return nil, fmt.Errorf("parse helm values: %v", err)
+	}
+	return values, nil
+}
+
+// renderHelm returns the objects deployHelm would install, without a
+// cluster.
+func renderHelm(ns, image string, h HelmChart) (string, error) {
+	extra, values, err := helmValueArgs(image, h)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(values)
+
+	args := append([]string{"template", h.Release, h.Chart, "-n", ns}, extra...)
+	var stderr bytes.Buffer
+	cmd := exec.Command("helm", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("helm template %s: %v: %s", h.Release, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// splitImageRef splits an image reference into repository and tag. A digest
+// stays on the tag (tag@sha256:...) so charts that render repo:tag pin it.
+func splitImageRef(ref string) (string, string) {
+	name, digest, _ := strings.Cut(ref, "@")
+	repo, tag := name, "latest"
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		repo, tag = name[:i], name[i+1:]
+	}
+	if digest != "" {
+		tag += "@" + digest
+	}
+	return repo, tag
+}
+
+// helmRelease returns the release of an app that was last deployed with
+// Helm.
+func helmRelease(workspace, app string) (string, bool) {
+	revs := historyStore.list(workspace, app)
+	if len(revs) == 0 || revs[0].Deploy.Type != deployTypeHelm || revs[0].Deploy.Helm == nil {
+		return "", false
+	}
+	return revs[0].Deploy.Helm.Release, true
+}
+
+func getHelmAppStatus(kubeconfig, workspace, app, release string) ([]byte, error) {
+	cmd := exec.Command("helm", "status", release, "--kubeconfig", kubeconfig, "-n", workspace, "-o", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("helm status %s: %v", release, err)
+	}
+	var rel struct {
+		Version int `json:"version"`
+		Info    struct {
+			Status       string `json:"status"`
+			Description  string `json:"description"`
+			LastDeployed string `json:"last_deployed"`
+		} `json:"info"`
+		Chart struct {
+			Metadata struct {
+				Name       string `json:"name"`
+				Version    string `json:"version"`
+				AppVersion string `json:"appVersion"`
+			} `json:"metadata"`
+		} `json:"chart"`
+	}
+	if err := json.Unmarshal(out, &rel); err != nil {
+		return nil, fmt.Errorf("parse helm status: %v", err)
+	}
+
+	podsCmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "get", "pods", "-l", "app.kubernetes.io/instance="+release, "-o", "jsonpath={range .items[*]}{.metadata.name}|{.status.phase}|{.status.containerStatuses[0].ready}|{.status.containerStatuses[0].restartCount}{\"\\n\"}{end}")
+	podsOut, err := podsCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("get release pods failed: %v", err)
+	}
+	pods := []map[string]any{}
+	ready := rel.Info.Status == "deployed"
+	for _, line := range strings.Split(strings.TrimSpace(string(podsOut)), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) != 4 {
+			continue
+		}
+		var restarts int
+		fmt.Sscanf(parts[3], "%d", &restarts)
+		if parts[2] != "true" {
+			ready = false
+		}
+		pods = append(pods, map[string]any{
+			"name":     parts[0],
+			"phase":    parts[1],
+			"ready":    parts[2] == "true",
+			"restarts": restarts,
+		})
+	}
+	return json.Marshal(map[string]any{
+		"workspace": workspace,
+		"app":       app,
+		"ready":     ready,
+		"pods":      pods,
+		"helm": map[string]any{
+			"release":       release,
+			"revision":      rel.Version,
+			"status":        rel.Info.Status,
+			"description":   rel.Info.Description,
+			"last_deployed": rel.Info.LastDeployed,
+			"chart":         rel.Chart.Metadata.Name,
+			"chart_version": rel.Chart.Metadata.Version,
+			"app_version":   rel.Chart.Metadata.AppVersion,
+		},
+	})
+}
+
+func uninstallHelm(kubeconfig, workspace, release string) error {
+	cmd := exec.Command("helm", "uninstall", release, "--kubeconfig", kubeconfig, "-n", workspace, "--ignore-not-found")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("helm uninstall %s: %v", release, err)
+	}
+	return nil
+}
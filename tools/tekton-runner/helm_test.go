@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestSplitImageRef(t *testing.T) {
+	tests := []struct {
+		ref, repo, tag string
+	}{
+		{"nginx", "nginx", "latest"},
+		{"nginx:1.27", "nginx", "1.27"},
+		{"harbor.local/team/web:abc123", "harbor.local/team/web", "abc123"},
+		{"harbor.local:5000/team/web", "harbor.local:5000/team/web", "latest"},
+		{"harbor.local:5000/team/web:v2", "harbor.local:5000/team/web", "v2"},
+		{"harbor.local/team/web@sha256:0123", "harbor.local/team/web", "latest@sha256:0123"},
+		{"harbor.local/team/web:v2@sha256:0123", "harbor.local/team/web", "v2@sha256:0123"},
+	}
+	for _, tt := range tests {
+		if repo, tag := splitImageRef(tt.ref); repo != tt.repo || tag != tt.tag {
+			t.Errorf("splitImageRef(%q) = %q, %q, want %q, %q", tt.ref, repo, tag, tt.repo, tt.tag)
+		}
+	}
+}
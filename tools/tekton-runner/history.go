@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DeployRevision is one deploy of an app: the image and spec that were
+// applied and the run that applied them.
+type DeployRevision struct {
+	Revision   int    `json:"revision"`
+	RunID      string `json:"run_id,omitempty"`
+	Image      string `json:"image"`
+	Namespace  string `json:"namespace"`
+	Deploy     Deploy `json:"deploy"`
+	RollbackOf int    `json:"rollback_of,omitempty"`
+	// HelmRevision is the release revision of a helm deploy. Helm keeps its
+	// values, which the history leaves out.
+	HelmRevision int       `json:"helm_revision,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+type AppHistory struct {
+	Workspace string           `json:"workspace"`
+	App       string           `json:"app"`
+	Revisions []DeployRevision `json:"revisions"`
+}
+
+const maxRevisions = 50
+
+var errRevisionNotFound = fmt.Errorf("revision not found")
+
+type HistoryStore struct {
+	mu   sync.Mutex
+	path string
+	apps []AppHistory
+}
+
+var historyStore = &HistoryStore{path: "/home/beko/deploy-history.json"}
+
+func (s *HistoryStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.apps = []AppHistory{}
+			return nil
+		}
+		return err
+	}
+	if len(data) == 0 {
+		s.apps = []AppHistory{}
+		return nil
+	}
+	var apps []AppHistory
+	if err := json.Unmarshal(data, &apps); err != nil {
+		return err
+	}
+	s.apps = apps
+	return nil
+}
+
+// list returns the revisions of an app, newest first.
+func (s *HistoryStore) list(workspace, app string) []DeployRevision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.apps {
+		if h.Workspace == workspace && h.App == app {
+			out := make([]DeployRevision, 0, len(h.Revisions))
+			for i := len(h.Revisions) - 1; i >= 0; i-- {
+				out = append(out, h.Revisions[i])
+			}
+			return out
+		}
+	}
+	return []DeployRevision{}
+}
+
+// latest returns the newest revision of every app of a workspace.
+func (s *HistoryStore) latest(workspace string) map[string]DeployRevision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]DeployRevision{}
+	for _, h := range s.apps {
+		if h.Workspace == workspace && len(h.Revisions) > 0 {
+			out[h.App] = h.Revisions[len(h.Revisions)-1]
+		}
+	}
+	return out
+}
+
+func (s *HistoryStore) get(workspace, app string, revision int) (DeployRevision, error) {
+	for _, r := range s.list(workspace, app) {
+		if r.Revision == revision {
+			return r, nil
+		}
+	}
+	return DeployRevision{}, fmt.Errorf("%w: %d for %s/%s", errRevisionNotFound, revision, workspace, app)
+}
+
+// add appends a revision to the app history and returns its number. Secret
+// values of the deploy spec are not stored (see redactDeploy).
+func (s *HistoryStore) add(workspace, app string, rev DeployRevision) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := -1
+	for i, h := range s.apps {
+		if h.Workspace == workspace && h.App == app {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		s.apps = append(s.apps, AppHistory{Workspace: workspace, App: app})
+		idx = len(s.apps) - 1
+	}
+	h := &s.apps[idx]
+	rev.Deploy = redactDeploy(rev.Deploy)
+	rev.Revision = 1
+	if n := len(h.Revisions); n > 0 {
+		rev.Revision = h.Revisions[n-1].Revision + 1
+	}
+	rev.Time = time.Now().UTC()
+	h.Revisions = append(h.Revisions, rev)
+	if len(h.Revisions) > maxRevisions {
+		h.Revisions = h.Revisions[len(h.Revisions)-maxRevisions:]
+	}
+	return rev.Revision, s.save()
+}
+
+func (s *HistoryStore) removeWorkspace(workspace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]AppHistory, 0, len(s.apps))
+	for _, h := range s.apps {
+		if h.Workspace == workspace {
+			continue
+		}
+		out = append(out, h)
+	}
+	s.apps = out
+	return s.save()
+}
+
+func (s *HistoryStore) save() error {
+	b, err := json.MarshalIndent(s.apps, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// redactDeploy drops the values of d that must not be written to the
+// history file or served by /app/history. Inline env_from_secret values
+// and the data of manifest Secrets only live in the Secrets in the
+// workspace and helm values in the release; restoreDeploy reads them back
+// from there when a revision is re-applied.
+func redactDeploy(d Deploy) Deploy {
+	if d.Helm != nil && d.Helm.Values != nil {
+		h := *d.Helm
+		h.Values = nil
+		d.Helm = &h
+	}
+	if d.Manifests != nil {
+		// Rendered holds the objects of the revision; the inline body, and
+		// the literals of a kustomization, are not needed to re-apply it.
+		m := *d.Manifests
+		m.Inline = ""
+		m.Rendered = redactManifestSecrets(m.Rendered)
+		d.Manifests = &m
+	}
+	if len(d.EnvFromSecret) > 0 {
+		env := make(map[string]SecretEnv, len(d.EnvFromSecret))
+		for k, v := range d.EnvFromSecret {
+			v.Value = ""
+			env[k] = v
+		}
+		d.EnvFromSecret = env
+	}
+	return d
+}
+
+// restoreDeploy returns the deploy spec of a recorded revision with the
+// values redactDeploy dropped. Helm values come from the release revision,
+// manifest Secret data from the workspace Secrets and inline secret env
+// values from the env Secret of owner, the workload that currently runs the
+// app.
+func restoreDeploy(kubeconfig, workspace, owner string, rev DeployRevision) (Deploy, error) {
+	d := rev.Deploy
+	if usesManifests(d) && d.Manifests != nil {
+		rendered, err := restoreManifestSecrets(kubeconfig, workspace, d.Manifests.Rendered)
+		if err != nil {
+			return d, err
+		}
+		m := *d.Manifests
+		m.Rendered = rendered
+		d.Manifests = &m
+		return d, nil
+	}
+	if d.Type == deployTypeHelm && d.Helm != nil && rev.HelmRevision > 0 {
+		values, err := helmReleaseValues(kubeconfig, workspace, d.Helm.Release, rev.HelmRevision)
+		if err != nil {
+			return d, err
+		}
+		h := *d.Helm
+		h.Values = values
+		d.Helm = &h
+		return d, nil
+	}
+	var inline []string
+	for k, v := range d.EnvFromSecret {
+		if v.Secret == "" {
+			inline = append(inline, k)
+		}
+	}
+	if len(inline) == 0 {
+		return d, nil
+	}
+	secret := envConfigName(owner)
+	values, err := workspaceSecretData(kubeconfig, workspace, secret)
+	if err != nil {
+		return d, err
+	}
+	env := make(map[string]SecretEnv, len(d.EnvFromSecret))
+	for k, v := range d.EnvFromSecret {
+		env[k] = v
+	}
+	for _, k := range inline {
+		val, ok := values[k]
+		if !ok {
+			return d, fmt.Errorf("deploy.env_from_secret %s: inline values are not kept in the history and secret %s has no key %s", k, secret, k)
+		}
+		env[k] = SecretEnv{Value: val}
+	}
+	d.EnvFromSecret = env
+	return d, nil
+}
+
+// recordDeploy adds a successful deploy of in to the app history.
+func recordDeploy(in Input, image, runID string) (int, error) {
+	return recordRevision(workspaceName(in), sanitizeName(in.AppName), DeployRevision{
+		RunID:     runID,
+		Image:     image,
+		Namespace: in.Namespace,
+		Deploy:    in.Deploy,
+	})
+}
+
+// recordRevision adds rev to the app history. Helm deploys also record the
+// release revision they created and prune unused chart archives.
+func recordRevision(workspace, app string, rev DeployRevision) (int, error) {
+	h := rev.Deploy.Helm
+	if rev.Deploy.Type != deployTypeHelm || h == nil {
+		return historyStore.add(workspace, app, rev)
+	}
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	helmRev, err := helmReleaseRevision(kcfg, workspace, h.Release)
+	if err != nil {
+		return 0, err
+	}
+	rev.HelmRevision = helmRev
+	n, err := historyStore.add(workspace, app, rev)
+	if err == nil {
+		pruneHelmCharts(workspace, app)
+	}
+	return n, err
+}
+
+// rollbackApp re-applies the image and spec of a previous revision. The
+// rollback is recorded as a new revision with its own run.
+func rollbackApp(workspace, app string, to int) (Run, int, error) {
+	rev, err := historyStore.get(workspace, app, to)
+	if err != nil {
+		return Run{}, 0, err
+	}
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	d, err := restoreDeploy(kcfg, workspace, configOwner(kcfg, workspace, app), rev)
+	if err != nil {
+		return Run{}, 0, err
+	}
+	in := Input{
+		Namespace: rev.Namespace,
+		AppName:   app,
+		Workspace: workspace,
+		Deploy:    d,
+		Source:    Source{Type: "image", Image: rev.Image},
+	}
+	run := Run{
+		ID:        newRunID(),
+		Source:    "rollback",
+		Workspace: workspace,
+		App:       app,
+		Image:     rev.Image,
+		Status:    runDeploying,
+	}
+	if err := runStore.create(run); err != nil {
+		return Run{}, 0, err
+	}
+	err = checkSignature(in, rev.Image, run.ID)
+	if err == nil {
+		err = deployApp(in, rev.Image)
+	}
+	runStore.finish(run.ID, err)
+	if err != nil {
+		return Run{}, 0, err
+	}
+	n, err := recordRevision(workspace, app, DeployRevision{
+		RunID:      run.ID,
+		Image:      rev.Image,
+		Namespace:  rev.Namespace,
+		Deploy:     d,
+		RollbackOf: to,
+	})
+	if err != nil {
+		return Run{}, 0, err
+	}
+	run, _ = runStore.get(run.ID)
+	return run, n, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestRedactDeploy(t *testing.T) {
+	d := Deploy{
+		Env: map[string]string{"LOG_LEVEL": "debug"},
+		EnvFromSecret: map[string]SecretEnv{
+			"TOKEN":       {Value: "inline-token"},
+			"DB_PASSWORD": {Secret: "app-db", Key: "password"},
+		},
+		Helm: &HelmChart{Release: "web", Values: map[string]any{"password": "p"}},
+	}
+	got := redactDeploy(d)
+	if v := got.EnvFromSecret["TOKEN"]; v.Value != "" {
+		t.Errorf("inline value kept: %q", v.Value)
+	}
+	if v := got.EnvFromSecret["DB_PASSWORD"]; v.Secret != "app-db" || v.Key != "password" {
+		t.Errorf("secret reference changed: %+v", v)
+	}
+	if got.Env["LOG_LEVEL"] != "debug" {
+		t.Errorf("plain env changed: %v", got.Env)
+	}
+	if got.Helm.Values != nil || got.Helm.Release != "web" {
+		t.Errorf("helm values kept: %+v", got.Helm)
+	}
+	if d.Helm.Values == nil || d.EnvFromSecret["TOKEN"].Value != "inline-token" {
+		t.Errorf("redactDeploy changed its argument")
+	}
+}
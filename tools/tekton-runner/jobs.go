@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	kindDeployment = "deployment"
+	kindJob        = "job"
+	kindCronJob    = "cronjob"
+
+	// runJobLabel marks Jobs started with /app/run-job.
+	runJobLabel    = "tekton-runner/run-job"
+	defaultJobTTL  = 3600
+	jobTimeout     = 30 * time.Minute
+	jobPodDeadline = "5m"
+)
+
+var errAppNotDeployed = errors.New("app has no deploy history")
+
+var cronFieldRe = regexp.MustCompile(`^[-*/,0-9A-Za-z?]+$`)
+
+// cronMacros are the schedule shorthands a CronJob accepts.
+var cronMacros = map[string]bool{
+	"@yearly": true, "@annually": true, "@monthly": true, "@weekly": true,
+	"@daily": true, "@midnight": true, "@hourly": true,
+}
+
+// JobRun is the body of POST /app/run-job. Command and args replace those of
+// the app; env is added to the app env.
+type JobRun struct {
+	Command        []string          `json:"command"`
+	Args           []string          `json:"args"`
+	Env            map[string]string `json:"env"`
+	TimeoutSeconds int               `json:"timeout_seconds"`
+}
+
+func isJobKind(kind string) bool {
+	return kind == kindJob || kind == kindCronJob
+}
+
+func validateKind(in *Input) error {
+	d := in.Deploy
+	switch d.Kind {
+	case "", kindDeployment, kindStatefulSet:
+		if d.Schedule != "" || d.ConcurrencyPolicy != "" || d.BackoffLimit != nil || d.TTLSecondsAfterFinished != nil || d.ActiveDeadlineSeconds != 0 {
+			return fmt.Errorf("deploy.schedule, concurrency_policy, backoff_limit, ttl_seconds_after_finished and active_deadline_seconds are only used for job and cronjob")
+		}
+		if d.Kind == kindStatefulSet {
+			return validateStatefulSet(d)
+		}
+		return nil
+	case kindJob, kindCronJob:
+	default:
+		return fmt.Errorf("deploy.kind must be deployment, statefulset, job or cronjob")
+	}
+	if !usesDeployment(d) {
+		return fmt.Errorf("deploy.kind is only used with deploy.type=deployment")
+	}
+	if d.Kind == kindCronJob {
+		if err := validateSchedule(d.Schedule); err != nil {
+			return err
+		}
+	} else if d.Schedule != "" || d.ConcurrencyPolicy != "" {
+		return fmt.Errorf("deploy.schedule and concurrency_policy are only used for cronjob")
+	}
+	switch d.ConcurrencyPolicy {
+	case "", "Allow", "Forbid", "Replace":
+	default:
+		return fmt.Errorf("deploy.concurrency_policy must be Allow, Forbid or Replace")
+	}
+	if d.BackoffLimit != nil && *d.BackoffLimit < 0 {
+		return fmt.Errorf("deploy.backoff_limit must not be negative")
+	}
+	if d.TTLSecondsAfterFinished != nil && *d.TTLSecondsAfterFinished < 0 {
+		return fmt.Errorf("deploy.ttl_seconds_after_finished must not be negative")
+	}
+	if d.ActiveDeadlineSeconds < 0 {
+		return fmt.Errorf("deploy.active_deadline_seconds must not be negative")
+	}
+	if d.Strategy != "" && d.Strategy != strategyRolling {
+		return fmt.Errorf("deploy.strategy is not supported for %s", d.Kind)
+	}
+	if len(d.SmokeTests) > 0 {
+		return fmt.Errorf("deploy.smoke_tests is not supported for %s", d.Kind)
+	}
+	if d.Readiness != nil {
+		return fmt.Errorf("deploy.readiness_probe is not supported for %s", d.Kind)
+	}
+	if d.Replicas > 1 {
+		return fmt.Errorf("deploy.replicas is not supported for %s", d.Kind)
+	}
+	return nil
+}
+
+// validateSchedule checks the shape of a cron schedule; the values are
+// checked by the API server.
+func validateSchedule(s string) error {
+	if strings.HasPrefix(s, "@") {
+		if !cronMacros[s] {
+			return fmt.Errorf("deploy.schedule: unknown macro %q", s)
+		}
+		return nil
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return fmt.Errorf("deploy.schedule must be a cron expression with 5 fields")
+	}
+	for _, f := range fields {
+		if !cronFieldRe.MatchString(f) {
+			return fmt.Errorf("deploy.schedule: invalid field %q", f)
+		}
+	}
+	return nil
+}
+
+// appKind returns the workload kind of the last deploy of an app.
+func appKind(workspace, app string) string {
+	revs := historyStore.list(workspace, app)
+	if len(revs) == 0 || revs[0].Deploy.Kind == "" {
+		return kindDeployment
+	}
+	return revs[0].Deploy.Kind
+}
+
+// deployJob applies a job or cronjob app. A Job cannot be changed, so the
+// previous one is replaced and the deploy waits until the new one finished.
+func deployJob(kubeconfig, ns, app, image string, d Deploy, secretEnv map[string]string) error {
+	stale := "deployment,service,cronjob,job"
+	if d.Kind == kindCronJob {
+		stale = "deployment,service,job"
+	}
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "delete", stale, app, "--ignore-not-found")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("replace %s: %v", app, err)
+	}
+	if err := applyDeployment(kubeconfig, ns, app, image, d, secretEnv); err != nil {
+		return err
+	}
+	if d.Kind == kindCronJob {
+		return nil
+	}
+	timeout := jobTimeout
+	if d.ActiveDeadlineSeconds > 0 {
+		timeout = time.Duration(d.ActiveDeadlineSeconds)*time.Second + time.Minute
+	}
+	return waitForJob(kubeconfig, ns, app, timeout)
+}
+
+func waitForJob(kubeconfig, ns, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", "job", name, "-o", `jsonpath={.status.conditions[?(@.type=="Complete")].status}|{.status.conditions[?(@.type=="Failed")].status}|{.status.conditions[?(@.type=="Failed")].message}`)
+		out, err := cmd.Output()
+		if err == nil {
+			parts := strings.SplitN(strings.TrimSpace(string(out)), "|", 3)
+			if len(parts) == 3 {
+				if parts[0] == "True" {
+					return nil
+				}
+				if parts[1] == "True" {
+					return fmt.Errorf("job %s failed: %s", name, parts[2])
+				}
+			}
+		}
+		time.Sleep(3 * time.Second)
+	}
+	return fmt.Errorf("timeout waiting for job %s", name)
+}
+
+// runAppJob starts a Job from the image and config of an app's last deploy.
+// The volumes of deployment and statefulset apps are ReadWriteOnce claims
+// held by the running pods, so the Job does not mount them.
+func runAppJob(workspace, app string, req JobRun) (string, error) {
+	revs := historyStore.list(workspace, app)
+	if len(revs) == 0 {
+		return "", errAppNotDeployed
+	}
+	rev := revs[0]
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	owner := configOwner(kcfg, workspace, app)
+	prefix := app
+	if len(prefix) > 40 {
+		prefix = prefix[:40]
+	}
+	name := prefix + "-run-" + randSuffix()
+	d := rev.Deploy
+	command, args := d.Command, d.Args
+	if req.Command != nil {
+		command = req.Command
+	}
+	if req.Args != nil {
+		args = req.Args
+	}
+	var files []configFileMount
+	if usesDeployment(d) {
+		files = configFileMounts(d.ConfigFiles)
+	}
+	var volumes []map[string]string
+	if isJobKind(d.Kind) {
+		for _, v := range d.Volumes {
+			volumes = append(volumes, map[string]string{"Name": volumeName(v), "Claim": v.Name, "MountPath": yamlQuote(v.MountPath)})
+		}
+	}
+	tpl := `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    {{.Label}}: {{.App}}
+spec:
+  backoffLimit: 0
+  ttlSecondsAfterFinished: {{.TTL}}
+{{- if .Deadline }}
+  activeDeadlineSeconds: {{.Deadline}}
+{{- end }}
+  template:
+    metadata:
+      labels:
+        {{.Label}}: {{.App}}
+    spec:
+      restartPolicy: Never
+      containers:
+        - name: {{.App}}
+          image: {{.Image}}
+{{- if .Command }}
+          command: {{.Command}}
+{{- end }}
+{{- if .Args }}
+          args: {{.Args}}
+{{- end }}
+{{- if .WorkingDir }}
+          workingDir: {{.WorkingDir}}
+{{- end }}
+{{- if .Env }}
+          env:
+{{- range .Env }}
+            - name: {{.Key}}
+              value: {{.Value}}
+{{- end }}
+{{- end }}
+          envFrom:
+            - configMapRef:
+                name: {{.EnvName}}
+                optional: true
+            - secretRef:
+                name: {{.EnvName}}
+                optional: true
+{{- if or .Files .Volumes }}
+          volumeMounts:
+{{- range .Files }}
+            - name: config-files
+              mountPath: {{.MountPath}}
+              subPath: {{.Key}}
+{{- end }}
+{{- range .Volumes }}
+            - name: {{.Name}}
+              mountPath: {{.MountPath}}
+{{- end }}
+      volumes:
+{{- if .Files }}
+        - name: config-files
+          configMap:
+            name: {{.FilesName}}
+{{- end }}
+{{- range .Volumes }}
+        - name: {{.Name}}
+          persistentVolumeClaim:
+            claimName: {{.Claim}}
+{{- end }}
+{{- end }}
+`
+	manifest := mustRender(tpl, map[string]any{
+		"Name":       name,
+		"Namespace":  workspace,
+		"Label":      runJobLabel,
+		"App":        app,
+		"TTL":        defaultJobTTL,
+		"Deadline":   req.TimeoutSeconds,
+		"Image":      rev.Image,
+		"Command":    yamlList(command),
+		"Args":       yamlList(args),
+		"WorkingDir": quoteIfSet(d.WorkingDir),
+		"Env":        sortedKV(req.Env),
+		"EnvName":    envConfigName(owner),
+		"Files":      files,
+		"FilesName":  filesConfigName(owner),
+		"Volumes":    volumes,
+	})
+	if err := kubectlApplyTo(kcfg, manifest); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// streamJobLogs follows the logs of a Job and then reports how it ended.
+func streamJobLogs(workspace, name string, timeout time.Duration, out io.Writer) error {
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "logs", "-f", "job/"+name, "--pod-running-timeout="+jobPodDeadline)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	_ = cmd.Run()
+	return waitForJob(kcfg, workspace, name, timeout)
+}
+
+// flushWriter sends every write to the client right away.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// getJobAppStatus reports the Jobs of a job or cronjob app and the Jobs
+// started with /app/run-job.
+func getJobAppStatus(kubeconfig, workspace, app, kind string) ([]byte, error) {
+	jobs, err := listJobs(kubeconfig, workspace, "app="+app)
+	if err != nil {
+		return nil, err
+	}
+	runs, err := listJobs(kubeconfig, workspace, runJobLabel+"="+app)
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]any{
+		"workspace": workspace,
+		"app":       app,
+		"kind":      kind,
+		"jobs":      jobs,
+		"runs":      runs,
+	}
+	if kind == kindCronJob {
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "get", "cronjob", app, "-o", "jsonpath={.spec.schedule}|{.spec.suspend}|{.status.lastScheduleTime}|{.status.lastSuccessfulTime}")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("get cronjob failed: %v", err)
+		}
+		parts := strings.Split(strings.TrimSpace(string(out)), "|")
+		for len(parts) < 4 {
+			parts = append(parts, "")
+		}
+		status["schedule"] = parts[0]
+		status["suspended"] = parts[1] == "true"
+		status["last_schedule_time"] = parts[2]
+		status["last_successful_time"] = parts[3]
+		status["ready"] = true
+	} else {
+		ready := false
+		for _, j := range jobs {
+			if j["name"] == app {
+				ready = j["succeeded"].(int) > 0
+			}
+		}
+		status["ready"] = ready
+	}
+	return json.Marshal(status)
+}
+
+func listJobs(kubeconfig, workspace, selector string) ([]map[string]any, error) {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "get", "jobs", "-l", selector, "--sort-by=.metadata.creationTimestamp", "-o", "jsonpath={range .items[*]}{.metadata.name}|{.status.active}|{.status.succeeded}|{.status.failed}|{.status.startTime}|{.status.completionTime}{\"\\n\"}{end}")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("get jobs failed: %v", err)
+	}
+	jobs := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) != 6 {
+			continue
+		}
+		var active, succeeded, failed int
+		fmt.Sscanf(parts[1], "%d", &active)
+		fmt.Sscanf(parts[2], "%d", &succeeded)
+		fmt.Sscanf(parts[3], "%d", &failed)
+		jobs = append(jobs, map[string]any{
+			"name":            parts[0],
+			"active":          active,
+			"succeeded":       succeeded,
+			"failed":          failed,
+			"start_time":      parts[4],
+			"completion_time": parts[5],
+		})
+	}
+	return jobs, nil
+}
+
+// deleteJobs removes the Jobs of an app, including the ones started with
+// /app/run-job.
+func deleteJobs(kubeconfig, workspace, app string) error {
+	for _, sel := range []string{"app=" + app, runJobLabel + "=" + app} {
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "delete", "cronjob,job", "-l", sel, "--ignore-not-found")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("delete jobs: %v", err)
+		}
+	}
+	return nil
+}
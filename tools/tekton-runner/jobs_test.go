@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		wantErr  bool
+	}{
+		{"*/5 * * * *", false},
+		{"0 3 * * 1-5", false},
+		{"15,45 8-18 ? JAN MON", false},
+		{"@daily", false},
+		{"@hourly", false},
+		{"", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"0 3 * * $(id)", true},
+		{"@every 5m", true},
+		{"@daily\"\nsuspend: true", true},
+	}
+	for _, tt := range tests {
+		if err := validateSchedule(tt.schedule); (err != nil) != tt.wantErr {
+			t.Errorf("validateSchedule(%q) error = %v, want error %v", tt.schedule, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// TestReport is the JUnit result of one test stage of a pipeline.
+type TestReport struct {
+	Stage    string        `json:"stage"`
+	Files    []string      `json:"files"`
+	Total    int           `json:"total"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Failures []TestFailure `json:"failures,omitempty"`
+}
+
+type TestFailure struct {
+	Suite   string `json:"suite,omitempty"`
+	Class   string `json:"class,omitempty"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+const (
+	junitDir         = ".reports/junit"
+	junitBegin       = "--- junit "
+	reportEnd        = "--- end"
+	maxTestFailures  = 50
+	maxFailureLength = 1000
+)
+
+var reportGlobRe = regexp.MustCompile(`^[A-Za-z0-9_./*?-]+$`)
+
+func reportStepImage() string {
+	if v := strings.TrimSpace(os.Getenv("REPORT_STEP_IMAGE")); v != "" {
+		return v
+	}
+	return "lenovo:8443/library/alpine-git:2.45.2"
+}
+
+func validateReportGlob(glob string) error {
+	if glob == "" {
+		return nil
+	}
+	if !reportGlobRe.MatchString(glob) || path.IsAbs(glob) || strings.HasPrefix(path.Clean(glob), "..") {
+		return fmt.Errorf("reports must be a relative file glob inside the source")
+	}
+	return nil
+}
+
+// renderReportScript prints the JUnit files of a test stage between marker
+// lines, then exits with the exit code of the test command.
+func renderReportScript(stage, glob string) string {
+	return mustRender(`for f in {{.Dir}}/*.xml {{.Glob}}; do
+  [ -f "$f" ] || continue
+  echo "{{.Begin}}$f"
+  cat "$f"
+  echo
+  echo "{{.End}}"
+done
+exit "$(cat $(steps.step-run.exitCode.path))"
+`, map[string]string{"Dir": path.Join(junitDir, stage), "Glob": glob, "Begin": junitBegin, "End": reportEnd})
+}
+
+// collectTestReports reads the JUnit reports of the test stages of a finished
+// PipelineRun and stores them on the run. It returns an error if a test
+// failed.
+func collectTestReports(in Input, pipelineRun, runID string) error {
+	if in.Pipeline == nil {
+		return nil
+	}
+	stages := pipelineStageStatus(in.Namespace, pipelineRun, true)
+	var reports []TestReport
+	for _, s := range in.Pipeline.Stages {
+		st, ok := stages[s.Name]
+		if s.Type != stageTest || !ok || st.TaskRun == "" {
+			continue
+		}
+		report, err := stageTestReport(in.Namespace, s.Name, st.TaskRun)
+		if err != nil {
+			log.Printf("run %s: test reports of %s: %v", runID, s.Name, err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+	if len(reports) == 0 {
+		return nil
+	}
+	if err := runStore.update(runID, func(r *Run) { r.Tests = reports }); err != nil {
+		logRunError(runID, err)
+	}
+	failed, total := 0, 0
+	for _, r := range reports {
+		failed += r.Failed
+		total += r.Total
+	}
+	if failed > 0 {
+		return fmt.Errorf("tests failed: %d of %d", failed, total)
+	}
+	return nil
+}
+
+func stageTestReport(ns, stage, taskRun string) (TestReport, error) {
+	report := TestReport{Stage: stage, Files: []string{}}
+	pod, err := kubectlCmd("-n", ns, "get", "taskrun", taskRun, "-o", "jsonpath={.status.podName}").Output()
+	if err != nil || strings.TrimSpace(string(pod)) == "" {
+		return report, fmt.Errorf("get pod of taskrun %s: %v", taskRun, err)
+	}
+	cmd := kubectlCmd("-n", ns, "logs", strings.TrimSpace(string(pod)), "-c", "step-report")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return report, err
+	}
+	if err := cmd.Start(); err != nil {
+		return report, err
+	}
+	perr := readJUnitLog(out, &report)
+	if err := cmd.Wait(); err != nil {
+		return report, fmt.Errorf("logs of taskrun %s: %v", taskRun, err)
+	}
+	return report, perr
+}
+
+// readJUnitLog parses the JUnit files printed by the report step.
+func readJUnitLog(r io.Reader, report *TestReport) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 1<<20), 16<<20)
+	var file string
+	var doc strings.Builder
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case file == "" && strings.HasPrefix(line, junitBegin):
+			file = strings.TrimPrefix(line, junitBegin)
+			doc.Reset()
+		case file != "" && line == reportEnd:
+			if err := parseJUnit(strings.NewReader(doc.String()), report); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			report.Files = append(report.Files, file)
+			file = ""
+		case file != "":
+			doc.WriteString(line)
+			doc.WriteByte('\n')
+		}
+	}
+	return sc.Err()
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// parseJUnit adds the test cases of a JUnit XML document to report. Suites
+// may be nested; errors count as failures.
+func parseJUnit(r io.Reader, report *TestReport) error {
+	dec := xml.NewDecoder(r)
+	var suites []string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "testsuite":
+				name := ""
+				for _, a := range t.Attr {
+					if a.Name.Local == "name" {
+						name = a.Value
+					}
+				}
+				suites = append(suites, name)
+			case "testcase":
+				var c junitCase
+				if err := dec.DecodeElement(&c, &t); err != nil {
+					return err
+				}
+				addJUnitCase(report, suites, c)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "testsuite" && len(suites) > 0 {
+				suites = suites[:len(suites)-1]
+			}
+		}
+	}
+}
+
+func addJUnitCase(report *TestReport, suites []string, c junitCase) {
+	report.Total++
+	msg := c.Failure
+	if msg == nil {
+		msg = c.Error
+	}
+	switch {
+	case msg != nil:
+		report.Failed++
+		if len(report.Failures) >= maxTestFailures {
+			return
+		}
+		text := msg.Message
+		if text == "" {
+			text = strings.TrimSpace(msg.Text)
+		}
+		if len(text) > maxFailureLength {
+			text = text[:maxFailureLength] + "..."
+		}
+		f := TestFailure{Class: c.Classname, Name: c.Name, Message: text}
+		if len(suites) > 0 {
+			f.Suite = suites[len(suites)-1]
+		}
+		report.Failures = append(report.Failures, f)
+	case c.Skipped != nil:
+		report.Skipped++
+	default:
+		report.Passed++
+	}
+}
+
+// testSummary is the reply of GET /runs/{id}/tests.
+func testSummary(run Run) map[string]any {
+	var total, passed, failed, skipped int
+	reports := run.Tests
+	if reports == nil {
+		reports = []TestReport{}
+	}
+	for _, r := range reports {
+		total += r.Total
+		passed += r.Passed
+		failed += r.Failed
+		skipped += r.Skipped
+	}
+	return map[string]any{
+		"run_id":  run.ID,
+		"total":   total,
+		"passed":  passed,
+		"failed":  failed,
+		"skipped": skipped,
+		"reports": reports,
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testJUnit = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="api">
+    <testcase classname="api.Users" name="create"/>
+    <testcase classname="api.Users" name="delete">
+      <failure message="expected 204, got 500">stack</failure>
+    </testcase>
+    <testsuite name="api/db">
+      <testcase classname="api.DB" name="migrate">
+        <error>connection refused</error>
+      </testcase>
+      <testcase classname="api.DB" name="seed"><skipped/></testcase>
+    </testsuite>
+    <testcase classname="api.Users" name="list"/>
+  </testsuite>
+</testsuites>
+`
+
+func TestParseJUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    TestReport
+		wantErr bool
+	}{
+		{
+			"nested suites",
+			testJUnit,
+			TestReport{Total: 5, Passed: 2, Failed: 2, Skipped: 1, Failures: []TestFailure{
+				{Suite: "api", Class: "api.Users", Name: "delete", Message: "expected 204, got 500"},
+				{Suite: "api/db", Class: "api.DB", Name: "migrate", Message: "connection refused"},
+			}},
+			false,
+		},
+		{"single suite", `<testsuite name="s"><testcase name="a"/></testsuite>`, TestReport{Total: 1, Passed: 1}, false},
+		{"empty", "", TestReport{}, false},
+		{"truncated", `<testsuite name="s"><testcase name="a">`, TestReport{}, true},
+	}
+	for _, tt := range tests {
+		var got TestReport
+		err := parseJUnit(strings.NewReader(tt.doc), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseJUnit() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseJUnit() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseJUnitLimits(t *testing.T) {
+	var doc strings.Builder
+	doc.WriteString("<testsuite>")
+	for i := 0; i < maxTestFailures+5; i++ {
+		doc.WriteString(`<testcase name="t"><failure message="` + strings.Repeat("x", maxFailureLength+10) + `"/></testcase>`)
+	}
+	doc.WriteString("</testsuite>")
+	var got TestReport
+	if err := parseJUnit(strings.NewReader(doc.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Failed != maxTestFailures+5 || len(got.Failures) != maxTestFailures {
+		t.Errorf("failed = %d, failures = %d", got.Failed, len(got.Failures))
+	}
+	if n := len(got.Failures[0].Message); n != maxFailureLength+3 {
+		t.Errorf("message length = %d, want %d", n, maxFailureLength+3)
+	}
+}
+
+func TestReadJUnitLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		log       string
+		wantFiles []string
+		wantTotal int
+		wantErr   bool
+	}{
+		{
+			"two files between output",
+			"=== RUN TestX\n" + junitBegin + ".reports/junit/unit/a.xml\n" + testJUnit + reportEnd + "\nnoise\n" +
+				junitBegin + "out/b.xml\n<testsuite><testcase name=\"b\"/></testsuite>\n" + reportEnd + "\n",
+			[]string{".reports/junit/unit/a.xml", "out/b.xml"},
+			6,
+			false,
+		},
+		{"no reports", "ok  \tpkg\t0.1s\n", nil, 0, false},
+		{"unterminated", junitBegin + "a.xml\n<testsuite><testcase name=\"a\"/></testsuite>\n", nil, 0, false},
+		{"broken file", junitBegin + "a.xml\n<testsuite><testcase>\n" + reportEnd + "\n", nil, 0, true},
+	}
+	for _, tt := range tests {
+		var got TestReport
+		err := readJUnitLog(strings.NewReader(tt.log), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: readJUnitLog() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(got.Files, tt.wantFiles) || got.Total != tt.wantTotal {
+			t.Errorf("%s: files = %v, total = %d, want %v, %d", tt.name, got.Files, got.Total, tt.wantFiles, tt.wantTotal)
+		}
+	}
+}
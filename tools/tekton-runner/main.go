@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
@@ -21,27 +23,49 @@ import (
 )
 
 type Input struct {
-	Namespace string `json:"namespace"`
-	Task      string `json:"task"`
-	AppName   string `json:"app_name"`
-	Workspace string `json:"workspace"`
-	Deploy    Deploy `json:"deploy"`
-	Source    Source `json:"source"`
-	Image     Image  `json:"image"`
+	Namespace string  `json:"namespace"`
+	Task      string  `json:"task"`
+	AppName   string  `json:"app_name"`
+	Workspace string  `json:"workspace"`
+	Deploy    Deploy  `json:"deploy"`
+	Source    Source  `json:"source"`
+	Image     Image   `json:"image"`
+	Addons    []Addon `json:"addons"`
+
+	// Pipeline builds with a PipelineRun of stages instead of Task.
+	Pipeline *Pipeline `json:"pipeline"`
+
+	// Scan blocks the deploy when the image has findings above the policy.
+	Scan *ScanPolicy `json:"scan"`
+
+	// SBOM archives an SBOM of the built image with the run.
+	SBOM *SBOMOptions `json:"sbom"`
+
+	// RunID is the run the request is submitted as; the run-id tag
+	// strategy uses it.
+	RunID string `json:"-"`
+
+	// InferPort deploys an auto build on the port detected by the build.
+	InferPort bool `json:"-"`
+
+	// ClusterReady skips creating the workspace cluster; workspace requests
+	// create it once before their apps deploy in parallel.
+	ClusterReady bool `json:"-"`
 }
 
 type Source struct {
-	Type        string    `json:"type"`
-	RepoURL     string    `json:"repo_url"`
-	Revision    string    `json:"revision"`
-	GitUsername string    `json:"git_username"`
-	GitToken    string    `json:"git_token"`
-	GitSecret   string    `json:"git_secret"`
-	LocalPath   string    `json:"local_path"`
-	PVCName     string    `json:"pvc_name"`
-	ZipURL      string    `json:"zip_url"`
-	ZipUsername string    `json:"zip_username"`
-	ZipPassword string    `json:"zip_password"`
+	Type        string     `json:"type"`
+	RepoURL     string     `json:"repo_url"`
+	Revision    string     `json:"revision"`
+	GitUsername string     `json:"git_username"`
+	GitToken    string     `json:"git_token"`
+	GitSecret   string     `json:"git_secret"`
+	LocalPath   string     `json:"local_path"`
+	PVCName     string     `json:"pvc_name"`
+	ZipURL      string     `json:"zip_url"`
+	ZipUsername string     `json:"zip_username"`
+	ZipPassword string     `json:"zip_password"`
+	Image       string     `json:"image"`
 	NFS         *NFSConfig `json:"nfs"`
 	SMB         *SMBConfig `json:"smb"`
 }
@@ -66,10 +90,104 @@ type Image struct {
 	Project  string `json:"project"`
 	Tag      string `json:"tag"`
 	Registry string `json:"registry"`
+	Digest   string `json:"digest"`
+
+	// TagStrategy sets Tag when the request is submitted: git-sha,
+	// timestamp, run-id or template (TagTemplate).
+	TagStrategy string `json:"tag_strategy"`
+	TagTemplate string `json:"tag_template"`
+
+	// Build options, passed to the Task as params.
+	ContextDir string            `json:"context_dir"`
+	Dockerfile string            `json:"dockerfile"`
+	BuildArgs  map[string]string `json:"build_args"`
+	Target     string            `json:"target"`
+	Labels     map[string]string `json:"labels"`
+
+	// Platforms builds a manifest list, e.g. "linux/amd64,linux/arm64".
+	Platforms string `json:"platforms"`
+
+	// Sign signs the pushed image with the key of the credential store.
+	Sign bool `json:"sign"`
+
+	// Cache keeps the build cache of the project between builds.
+	Cache *BuildCache `json:"cache"`
+
+	// BuildMode auto generates a Dockerfile for sources without one.
+	BuildMode string `json:"build_mode"`
 }
 
 type Deploy struct {
-	ContainerPort int `json:"container_port"`
+	ContainerPort int                  `json:"container_port"`
+	Ports         []DeployPort         `json:"ports"`
+	Env           map[string]string    `json:"env"`
+	EnvFromSecret map[string]SecretEnv `json:"env_from_secret"`
+	ConfigFiles   []ConfigFile         `json:"config_files"`
+	Replicas      int                  `json:"replicas"`
+	Command       []string             `json:"command"`
+	Args          []string             `json:"args"`
+	WorkingDir    string               `json:"working_dir"`
+	Resources     *Resources           `json:"resources"`
+	Readiness     *Probe               `json:"readiness_probe"`
+	Liveness      *Probe               `json:"liveness_probe"`
+	Strategy      string               `json:"strategy"`
+	CanaryWeight  *int                 `json:"canary_weight"`
+	SmokePath     string               `json:"smoke_path"`
+
+	Volumes             []Volume    `json:"volumes"`
+	SmokeTests          []SmokeTest `json:"smoke_tests"`
+	SmokeTimeoutSeconds int         `json:"smoke_timeout_seconds"`
+	RollbackOnFailure   bool        `json:"rollback_on_failure"`
+
+	Type      string        `json:"type"`
+	Helm      *HelmChart    `json:"helm"`
+	Manifests *ManifestSpec `json:"manifests"`
+
+	Autoscale *Autoscale `json:"autoscale"`
+
+	Kind                    string `json:"kind"`
+	Schedule                string `json:"schedule"`
+	ConcurrencyPolicy       string `json:"concurrency_policy"`
+	BackoffLimit            *int   `json:"backoff_limit"`
+	TTLSecondsAfterFinished *int   `json:"ttl_seconds_after_finished"`
+	ActiveDeadlineSeconds   int    `json:"active_deadline_seconds"`
+}
+
+type Resources struct {
+	CPURequest    string `json:"cpu_request"`
+	CPULimit      string `json:"cpu_limit"`
+	MemoryRequest string `json:"memory_request"`
+	MemoryLimit   string `json:"memory_limit"`
+}
+
+// Probe is an http, tcp or exec container probe. Port is a port name from
+// deploy.ports and defaults to the first TCP port.
+type Probe struct {
+	Type                string   `json:"type"`
+	Path                string   `json:"path"`
+	Port                string   `json:"port"`
+	Command             []string `json:"command"`
+	InitialDelaySeconds int      `json:"initial_delay_seconds"`
+	PeriodSeconds       int      `json:"period_seconds"`
+	TimeoutSeconds      int      `json:"timeout_seconds"`
+	FailureThreshold    int      `json:"failure_threshold"`
+}
+
+// DeployPort is a named container port. Each one is exposed through its own
+// NodePort on the app Service.
+type DeployPort struct {
+	Name          string `json:"name"`
+	ContainerPort int    `json:"container_port"`
+	Protocol      string `json:"protocol"`
+	ServicePort   int    `json:"service_port"`
+}
+
+// ServicePort is a port as read back from a workspace Service.
+type ServicePort struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	NodePort int    `json:"nodePort"`
 }
 
 type RenderContext struct {
@@ -90,6 +208,10 @@ type RenderContext struct {
 	HasGit      bool
 	HasLocal    bool
 	HasZip      bool
+	BuildParams []buildParam
+
+	// CacheClaim is the PVC bound to the cache workspace of the build.
+	CacheClaim string
 }
 
 type ServerState struct {
@@ -100,6 +222,7 @@ type ServerState struct {
 type ExternalPortEntry struct {
 	Workspace    string `json:"workspace"`
 	App          string `json:"app"`
+	Port         string `json:"port,omitempty"`
 	ExternalPort int    `json:"external_port"`
 }
 
@@ -114,8 +237,9 @@ var serverKubeconfig string
 var serverState = &ServerState{endpoints: map[string]string{}}
 var portStore = &ExternalPortStore{path: "/home/beko/port-map.json"}
 type Forward struct {
-	Port int
-	Cmd  *exec.Cmd
+	Port  int
+	Cmd   *exec.Cmd
+	Proxy *weightedProxy
 }
 
 var forwardMu sync.Mutex
@@ -173,6 +297,9 @@ func main() {
 	}
 
 	if !*apply {
+		if in.Source.Type == "image" && usesDeployment(in.Deploy) {
+			manifests = append(manifests, renderDeployment(workspaceName(in), sanitizeName(in.AppName), imageRef(in), in.Deploy, nil))
+		}
 		for i, m := range manifests {
 			if i > 0 {
 				fmt.Println("---")
@@ -182,9 +309,19 @@ func main() {
 		return
 	}
 
+	if err := historyStore.load(); err != nil {
+		fatal("load deploy history", err)
+	}
+	if err := cacheStore.load(); err != nil {
+		fatal("load build caches", err)
+	}
+	if err := checkTaskParams(in); err != nil {
+		fatal("validate input", err)
+	}
+
 	var taskRunName string
 	for _, m := range manifests {
-		if isTaskRun(m) {
+		if isBuildRun(m) {
 			name, err := kubectlCreateName(m, in.Namespace)
 			if err != nil {
 				fatal("kubectl create", err)
@@ -198,23 +335,53 @@ func main() {
 	}
 
 	if in.Source.Type == "zip" && in.AppName != "" && taskRunName != "" {
-		if err := handleZipDeploy(in, taskRunName); err != nil {
+		if err := handleZipDeploy(in, taskRunName, ""); err != nil {
 			fatal("zip deploy", err)
 		}
 	}
+	if in.Source.Type == "image" {
+		if in.Scan != nil {
+			if err := scanImage(in, imageRef(in), ""); err != nil {
+				fatal("image scan", err)
+			}
+		}
+		if err := deployAndVerify(in, imageRef(in), ""); err != nil {
+			fatal("image deploy", err)
+		}
+	}
 }
 
 func runServer(addr, apiKey string) {
 	if err := portStore.load(); err != nil {
 		log.Printf("port map load error: %v", err)
 	}
+	if err := runStore.load(); err != nil {
+		log.Printf("run store load error: %v", err)
+	}
+	if err := historyStore.load(); err != nil {
+		log.Printf("deploy history load error: %v", err)
+	}
+	if err := cacheStore.load(); err != nil {
+		log.Printf("build cache store load error: %v", err)
+	}
+	startCacheEviction()
 	// Start port forwards for existing mappings
 	for _, e := range portStore.list() {
-		if err := ensureForward(e.Workspace, e.App, e.ExternalPort); err != nil {
-			log.Printf("forward start failed for %s/%s: %v", e.Workspace, e.App, err)
+		if err := ensureForward(e.Workspace, e.App, e.Port, e.ExternalPort); err != nil {
+			log.Printf("forward start failed for %s: %v", endpointKey(e.Workspace, e.App, e.Port), err)
 		}
 	}
 
+	// requireAPIKey answers 401 and returns false when an API key is set and
+	// the request does not carry it as a Bearer token.
+	requireAPIKey := func(w http.ResponseWriter, r *http.Request) bool {
+		if apiKey != "" && r.Header.Get("Authorization") != "Bearer "+apiKey {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
@@ -225,12 +392,8 @@ func runServer(addr, apiKey string) {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		if apiKey != "" {
-			auth := r.Header.Get("Authorization")
-			if auth != "Bearer "+apiKey {
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
-				return
-			}
+		if !requireAPIKey(w, r) {
+			return
 		}
 
 		body, err := io.ReadAll(r.Body)
@@ -244,14 +407,23 @@ func runServer(addr, apiKey string) {
 			http.Error(w, "invalid JSON", http.StatusBadRequest)
 			return
 		}
+		in.RunID = newRunID()
 
 		manifests, err := buildManifests(&in)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if err := checkTaskParams(in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		dryRun := r.URL.Query().Get("dry_run") == "true"
+		if dryRun && in.Source.Type == "image" && usesDeployment(in.Deploy) {
+			// Nothing is built; show what would be applied to the workspace.
+			manifests = append(manifests, renderDeployment(workspaceName(in), sanitizeName(in.AppName), imageRef(in), in.Deploy, nil))
+		}
 		if dryRun {
 			w.Header().Set("Content-Type", "application/yaml")
 			for i, m := range manifests {
@@ -263,69 +435,358 @@ func runServer(addr, apiKey string) {
 			return
 		}
 
+		run := Run{ID: in.RunID, Source: in.Source.Type, Stages: pipelineStages(in)}
+		if in.AppName != "" {
+			run.Workspace = workspaceName(in)
+			run.App = sanitizeName(in.AppName)
+			run.Image = imageRef(in)
+		}
+		if err := runStore.create(run); err != nil {
+			http.Error(w, "create run failed", http.StatusInternalServerError)
+			return
+		}
+
+		// finishBuild releases the cache once the build is done.
+		acquireCache(in)
 		var taskRunName string
 		for _, m := range manifests {
-			if isTaskRun(m) {
+			if isBuildRun(m) {
 				name, err := kubectlCreateName(m, in.Namespace)
 				if err != nil {
+					releaseCache(in)
+					runStore.finish(run.ID, err)
 					http.Error(w, "kubectl create failed", http.StatusInternalServerError)
 					return
 				}
 				taskRunName = name
 			} else {
 				if err := kubectlApply(m); err != nil {
+					releaseCache(in)
+					runStore.finish(run.ID, err)
 					http.Error(w, "kubectl apply failed", http.StatusInternalServerError)
 					return
 				}
 			}
 		}
+		if taskRunName != "" {
+			_ = runStore.update(run.ID, func(r *Run) { setBuildRun(r, in, taskRunName) })
+		} else {
+			releaseCache(in)
+		}
 
 		if in.AppName != "" && taskRunName != "" && (in.Source.Type == "zip" || in.Source.Type == "git" || in.Source.Type == "local") {
-			go func(req Input, tr string) {
-				if err := handleZipDeploy(req, tr); err != nil {
+			go func(req Input, tr, runID string) {
+				err := handleZipDeploy(req, tr, runID)
+				if err != nil {
+					log.Printf("deploy error: %v", err)
+				}
+				runStore.finish(runID, err)
+			}(in, taskRunName, run.ID)
+		} else if taskRunName != "" {
+			go func(req Input, tr, runID string) {
+				runStore.setStatus(runID, runBuilding)
+				_, err := finishBuild(&req, tr, runID)
+				runStore.finish(runID, err)
+			}(in, taskRunName, run.ID)
+		}
+		if in.Source.Type == "image" {
+			go func(req Input, runID string) {
+				var err error
+				if req.Scan != nil {
+					err = scanImage(req, imageRef(req), runID)
+				}
+				if err == nil {
+					runStore.setStatus(runID, runDeploying)
+					err = deployAndVerify(req, imageRef(req), runID)
+				}
+				if err != nil {
 					log.Printf("deploy error: %v", err)
 				}
-			}(in, taskRunName)
+				runStore.finish(runID, err)
+			}(in, run.ID)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
-		w.Write([]byte(`{"status":"submitted"}`))
+		resp := map[string]string{"status": "submitted", "run_id": run.ID, "task_run": taskRunName}
+		if in.Pipeline != nil {
+			resp = map[string]string{"status": "submitted", "run_id": run.ID, "pipeline_run": taskRunName}
+		}
+		b, _ := json.Marshal(resp)
+		w.Write(b)
 	})
 
-	http.HandleFunc("/endpoint", func(w http.ResponseWriter, r *http.Request) {
-		workspace := r.URL.Query().Get("workspace")
-		app := r.URL.Query().Get("app")
-		if workspace == "" || app == "" {
-			http.Error(w, "workspace and app are required", http.StatusBadRequest)
+	http.HandleFunc("/workspace/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		key := workspace + "/" + app
-		serverState.mu.Lock()
-		if url, ok := serverState.endpoints[key]; ok {
-			serverState.mu.Unlock()
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(fmt.Sprintf(`{"endpoint":"%s"}`, url)))
+		if !requireAPIKey(w, r) {
+			return
+		}
+		var req StackRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		plan, err := prepareStack(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.URL.Query().Get("dry_run") == "true" {
+			w.Header().Set("Content-Type", "application/yaml")
+			first := true
+			for i, app := range req.Apps {
+				manifests := plan.Manifests[i]
+				if app.Source.Type == "image" && usesDeployment(app.Deploy) {
+					manifests = append(manifests, renderDeployment(req.Workspace, sanitizeName(app.AppName), imageRef(app.Input), app.Deploy, nil))
+				}
+				for _, m := range manifests {
+					if !first {
+						w.Write([]byte("\n---\n"))
+					}
+					first = false
+					w.Write([]byte(m))
+				}
+			}
+			return
+		}
+
+		parent, runs, err := submitStack(req, plan)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		b, _ := json.Marshal(stackResponse(parent, runs, plan))
+		w.Write(b)
+	})
+
+	http.HandleFunc("/workspace/import-compose", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		// A JSON body is an import request; anything else is the compose file.
+		var imp ComposeImport
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.Unmarshal(body, &imp); err != nil {
+				http.Error(w, "invalid JSON", http.StatusBadRequest)
+				return
+			}
+		} else {
+			imp.Compose = string(body)
+		}
+		if ws := r.URL.Query().Get("workspace"); ws != "" {
+			imp.Workspace = ws
+		}
+		if !strings.HasPrefix(imp.Workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		data := []byte(imp.Compose)
+		if imp.Compose == "" {
+			data, err = loadComposeFile(&imp)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		req, warnings, err := composeToStack(imp, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		plan, err := prepareStack(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if warnings == nil {
+			warnings = []string{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("dry_run") == "true" {
+			b, _ := json.Marshal(map[string]any{"workspace_request": req, "warnings": warnings})
+			w.Write(b)
+			return
+		}
+		parent, runs, err := submitStack(req, plan)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out := stackResponse(parent, runs, plan)
+		out["warnings"] = warnings
+		w.WriteHeader(http.StatusAccepted)
+		b, _ := json.Marshal(out)
+		w.Write(b)
+	})
+
+	http.HandleFunc("/runs", func(w http.ResponseWriter, r *http.Request) {
+		runs := runStore.list(r.URL.Query().Get("workspace"), r.URL.Query().Get("app"))
+		b, _ := json.Marshal(runs)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+
+	http.HandleFunc("/runs/", func(w http.ResponseWriter, r *http.Request) {
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/runs/"), "/")
+		run, err := runStore.get(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		var b []byte
+		switch {
+		case sub == "tests" && run.Source == "workspace":
+			apps := map[string]any{}
+			for _, c := range runStore.children(run.ID) {
+				apps[c.App] = testSummary(c)
+			}
+			b, _ = json.Marshal(map[string]any{"run_id": run.ID, "apps": apps})
+		case sub == "tests":
+			b, _ = json.Marshal(testSummary(run))
+		case sub == "scan" && run.Source == "workspace":
+			apps := map[string]any{}
+			for _, c := range runStore.children(run.ID) {
+				apps[c.App] = scanResult(c)
+			}
+			b, _ = json.Marshal(map[string]any{"run_id": run.ID, "apps": apps})
+		case sub == "scan":
+			b, _ = json.Marshal(scanResult(run))
+		case sub == "sbom":
+			doc, err := readRunSBOM(run)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			contentType := "application/spdx+json"
+			if run.SBOM.Format == sbomCycloneDX {
+				contentType = "application/vnd.cyclonedx+json"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Write(doc)
 			return
+		case sub != "":
+			http.NotFound(w, r)
+			return
+		case run.Source == "workspace":
+			b, _ = json.Marshal(struct {
+				Run
+				Apps []Run `json:"apps"`
+			}{run, runStore.children(run.ID)})
+		default:
+			b, _ = json.Marshal(run)
 		}
-		serverState.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
 
-		kcfgPath := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
-		port, err := getServiceNodePort(kcfgPath, workspace, app)
+	http.HandleFunc("/sbom/diff", func(w http.ResponseWriter, r *http.Request) {
+		from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+		if from == "" || to == "" {
+			http.Error(w, "from and to are required", http.StatusBadRequest)
+			return
+		}
+		diff, err := sbomDiff(from, to)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		host := serverHostIP
-		if host == "" {
-			host = "127.0.0.1"
+		b, _ := json.Marshal(diff)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+
+	http.HandleFunc("/projects/", func(w http.ResponseWriter, r *http.Request) {
+		project, action, ok := projectCacheRoute(r.URL.Path)
+		if !ok || (action != "" && action != "clear") {
+			http.NotFound(w, r)
+			return
+		}
+		ns := r.URL.Query().Get("namespace")
+		if ns == "" {
+			ns = "tekton-pipelines"
+		}
+		if action == "" {
+			c, found := cacheStore.get(ns, project)
+			if !found {
+				http.Error(w, "no builds recorded for project", http.StatusNotFound)
+				return
+			}
+			b, _ := json.Marshal(c)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		cleared, err := clearCache(ns, project)
+		if err == errCacheNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err == errCacheInUse {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(map[string]any{"status": "cleared", "project": project, "cleared": cleared})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+
+	http.HandleFunc("/endpoint", func(w http.ResponseWriter, r *http.Request) {
+		workspace := r.URL.Query().Get("workspace")
+		app := r.URL.Query().Get("app")
+		port := r.URL.Query().Get("port")
+		if workspace == "" || app == "" {
+			http.Error(w, "workspace and app are required", http.StatusBadRequest)
+			return
+		}
+		url, named, ok := lookupEndpoints(workspace, app, port)
+		if !ok {
+			kcfgPath := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+			ports, err := getServicePorts(kcfgPath, workspace, app)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			cacheEndpoints(workspace, app, ports)
+			url, named, ok = lookupEndpoints(workspace, app, port)
+			if !ok {
+				http.Error(w, "port not found: "+port, http.StatusNotFound)
+				return
+			}
+		}
+		out := map[string]any{"endpoint": url}
+		if port == "" {
+			out["endpoints"] = named
 		}
-		url := fmt.Sprintf("http://%s:%d", host, port)
-		serverState.mu.Lock()
-		serverState.endpoints[key] = url
-		serverState.mu.Unlock()
+		b, _ := json.Marshal(out)
 		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(fmt.Sprintf(`{"endpoint":"%s"}`, url)))
+		w.Write(b)
 	})
 
 	http.HandleFunc("/workspaces", func(w http.ResponseWriter, r *http.Request) {
@@ -380,6 +841,75 @@ func runServer(addr, apiKey string) {
 		w.Write(info)
 	})
 
+	http.HandleFunc("/workspace/addons", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		if workspace == "" {
+			http.Error(w, "workspace is required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Addons []Addon `json:"addons"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		setAddonDefaults(req.Addons)
+		if err := validateAddons(req.Addons, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := provisionAddons(workspace, req.Addons); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"provisioned"}`))
+	})
+
+	http.HandleFunc("/workspace/addon/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		name := r.URL.Query().Get("name")
+		if workspace == "" || name == "" {
+			http.Error(w, "workspace and name are required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		if err := deleteAddon(workspace, name); err != nil {
+			if errors.Is(err, errAddonNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"deleted"}`))
+	})
+
 	http.HandleFunc("/app/delete", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -395,7 +925,13 @@ func runServer(addr, apiKey string) {
 			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
 			return
 		}
-		if err := deleteApp(workspace, app); err != nil {
+		// Deleting volumes loses data; the UI never purges, so plain deletes
+		// stay open to it.
+		purge := r.URL.Query().Get("purge") == "true"
+		if purge && !requireAPIKey(w, r) {
+			return
+		}
+		if err := deleteApp(workspace, app, purge); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -441,6 +977,10 @@ func runServer(addr, apiKey string) {
 			return
 		}
 		if err := scaleApp(workspace, app, replicas); err != nil {
+			if errors.Is(err, errAutoscaled) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -473,19 +1013,231 @@ func runServer(addr, apiKey string) {
 		w.Write([]byte(`{"status":"restarted"}`))
 	})
 
-	http.HandleFunc("/workspace/restart", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/app/run-job", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		workspace := r.URL.Query().Get("workspace")
-		if workspace == "" {
-			http.Error(w, "workspace is required", http.StatusBadRequest)
+		if !requireAPIKey(w, r) {
 			return
 		}
-		if !strings.HasPrefix(workspace, "ws-") {
-			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
-			return
+		workspace := r.URL.Query().Get("workspace")
+		app := r.URL.Query().Get("app")
+		if workspace == "" || app == "" {
+			http.Error(w, "workspace and app are required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		var req JobRun
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := validateAppConfig(req.Env, nil, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.TimeoutSeconds < 0 {
+			http.Error(w, "timeout_seconds must not be negative", http.StatusBadRequest)
+			return
+		}
+		name, err := runAppJob(workspace, app, req)
+		if err != nil {
+			if errors.Is(err, errAppNotDeployed) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("follow") == "false" {
+			b, _ := json.Marshal(map[string]string{"status": "started", "job": name})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(b)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Job-Name", name)
+		w.WriteHeader(http.StatusOK)
+		out := flushWriter{w: w}
+		out.f, _ = w.(http.Flusher)
+		timeout := jobTimeout
+		if req.TimeoutSeconds > 0 {
+			timeout = time.Duration(req.TimeoutSeconds)*time.Second + time.Minute
+		}
+		if err := streamJobLogs(workspace, name, timeout, out); err != nil {
+			fmt.Fprintf(out, "\n--- job %s failed: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(out, "\n--- job %s succeeded\n", name)
+	})
+
+	http.HandleFunc("/app/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		app := r.URL.Query().Get("app")
+		if workspace == "" || app == "" {
+			http.Error(w, "workspace and app are required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		var cfg AppConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := validateAppConfig(cfg.Env, cfg.EnvFromSecret, cfg.ConfigFiles); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := updateAppConfig(workspace, app, cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"updated"}`))
+	})
+
+	http.HandleFunc("/app/history", func(w http.ResponseWriter, r *http.Request) {
+		if !requireAPIKey(w, r) {
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		app := r.URL.Query().Get("app")
+		if workspace == "" || app == "" {
+			http.Error(w, "workspace and app are required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		b, _ := json.Marshal(map[string]any{
+			"workspace": workspace,
+			"app":       app,
+			"revisions": historyStore.list(workspace, app),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+
+	http.HandleFunc("/app/rollback", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		app := r.URL.Query().Get("app")
+		to, err := strconv.Atoi(r.URL.Query().Get("to"))
+		if workspace == "" || app == "" || err != nil {
+			http.Error(w, "workspace, app and numeric to are required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		run, rev, err := rollbackApp(workspace, app, to)
+		if err != nil {
+			if errors.Is(err, errRevisionNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(map[string]any{"status": "rolled back", "revision": rev, "run": run})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	})
+
+	http.HandleFunc("/app/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		app := r.URL.Query().Get("app")
+		if workspace == "" || app == "" {
+			http.Error(w, "workspace and app are required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		status, err := promoteApp(workspace, app)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, status)))
+	})
+
+	http.HandleFunc("/app/abort", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireAPIKey(w, r) {
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		app := r.URL.Query().Get("app")
+		if workspace == "" || app == "" {
+			http.Error(w, "workspace and app are required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
+		}
+		status, err := abortApp(workspace, app)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, status)))
+	})
+
+	http.HandleFunc("/workspace/restart", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		workspace := r.URL.Query().Get("workspace")
+		if workspace == "" {
+			http.Error(w, "workspace is required", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(workspace, "ws-") {
+			http.Error(w, "workspace must start with ws-", http.StatusBadRequest)
+			return
 		}
 		if err := rolloutRestartAll(workspace); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -546,8 +1298,8 @@ func runServer(addr, apiKey string) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if err := ensureForward(req.Workspace, req.App, req.ExternalPort); err != nil {
-			_ = portStore.remove(req.Workspace, req.App)
+		if err := ensureForward(req.Workspace, req.App, req.Port, req.ExternalPort); err != nil {
+			_ = portStore.remove(req.Workspace, req.App, req.Port)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -576,6 +1328,12 @@ func buildManifests(in *Input) ([]string, error) {
 	}
 
 	manifests := make([]string, 0, 4)
+	if in.Source.Type == "image" {
+		return manifests, nil
+	}
+	if err := resolveTag(in); err != nil {
+		return nil, err
+	}
 	if in.Source.Type == "git" && in.Source.GitUsername != "" && in.Source.GitToken != "" {
 		if in.Source.GitSecret == "" {
 			in.Source.GitSecret = "git-cred-" + randSuffix()
@@ -593,7 +1351,15 @@ func buildManifests(in *Input) ([]string, error) {
 		}
 	}
 
-	manifests = append(manifests, renderTaskRun(*in))
+	if cacheClaim(*in) != "" {
+		manifests = append(manifests, renderCacheClaim(*in))
+	}
+
+	if in.Pipeline != nil {
+		manifests = append(manifests, renderPipelineRun(*in))
+	} else {
+		manifests = append(manifests, renderTaskRun(*in))
+	}
 	return manifests, nil
 }
 
@@ -633,46 +1399,93 @@ func kubectlCmd(args ...string) *exec.Cmd {
 	return cmd
 }
 
-func handleZipDeploy(in Input, taskRunName string) error {
-	ns := in.Namespace
-	if err := waitForTaskRun(ns, taskRunName, 45*time.Minute); err != nil {
+func handleZipDeploy(in Input, taskRunName, runID string) error {
+	runStore.setStatus(runID, runBuilding)
+	image, err := finishBuild(&in, taskRunName, runID)
+	if err != nil {
 		return err
 	}
+	runStore.setStatus(runID, runDeploying)
+	return deployAndVerify(in, image, runID)
+}
 
-	clusterName := in.Workspace
-	if clusterName == "" {
-		clusterName = "ws-" + sanitizeName(in.AppName)
-	}
+// deployApp creates the workspace cluster if needed and deploys image as the
+// app described by in.
+func deployApp(in Input, image string) error {
+	clusterName := workspaceName(in)
 	kcfgDir := "/home/beko/kubeconfigs"
 	if err := os.MkdirAll(kcfgDir, 0o755); err != nil {
 		return err
 	}
 	kcfgPath := filepath.Join(kcfgDir, clusterName+".yaml")
 
-	if err := ensureKindCluster(clusterName, kcfgPath); err != nil {
-		return err
+	if !in.ClusterReady {
+		if err := ensureKindCluster(clusterName, kcfgPath); err != nil {
+			return err
+		}
 	}
 
-	image := fmt.Sprintf("%s/%s/%s:%s", in.Image.Registry, strings.ToLower(in.Image.Project), strings.ToLower(in.Image.Project), in.Image.Tag)
-	if err := applyDeployment(kcfgPath, clusterName, sanitizeName(in.AppName), image, in.Deploy.ContainerPort); err != nil {
+	if err := ensureAddons(kcfgPath, clusterName, in.Addons); err != nil {
+		return err
+	}
+	if in.Deploy.Type == deployTypeHelm {
+		return deployHelm(kcfgPath, clusterName, image, *in.Deploy.Helm)
+	}
+	if usesManifests(in.Deploy) {
+		return deployManifests(kcfgPath, clusterName, sanitizeName(in.AppName), image, in)
+	}
+	secretEnv, err := appSecretEnv(kcfgPath, clusterName, in.Namespace, in.Deploy.Env, in.Deploy.EnvFromSecret)
+	if err != nil {
+		return err
+	}
+	app := sanitizeName(in.AppName)
+	if isJobKind(in.Deploy.Kind) {
+		return deployJob(kcfgPath, clusterName, app, image, in.Deploy, secretEnv)
+	}
+	switch {
+	case in.Deploy.Kind == kindStatefulSet:
+		err = deployStatefulSet(kcfgPath, clusterName, app, image, in.Deploy, secretEnv)
+	case in.Deploy.Strategy == strategyBlueGreen:
+		err = deployBlueGreen(kcfgPath, clusterName, app, image, in.Deploy, secretEnv)
+	case in.Deploy.Strategy == strategyCanary:
+		err = deployCanary(kcfgPath, clusterName, app, image, in.Deploy, secretEnv)
+	default:
+		err = deployRolling(kcfgPath, clusterName, app, image, in.Deploy, secretEnv)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncAutoscale(kcfgPath, clusterName, app, in.Deploy); err != nil {
 		return err
 	}
 
-	port, err := getServiceNodePort(kcfgPath, clusterName, sanitizeName(in.AppName))
+	ports, err := getServicePorts(kcfgPath, clusterName, sanitizeName(in.AppName))
 	if err == nil {
-		host := serverHostIP
-		if host == "" {
-			host = "127.0.0.1"
-		}
-		url := fmt.Sprintf("http://%s:%d", host, port)
-		key := clusterName + "/" + sanitizeName(in.AppName)
-		serverState.mu.Lock()
-		serverState.endpoints[key] = url
-		serverState.mu.Unlock()
+		cacheEndpoints(clusterName, sanitizeName(in.AppName), ports)
 	}
 	return nil
 }
 
+func workspaceName(in Input) string {
+	if in.Workspace != "" {
+		return in.Workspace
+	}
+	return "ws-" + sanitizeName(in.AppName)
+}
+
+// imageRef returns the image to deploy: source.image for image sources,
+// otherwise the reference the build Task pushes to. image.digest pins it.
+func imageRef(in Input) string {
+	ref := in.Source.Image
+	if in.Source.Type != "image" || ref == "" {
+		ref = fmt.Sprintf("%s/%s/%s:%s", in.Image.Registry, strings.ToLower(in.Image.Project), strings.ToLower(in.Image.Project), in.Image.Tag)
+	}
+	if in.Image.Digest == "" || strings.Contains(ref, "@") {
+		return ref
+	}
+	return imageRepo(ref) + "@" + in.Image.Digest
+}
+
 func waitForTaskRun(ns, name string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
@@ -769,11 +1582,11 @@ func configureKindNode(clusterName string) error {
 	return nil
 }
 
-func applyDeployment(kubeconfig, namespace, app, image string, port int) error {
-	if port == 0 {
-		port = 8080
+func applyDeployment(kubeconfig, namespace, app, image string, d Deploy, secretEnv map[string]string) error {
+	if len(d.Ports) == 0 {
+		d.Ports = defaultPorts(8080)
 	}
-	manifest := renderDeployment(namespace, app, image, port)
+	manifest := renderDeployment(namespace, app, image, d, secretEnv)
 	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "apply", "-f", "-")
 	cmd.Stdin = strings.NewReader(manifest)
 	cmd.Stdout = os.Stdout
@@ -781,54 +1594,447 @@ func applyDeployment(kubeconfig, namespace, app, image string, port int) error {
 	return cmd.Run()
 }
 
-func renderDeployment(ns, app, image string, port int) string {
+func defaultPorts(containerPort int) []DeployPort {
+	return []DeployPort{{Name: "http", ContainerPort: containerPort, Protocol: "TCP", ServicePort: 80}}
+}
+
+// workload names the objects rendered for one Deployment of an app. Rolling
+// deploys use the app name for all of them; blue/green slots and canaries
+// get their own Deployment and config objects.
+type workload struct {
+	Name    string
+	App     string
+	Slot    string
+	Service bool
+	Role    string
+}
+
+func renderDeployment(ns, app, image string, d Deploy, secretEnv map[string]string) string {
+	return renderWorkload(ns, workload{Name: app, App: app, Service: true}, image, d, secretEnv)
+}
+
+func renderWorkload(ns string, wl workload, image string, d Deploy, secretEnv map[string]string) string {
+	envCM := renderEnvConfigMap(ns, wl.Name, d.Env)
+	envSecret := renderEnvSecret(ns, wl.Name, secretEnv)
+	configs := []string{envCM, envSecret}
+	if len(d.ConfigFiles) > 0 {
+		configs = append(configs, renderFilesConfigMap(ns, wl.Name, d.ConfigFiles))
+	}
+	hash := configHash(configs...)
+	if wl.Service && !isJobKind(d.Kind) {
+		configs = append(configs, renderService(ns, wl.Name, wl.App, wl.Slot, wl.Role, d.Ports))
+	}
+	if wl.Service && d.Kind == kindStatefulSet {
+		configs = append(configs, renderHeadlessService(ns, wl.App, d.Ports))
+	}
+	type volumeMount struct {
+		Name      string
+		Claim     string
+		MountPath string
+	}
+	var volumes []volumeMount
+	for _, v := range d.Volumes {
+		if d.Kind == kindStatefulSet {
+			// Claims come from the volumeClaimTemplates, one per pod.
+			volumes = append(volumes, volumeMount{Name: volumeName(v), MountPath: yamlQuote(v.MountPath)})
+			continue
+		}
+		configs = append(configs, renderVolumeClaim(ns, v))
+		volumes = append(volumes, volumeMount{Name: volumeName(v), Claim: v.Name, MountPath: yamlQuote(v.MountPath)})
+	}
+
 	tpl := `apiVersion: v1
 kind: Namespace
 metadata:
   name: {{.Namespace}}
 ---
+{{- range .Configs }}
+{{.}}---
+{{- end }}
+{{- if eq .Kind "job" }}
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+spec:
+{{- with .BackoffLimit }}
+  backoffLimit: {{.}}
+{{- end }}
+{{- with .TTLSecondsAfterFinished }}
+  ttlSecondsAfterFinished: {{.}}
+{{- end }}
+{{- if .ActiveDeadlineSeconds }}
+  activeDeadlineSeconds: {{.ActiveDeadlineSeconds}}
+{{- end }}
+  template:
+{{- else if eq .Kind "cronjob" }}
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+spec:
+  schedule: "{{.Schedule}}"
+{{- if .ConcurrencyPolicy }}
+  concurrencyPolicy: {{.ConcurrencyPolicy}}
+{{- end }}
+  jobTemplate:
+    metadata:
+      labels:
+        app: {{.App}}
+    spec:
+{{- with .BackoffLimit }}
+      backoffLimit: {{.}}
+{{- end }}
+{{- with .TTLSecondsAfterFinished }}
+      ttlSecondsAfterFinished: {{.}}
+{{- end }}
+{{- if .ActiveDeadlineSeconds }}
+      activeDeadlineSeconds: {{.ActiveDeadlineSeconds}}
+{{- end }}
+      template:
+{{- else if eq .Kind "statefulset" }}
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+spec:
+  serviceName: {{.HeadlessService}}
+{{- if .Replicas }}
+  replicas: {{.Replicas}}
+{{- end }}
+  selector:
+    matchLabels:
+      app: {{.App}}
+{{- if .ClaimTemplates }}
+  volumeClaimTemplates:
+{{- range .ClaimTemplates }}
+    - metadata:
+        name: vol-{{.Name}}
+        labels:
+          app: {{$.App}}
+          {{$.VolumeLabel}}: {{.Name}}
+      spec:
+        accessModes: ["ReadWriteOnce"]
+{{- if .StorageClass }}
+        storageClassName: {{.StorageClass}}
+{{- end }}
+        resources:
+          requests:
+            storage: {{.Size}}
+{{- end }}
+{{- end }}
+  template:
+{{- else }}
 apiVersion: apps/v1
 kind: Deployment
 metadata:
-  name: {{.App}}
+  name: {{.Name}}
   namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+{{- if .Slot }}
+    slot: {{.Slot}}
+{{- end }}
 spec:
-  replicas: 1
+{{- if .Replicas }}
+  replicas: {{.Replicas}}
+{{- end }}
   selector:
     matchLabels:
       app: {{.App}}
+{{- if .Slot }}
+      slot: {{.Slot}}
+{{- end }}
   template:
-    metadata:
-      labels:
-        app: {{.App}}
-    spec:
-      containers:
-        - name: {{.App}}
-          image: {{.Image}}
-          ports:
-            - containerPort: {{.Port}}
----
-apiVersion: v1
+{{- end }}
+{{.PodTemplate}}`
+	podTpl := `metadata:
+  labels:
+    app: {{.App}}
+{{- if .Slot }}
+    slot: {{.Slot}}
+{{- end }}
+  annotations:
+    tekton-runner/config-hash: "{{.ConfigHash}}"
+spec:
+{{- if .RestartPolicy }}
+  restartPolicy: {{.RestartPolicy}}
+{{- end }}
+  containers:
+    - name: {{.App}}
+      image: {{.Image}}
+{{- if .Command }}
+      command: {{.Command}}
+{{- end }}
+{{- if .Args }}
+      args: {{.Args}}
+{{- end }}
+{{- if .WorkingDir }}
+      workingDir: {{.WorkingDir}}
+{{- end }}
+{{- with .Resources }}
+      resources:
+{{- if or .CPURequest .MemoryRequest }}
+        requests:
+{{- if .CPURequest }}
+          cpu: "{{.CPURequest}}"
+{{- end }}
+{{- if .MemoryRequest }}
+          memory: "{{.MemoryRequest}}"
+{{- end }}
+{{- end }}
+{{- if or .CPULimit .MemoryLimit }}
+        limits:
+{{- if .CPULimit }}
+          cpu: "{{.CPULimit}}"
+{{- end }}
+{{- if .MemoryLimit }}
+          memory: "{{.MemoryLimit}}"
+{{- end }}
+{{- end }}
+{{- end }}
+{{- with .Readiness }}
+      readinessProbe:
+{{- template "probe" . }}
+{{- end }}
+{{- with .Liveness }}
+      livenessProbe:
+{{- template "probe" . }}
+{{- end }}
+      ports:
+{{- range .Ports }}
+        - name: {{.Name}}
+          containerPort: {{.ContainerPort}}
+          protocol: {{.Protocol}}
+{{- end }}
+      envFrom:
+        - configMapRef:
+            name: {{.EnvName}}
+            optional: true
+        - secretRef:
+            name: {{.EnvName}}
+            optional: true
+{{- if or .Files .Volumes }}
+      volumeMounts:
+{{- range .Files }}
+        - name: config-files
+          mountPath: {{.MountPath}}
+          subPath: {{.Key}}
+{{- end }}
+{{- range .Volumes }}
+        - name: {{.Name}}
+          mountPath: {{.MountPath}}
+{{- end }}
+{{- if or .Files .Claims }}
+  volumes:
+{{- end }}
+{{- if .Files }}
+    - name: config-files
+      configMap:
+        name: {{.FilesName}}
+{{- end }}
+{{- range .Volumes }}
+{{- if .Claim }}
+    - name: {{.Name}}
+      persistentVolumeClaim:
+        claimName: {{.Claim}}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- define "probe" }}
+{{- if eq .Type "http" }}
+        httpGet:
+          path: {{.Path}}
+          port: {{.Port}}
+{{- else if eq .Type "tcp" }}
+        tcpSocket:
+          port: {{.Port}}
+{{- else }}
+        exec:
+          command: {{.Command}}
+{{- end }}
+{{- if .InitialDelaySeconds }}
+        initialDelaySeconds: {{.InitialDelaySeconds}}
+{{- end }}
+{{- if .PeriodSeconds }}
+        periodSeconds: {{.PeriodSeconds}}
+{{- end }}
+{{- if .TimeoutSeconds }}
+        timeoutSeconds: {{.TimeoutSeconds}}
+{{- end }}
+{{- if .FailureThreshold }}
+        failureThreshold: {{.FailureThreshold}}
+{{- end }}
+{{- end }}
+`
+	replicas := d.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+	if d.Autoscale != nil {
+		// Left to the autoscaler, so an apply does not reset it.
+		replicas = 0
+	}
+	data := map[string]any{
+		"Namespace":  ns,
+		"Name":       wl.Name,
+		"App":        wl.App,
+		"Slot":       wl.Slot,
+		"Kind":       d.Kind,
+		"Image":      image,
+		"Replicas":   replicas,
+		"Command":    yamlList(d.Command),
+		"Args":       yamlList(d.Args),
+		"WorkingDir": quoteIfSet(d.WorkingDir),
+		"Resources":  d.Resources,
+		"Readiness":  renderProbe(d.Readiness, d.Ports),
+		"Liveness":   renderProbe(d.Liveness, d.Ports),
+		"Ports":      d.Ports,
+		"Configs":    configs,
+		"ConfigHash": hash,
+		"EnvName":    envConfigName(wl.Name),
+		"Files":      configFileMounts(d.ConfigFiles),
+		"FilesName":  filesConfigName(wl.Name),
+		"Volumes":    volumes,
+
+		"Schedule":                d.Schedule,
+		"ConcurrencyPolicy":       d.ConcurrencyPolicy,
+		"BackoffLimit":            d.BackoffLimit,
+		"TTLSecondsAfterFinished": d.TTLSecondsAfterFinished,
+		"ActiveDeadlineSeconds":   d.ActiveDeadlineSeconds,
+		"VolumeLabel":             volumeLabel,
+	}
+	if d.Kind == kindStatefulSet {
+		data["HeadlessService"] = headlessServiceName(wl.App)
+		data["ClaimTemplates"] = d.Volumes
+	} else {
+		data["Claims"] = len(volumes) > 0
+	}
+	// The pod template sits at a different depth in each workload kind.
+	depth := 4
+	switch d.Kind {
+	case kindJob:
+		data["RestartPolicy"] = "Never"
+	case kindCronJob:
+		data["RestartPolicy"] = "Never"
+		depth = 8
+	}
+	data["PodTemplate"] = indentLines(mustRender(podTpl, data), depth)
+	return mustRender(tpl, data)
+}
+
+func indentLines(s string, n int) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			lines[i] = pad + l
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// renderService renders the NodePort Service of an app. A slot restricts the
+// selector to one blue/green Deployment; a role marks auxiliary Services
+// (canary, preview) so they are not listed as apps.
+func renderService(ns, name, app, slot, role string, ports []DeployPort) string {
+	tpl := `apiVersion: v1
 kind: Service
 metadata:
-  name: {{.App}}
+  name: {{.Name}}
   namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+{{- if .Role }}
+    tekton-runner/role: {{.Role}}
+{{- end }}
 spec:
   type: NodePort
   selector:
     app: {{.App}}
+{{- if .Slot }}
+    slot: {{.Slot}}
+{{- end }}
   ports:
-    - port: 80
-      targetPort: {{.Port}}
+{{- range .Ports }}
+    - name: {{.Name}}
+      port: {{.ServicePort}}
+      targetPort: {{.Name}}
+      protocol: {{.Protocol}}
+{{- end }}
 `
-	return mustRender(tpl, map[string]string{
+	return mustRender(tpl, map[string]any{
 		"Namespace": ns,
+		"Name":      name,
 		"App":       app,
-		"Image":     image,
-		"Port":      fmt.Sprintf("%d", port),
+		"Slot":      slot,
+		"Role":      role,
+		"Ports":     ports,
 	})
 }
 
+// renderProbe fills in the probe port and quotes the exec command for the
+// deployment template.
+func renderProbe(p *Probe, ports []DeployPort) map[string]any {
+	if p == nil {
+		return nil
+	}
+	port := p.Port
+	if port == "" {
+		port = defaultProbePort(ports)
+	}
+	path := p.Path
+	if path == "" {
+		path = "/"
+	}
+	return map[string]any{
+		"Type":                p.Type,
+		"Path":                yamlQuote(path),
+		"Port":                port,
+		"Command":             yamlList(p.Command),
+		"InitialDelaySeconds": p.InitialDelaySeconds,
+		"PeriodSeconds":       p.PeriodSeconds,
+		"TimeoutSeconds":      p.TimeoutSeconds,
+		"FailureThreshold":    p.FailureThreshold,
+	}
+}
+
+// defaultProbePort is the port of probes that name none: the first TCP port,
+// since http and tcp probes cannot reach a UDP port.
+func defaultProbePort(ports []DeployPort) string {
+	for _, p := range ports {
+		if p.Protocol == "TCP" {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+func quoteIfSet(s string) string {
+	if s == "" {
+		return ""
+	}
+	return yamlQuote(s)
+}
+
+// yamlList renders a string list as a JSON flow sequence.
+func yamlList(in []string) string {
+	if len(in) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(in)
+	return string(b)
+}
+
 func sanitizeName(in string) string {
 	s := strings.ToLower(in)
 	re := regexp.MustCompile(`[^a-z0-9-]+`)
@@ -840,22 +2046,109 @@ func sanitizeName(in string) string {
 	return s
 }
 
-func getServiceNodePort(kubeconfig, namespace, app string) (int, error) {
-	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", namespace, "get", "svc", app, "-o", "jsonpath={.spec.ports[0].nodePort}")
+func getServicePorts(kubeconfig, namespace, app string) ([]ServicePort, error) {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", namespace, "get", "svc", app, "-o", `jsonpath={range .spec.ports[*]}{.name}:{.protocol}:{.port}:{.nodePort},{end}`)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return 0, fmt.Errorf("get service nodePort failed: %v", err)
+		return nil, fmt.Errorf("get service ports failed: %v", err)
 	}
-	portStr := strings.TrimSpace(string(out))
-	if portStr == "" {
-		return 0, fmt.Errorf("nodePort not found")
+	ports := parseServicePorts(strings.TrimSpace(string(out)))
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("nodePort not found")
 	}
-	var port int
-	_, err = fmt.Sscanf(portStr, "%d", &port)
+	return ports, nil
+}
+
+// getServicePort returns the named Service port, or the first one when name
+// is empty.
+func getServicePort(kubeconfig, namespace, app, name string) (ServicePort, error) {
+	ports, err := getServicePorts(kubeconfig, namespace, app)
 	if err != nil {
-		return 0, fmt.Errorf("invalid nodePort: %s", portStr)
+		return ServicePort{}, err
 	}
-	return port, nil
+	if name == "" {
+		return ports[0], nil
+	}
+	for _, p := range ports {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return ServicePort{}, fmt.Errorf("port %s not found on service %s", name, app)
+}
+
+// parseServicePorts parses the name:protocol:port:nodePort list produced by
+// the service jsonpath queries. Ports without a nodePort are skipped.
+func parseServicePorts(in string) []ServicePort {
+	var ports []ServicePort
+	for _, item := range strings.Split(in, ",") {
+		parts := strings.Split(item, ":")
+		if len(parts) != 4 {
+			continue
+		}
+		p := ServicePort{Name: parts[0], Protocol: parts[1]}
+		fmt.Sscanf(parts[2], "%d", &p.Port)
+		fmt.Sscanf(parts[3], "%d", &p.NodePort)
+		if p.NodePort == 0 {
+			continue
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+func endpointKey(workspace, app, port string) string {
+	if port == "" {
+		return workspace + "/" + app
+	}
+	return workspace + "/" + app + "/" + port
+}
+
+func endpointURL(p ServicePort) string {
+	host := serverHostIP
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	scheme := "http"
+	if p.Protocol == "UDP" {
+		scheme = "udp"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, p.NodePort)
+}
+
+// cacheEndpoints stores the URL of every named port of an app. The first port
+// is also stored under the plain app key for clients that don't name a port.
+func cacheEndpoints(workspace, app string, ports []ServicePort) {
+	serverState.mu.Lock()
+	defer serverState.mu.Unlock()
+	for i, p := range ports {
+		url := endpointURL(p)
+		if i == 0 {
+			serverState.endpoints[endpointKey(workspace, app, "")] = url
+		}
+		if p.Name != "" {
+			serverState.endpoints[endpointKey(workspace, app, p.Name)] = url
+		}
+	}
+}
+
+// lookupEndpoints returns the cached URL for a port of an app and, for the
+// unnamed lookup, the URLs of all named ports.
+func lookupEndpoints(workspace, app, port string) (string, map[string]string, bool) {
+	serverState.mu.Lock()
+	defer serverState.mu.Unlock()
+	url, ok := serverState.endpoints[endpointKey(workspace, app, port)]
+	if !ok {
+		return "", nil, false
+	}
+	named := map[string]string{}
+	prefix := endpointKey(workspace, app, "") + "/"
+	for k, v := range serverState.endpoints {
+		if strings.HasPrefix(k, prefix) {
+			named[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return url, named, true
 }
 
 func listWorkspaces() ([]byte, error) {
@@ -882,7 +2175,7 @@ func listWorkspaces() ([]byte, error) {
 }
 
 func listWorkspaceApps(kubeconfig, namespace string) ([]map[string]any, error) {
-	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", namespace, "get", "svc", "-o", `jsonpath={range .items[*]}{.metadata.name}|{.spec.ports[0].nodePort}{"\n"}{end}`)
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", namespace, "get", "svc", "-l", "!tekton-runner/role", "-o", `jsonpath={range .items[*]}{.metadata.name}|{range .spec.ports[*]}{.name}:{.protocol}:{.port}:{.nodePort},{end}{"\n"}{end}`)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, err
@@ -895,12 +2188,15 @@ func listWorkspaceApps(kubeconfig, namespace string) ([]map[string]any, error) {
 			continue
 		}
 		name := parts[0]
-		portStr := parts[1]
+		ports := parseServicePorts(parts[1])
 		var port int
-		fmt.Sscanf(portStr, "%d", &port)
+		if len(ports) > 0 {
+			port = ports[0].NodePort
+		}
 		apps = append(apps, map[string]any{
 			"app":      name,
 			"nodePort": port,
+			"ports":    ports,
 		})
 	}
 	return apps, nil
@@ -915,6 +2211,10 @@ func deleteWorkspace(name string) error {
 	}
 	kcfg := filepath.Join("/home/beko/kubeconfigs", name+".yaml")
 	_ = os.Remove(kcfg)
+	_ = os.RemoveAll(filepath.Join(helmChartDir, name))
+	if err := historyStore.removeWorkspace(name); err != nil {
+		log.Printf("deploy history cleanup for %s: %v", name, err)
+	}
 
 	serverState.mu.Lock()
 	for k := range serverState.endpoints {
@@ -926,9 +2226,39 @@ func deleteWorkspace(name string) error {
 	return nil
 }
 
-func deleteApp(workspace, app string) error {
+// deleteApp removes an app. Its volumes are kept unless purge is set.
+func deleteApp(workspace, app string, purge bool) error {
 	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
-	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "delete", "deployment", app)
+	if err := deleteAppObjects(kcfg, workspace, app); err != nil {
+		return err
+	}
+	forgetEndpoints(workspace, app)
+	if purge {
+		return purgeAppVolumes(kcfg, workspace, app)
+	}
+	return nil
+}
+
+func deleteAppObjects(kcfg, workspace, app string) error {
+	if release, ok := helmRelease(workspace, app); ok {
+		return uninstallHelm(kcfg, workspace, release)
+	}
+	if manifestsApp(workspace, app) {
+		return deleteManifestsApp(kcfg, workspace, app)
+	}
+	if err := deleteJobs(kcfg, workspace, app); err != nil {
+		return err
+	}
+	if isJobKind(appKind(workspace, app)) {
+		cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "delete", "configmap,secret", "-l", "app="+app, "--ignore-not-found")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("delete app config: %v", err)
+		}
+		return nil
+	}
+	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "delete", "deployment,statefulset,hpa", app, "--ignore-not-found")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -940,22 +2270,74 @@ func deleteApp(workspace, app string) error {
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("delete service: %v", err)
 	}
+	if err := cleanupStrategyObjects(kcfg, workspace, app); err != nil {
+		return err
+	}
+	cmd = exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "delete", "configmap,secret", "-l", "app="+app, "--ignore-not-found")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("delete app config: %v", err)
+	}
+	return nil
+}
 
+func forgetEndpoints(workspace, app string) {
 	serverState.mu.Lock()
-	delete(serverState.endpoints, workspace+"/"+app)
+	delete(serverState.endpoints, endpointKey(workspace, app, ""))
+	for k := range serverState.endpoints {
+		if strings.HasPrefix(k, endpointKey(workspace, app, "")+"/") {
+			delete(serverState.endpoints, k)
+		}
+	}
 	serverState.mu.Unlock()
-	return nil
 }
 
+// getAppStatus returns the state of an app in its cluster and the image of
+// its latest deploy.
 func getAppStatus(workspace, app string) ([]byte, error) {
+	b, err := appStatus(workspace, app)
+	if err != nil {
+		return nil, err
+	}
+	revs := historyStore.list(workspace, app)
+	if len(revs) == 0 {
+		return b, nil
+	}
+	var out map[string]any
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	out["image"] = revs[0].Image
+	if d := imageDigest(revs[0].Image); d != "" {
+		out["digest"] = d
+	}
+	return json.Marshal(out)
+}
+
+func appStatus(workspace, app string) ([]byte, error) {
 	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
-	podsCmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "get", "pods", "-l", "app="+app, "-o", "jsonpath={range .items[*]}{.metadata.name}|{.status.phase}{\"\\n\"}{end}")
+	if release, ok := helmRelease(workspace, app); ok {
+		return getHelmAppStatus(kcfg, workspace, app, release)
+	}
+	if manifestsApp(workspace, app) {
+		return getManifestsAppStatus(kcfg, workspace, app)
+	}
+	if kind := appKind(workspace, app); isJobKind(kind) {
+		return getJobAppStatus(kcfg, workspace, app, kind)
+	}
+	podsCmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "get", "pods", "-l", "app="+app, "-o", "jsonpath={range .items[*]}{.metadata.name}|{.status.phase}|{.status.containerStatuses[0].ready}|{.status.containerStatuses[0].restartCount}{\"\\n\"}{end}")
 	podsOut, podsErr := podsCmd.CombinedOutput()
 	if podsErr != nil {
 		return nil, fmt.Errorf("get app pods failed: %v", podsErr)
 	}
-	svcCmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "get", "svc", app, "-o", "jsonpath={.spec.ports[0].nodePort}")
-	svcOut, svcErr := svcCmd.CombinedOutput()
+	resource, deployment := appWorkload(kcfg, workspace, app)
+	deployCmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "get", resource, deployment, "-o", "jsonpath={.spec.replicas}|{.status.readyReplicas}|{.status.availableReplicas}|{.status.updatedReplicas}")
+	deployOut, deployErr := deployCmd.CombinedOutput()
+	if deployErr != nil {
+		return nil, fmt.Errorf("get app %s failed: %v", resource, deployErr)
+	}
+	ports, svcErr := getServicePorts(kcfg, workspace, app)
 	if svcErr != nil {
 		return nil, fmt.Errorf("get app service failed: %v", svcErr)
 	}
@@ -966,28 +2348,63 @@ func getAppStatus(workspace, app string) ([]byte, error) {
 			continue
 		}
 		parts := strings.Split(line, "|")
-		if len(parts) != 2 {
+		if len(parts) != 4 {
 			continue
 		}
+		var restarts int
+		fmt.Sscanf(parts[3], "%d", &restarts)
 		pods = append(pods, map[string]any{
-			"name":  parts[0],
-			"phase": parts[1],
+			"name":     parts[0],
+			"phase":    parts[1],
+			"ready":    parts[2] == "true",
+			"restarts": restarts,
 		})
 	}
 
-	nodePort := strings.TrimSpace(string(svcOut))
+	var desired, ready, available, updated int
+	counts := strings.Split(strings.TrimSpace(string(deployOut)), "|")
+	for i, v := range []*int{&desired, &ready, &available, &updated} {
+		if i < len(counts) {
+			fmt.Sscanf(counts[i], "%d", v)
+		}
+	}
+
+	nodePort := fmt.Sprintf("%d", ports[0].NodePort)
 	out := map[string]any{
-		"workspace": workspace,
-		"app":       app,
-		"nodePort":  nodePort,
-		"pods":      pods,
+		"workspace":  workspace,
+		"app":        app,
+		"deployment": deployment,
+		"kind":       resource,
+		"nodePort":   nodePort,
+		"ports":      ports,
+		"ready":      desired > 0 && ready >= desired,
+		"replicas": map[string]int{
+			"desired":   desired,
+			"ready":     ready,
+			"available": available,
+			"updated":   updated,
+		},
+		"pods": pods,
+	}
+	if as, ok := autoscaleStatus(kcfg, workspace, app); ok {
+		out["autoscale"] = as
+	}
+	if slot := serviceSlot(kcfg, workspace, app); slot != "" {
+		out["slot"] = slot
+	}
+	if weight, ok := canaryWeight(kcfg, workspace, app); ok {
+		out["canary_weight"] = weight
 	}
 	return json.Marshal(out)
 }
 
 func scaleApp(workspace, app, replicas string) error {
+	if revs := historyStore.list(workspace, app); len(revs) > 0 && revs[0].Deploy.Autoscale != nil {
+		return errAutoscaled
+	}
 	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
-	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "scale", "deployment", app, "--replicas", replicas)
+	resource, name := appWorkload(kcfg, workspace, app)
+	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "scale", resource, name, "--replicas", replicas)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -998,7 +2415,8 @@ func scaleApp(workspace, app, replicas string) error {
 
 func rolloutRestart(workspace, app string) error {
 	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
-	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "rollout", "restart", "deployment", app)
+	resource, name := appWorkload(kcfg, workspace, app)
+	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "rollout", "restart", resource, name)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -1009,7 +2427,7 @@ func rolloutRestart(workspace, app string) error {
 
 func rolloutRestartAll(workspace string) error {
 	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
-	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "rollout", "restart", "deployment", "-l", "app")
+	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "rollout", "restart", "deployment,statefulset", "-l", "app")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -1034,12 +2452,118 @@ func openAPISpec() string {
     },
     "/run": {
       "post": {
-        "summary": "Create TaskRun",
+        "summary": "Create TaskRun (or deploy an existing image with source.type=image)",
         "requestBody": {
           "required": true,
           "content": { "application/json": { "schema": { "$ref": "#/components/schemas/RunRequest" } } }
         },
-        "responses": { "202": { "description": "Submitted" } }
+        "responses": { "202": { "description": "Submitted (returns run_id)" } }
+      }
+    },
+    "/runs": {
+      "get": {
+        "summary": "List runs, newest first",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": false, "schema": { "type": "string" } },
+          { "name": "app", "in": "query", "required": false, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "Runs" } }
+      }
+    },
+    "/runs/{id}": {
+      "get": {
+        "summary": "Get run",
+        "parameters": [
+          { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "Run; workspace runs also list their app runs in apps. digest is the pushed image digest of builds" }, "404": { "description": "Not found" } }
+      }
+    },
+    "/runs/{id}/tests": {
+      "get": {
+        "summary": "JUnit results of the test stages of a pipeline run",
+        "parameters": [
+          { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "total/passed/failed/skipped counts and reports per stage with failure messages; workspace runs return them per app in apps" }, "404": { "description": "Not found" } }
+      }
+    },
+    "/runs/{id}/scan": {
+      "get": {
+        "summary": "Vulnerability scan result of a run",
+        "parameters": [
+          { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "scanned, and the scan summary: counts per severity, ignored/blocked counts, passed and the findings that blocked the deploy; workspace runs return them per app in apps" }, "404": { "description": "Not found" } }
+      }
+    },
+    "/runs/{id}/sbom": {
+      "get": {
+        "summary": "Archived SBOM of the image built by a run",
+        "parameters": [
+          { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "SPDX or CycloneDX JSON document" }, "404": { "description": "Run not found or no SBOM" } }
+      }
+    },
+    "/sbom/diff": {
+      "get": {
+        "summary": "Compare the SBOMs of two runs",
+        "parameters": [
+          { "name": "from", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "to", "in": "query", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "added, removed and changed packages (name, version, purl) and the unchanged count" }, "400": { "description": "from or to missing" }, "404": { "description": "Run not found or no SBOM" } }
+      }
+    },
+    "/projects/{name}/cache": {
+      "get": {
+        "summary": "Build cache of a project and its build durations by cache type",
+        "parameters": [
+          { "name": "name", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "namespace", "in": "query", "required": false, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "claim, claim_size, repo, last_used and builds (count, total/avg/last seconds) by pvc, registry and none" }, "404": { "description": "No builds recorded for the project" } }
+      }
+    },
+    "/projects/{name}/cache/clear": {
+      "post": {
+        "summary": "Delete the cache PVC and registry cache repository of a project",
+        "parameters": [
+          { "name": "name", "in": "path", "required": true, "schema": { "type": "string" } },
+          { "name": "namespace", "in": "query", "required": false, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "Cleared; the build stats are kept" }, "401": { "description": "Unauthorized" }, "404": { "description": "Project has no build cache" }, "409": { "description": "The cache is used by a running build" } }
+      }
+    },
+    "/workspace/run": {
+      "post": {
+        "summary": "Build several apps in parallel and deploy them in depends_on order",
+        "parameters": [
+          { "name": "dry_run", "in": "query", "required": false, "schema": { "type": "boolean" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": { "application/json": { "schema": { "$ref": "#/components/schemas/WorkspaceRequest" } } }
+        },
+        "responses": { "202": { "description": "Submitted; run_id, per-app run ids and deploy order" }, "400": { "description": "Invalid request" } }
+      }
+    },
+    "/workspace/import-compose": {
+      "post": {
+        "summary": "Translate a docker-compose file into a workspace request and run it",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": false, "schema": { "type": "string" } },
+          { "name": "dry_run", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "Return the translated workspace request and warnings" }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": { "schema": { "$ref": "#/components/schemas/ComposeImport" } },
+            "application/yaml": { "schema": { "type": "string", "description": "The compose file" } }
+          }
+        },
+        "responses": { "202": { "description": "Submitted; like /workspace/run plus warnings" }, "400": { "description": "Invalid compose file" } }
       }
     },
     "/endpoint": {
@@ -1047,7 +2571,8 @@ func openAPISpec() string {
         "summary": "Get app endpoint",
         "parameters": [
           { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
-          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } }
+          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "port", "in": "query", "required": false, "schema": { "type": "string" }, "description": "Named port (default: first port)" }
         ],
         "responses": { "200": { "description": "Endpoint" } }
       }
@@ -1082,9 +2607,35 @@ func openAPISpec() string {
       "get": {
         "summary": "Workspace status",
         "parameters": [
-          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } }
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "Status, including addons" } }
+      }
+    },
+    "/workspace/addons": {
+      "post": {
+        "summary": "Create or update workspace addons",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": { "application/json": { "schema": {
+            "type": "object",
+            "properties": { "addons": { "type": "array", "items": { "$ref": "#/components/schemas/Addon" } } }
+          } } }
+        },
+        "responses": { "200": { "description": "Provisioned" }, "400": { "description": "Invalid addons" }, "401": { "description": "Unauthorized" } }
+      }
+    },
+    "/workspace/addon/delete": {
+      "post": {
+        "summary": "Delete a workspace addon with its credentials and data",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "name", "in": "query", "required": true, "schema": { "type": "string" } }
         ],
-        "responses": { "200": { "description": "Status" } }
+        "responses": { "200": { "description": "Deleted" }, "401": { "description": "Unauthorized" }, "404": { "description": "Not found" } }
       }
     },
     "/workspace/delete": {
@@ -1104,7 +2655,7 @@ func openAPISpec() string {
           { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } },
           { "name": "replicas", "in": "query", "required": true, "schema": { "type": "integer" } }
         ],
-        "responses": { "200": { "description": "Scaled" } }
+        "responses": { "200": { "description": "Scaled" }, "409": { "description": "App is autoscaled" } }
       }
     },
     "/workspace/restart": {
@@ -1123,17 +2674,93 @@ func openAPISpec() string {
           { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
           { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } }
         ],
-        "responses": { "200": { "description": "Status" } }
+        "responses": { "200": { "description": "Status, with the image (and digest) of the latest deploy" } }
       }
     },
     "/app/delete": {
       "post": {
         "summary": "Delete app",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "purge", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "Also delete the app's volumes (PVCs); needs the API key when one is set" }
+        ],
+        "responses": { "200": { "description": "Deleted" }, "401": { "description": "Unauthorized (purge only)" } }
+      }
+    },
+    "/app/run-job": {
+      "post": {
+        "summary": "Run a Job from the app's image and config, streaming its logs",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "follow", "in": "query", "required": false, "schema": { "type": "boolean", "default": true }, "description": "false returns right after the Job is created" }
+        ],
+        "requestBody": {
+          "required": false,
+          "content": { "application/json": { "schema": { "$ref": "#/components/schemas/JobRun" } } }
+        },
+        "responses": {
+          "200": { "description": "Job logs, followed by a line with the result", "content": { "text/plain": {} } },
+          "202": { "description": "Job started (follow=false)" },
+          "401": { "description": "Unauthorized" },
+          "404": { "description": "App has no deploy history" }
+        }
+      }
+    },
+    "/app/config": {
+      "post": {
+        "summary": "Update app env, secret env and config files, then roll out",
         "parameters": [
           { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
           { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } }
         ],
-        "responses": { "200": { "description": "Deleted" } }
+        "requestBody": {
+          "required": true,
+          "content": { "application/json": { "schema": { "$ref": "#/components/schemas/AppConfig" } } }
+        },
+        "responses": { "200": { "description": "Updated" }, "400": { "description": "Invalid config or a reserved secret" }, "401": { "description": "Unauthorized" } }
+      }
+    },
+    "/app/history": {
+      "get": {
+        "summary": "Deploy history of an app, newest first",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "History; inline env_from_secret values are left out" }, "401": { "description": "Unauthorized" } }
+      }
+    },
+    "/app/rollback": {
+      "post": {
+        "summary": "Re-apply the image and spec of a previous revision",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "to", "in": "query", "required": true, "schema": { "type": "integer" } }
+        ],
+        "responses": { "200": { "description": "Rolled back" }, "401": { "description": "Unauthorized" }, "404": { "description": "Revision not found" } }
+      }
+    },
+    "/app/promote": {
+      "post": {
+        "summary": "Promote a canary to stable, or scale down the previous bluegreen slot",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "Promoted" }, "401": { "description": "Unauthorized" } }
+      }
+    },
+    "/app/abort": {
+      "post": {
+        "summary": "Remove a canary, or switch a bluegreen app back to its previous slot",
+        "parameters": [
+          { "name": "workspace", "in": "query", "required": true, "schema": { "type": "string" } },
+          { "name": "app", "in": "query", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": { "200": { "description": "Aborted" }, "401": { "description": "Unauthorized" } }
       }
     },
     "/app/restart": {
@@ -1154,10 +2781,20 @@ func openAPISpec() string {
         "properties": {
           "app_name": { "type": "string" },
           "workspace": { "type": "string" },
+          "addons": { "type": "array", "items": { "$ref": "#/components/schemas/Addon" } },
+          "pipeline": { "$ref": "#/components/schemas/Pipeline" },
+          "scan": { "$ref": "#/components/schemas/ScanPolicy" },
+          "sbom": {
+            "type": "object",
+            "description": "Archive an SBOM of the built image with the run",
+            "properties": {
+              "format": { "type": "string", "enum": ["spdx", "cyclonedx"], "description": "default spdx" }
+            }
+          },
           "source": {
             "type": "object",
             "properties": {
-              "type": { "type": "string", "enum": ["git","local","zip"] },
+              "type": { "type": "string", "enum": ["git","local","zip","image"] },
               "repo_url": { "type": "string" },
               "revision": { "type": "string" },
               "git_username": { "type": "string" },
@@ -1166,7 +2803,8 @@ func openAPISpec() string {
               "pvc_name": { "type": "string" },
               "zip_url": { "type": "string" },
               "zip_username": { "type": "string" },
-              "zip_password": { "type": "string" }
+              "zip_password": { "type": "string" },
+              "image": { "type": "string", "description": "Image to deploy for source.type=image (default: image.registry/project/project:tag)" }
             }
           },
           "image": {
@@ -1174,22 +2812,253 @@ func openAPISpec() string {
             "properties": {
               "project": { "type": "string" },
               "tag": { "type": "string" },
-              "registry": { "type": "string" }
+              "tag_strategy": { "type": "string", "enum": ["git-sha", "timestamp", "run-id", "template"], "description": "Sets tag when the request is submitted; tag must be empty" },
+              "tag_template": { "type": "string", "description": "Go template for tag_strategy=template, e.g. {{.Revision}}-{{.ShortSHA}}" },
+              "registry": { "type": "string" },
+              "digest": { "type": "string", "description": "sha256:... digest to pin the deployed image" },
+              "context_dir": { "type": "string", "description": "Build context, relative to the source root" },
+              "dockerfile": { "type": "string", "description": "Dockerfile path, relative to context_dir" },
+              "build_args": { "type": "object", "additionalProperties": { "type": "string" } },
+              "target": { "type": "string", "description": "Build stage to stop at" },
+              "labels": { "type": "object", "additionalProperties": { "type": "string" } },
+              "platforms": { "type": "string", "description": "Comma separated platforms of a multi-arch build, e.g. linux/amd64,linux/arm64; must be listed in the tekton-runner/platforms annotation of the Task" },
+              "sign": { "type": "boolean", "description": "Sign the pushed image with cosign; pipelines need a sign stage" },
+              "cache": { "$ref": "#/components/schemas/BuildCache" },
+              "build_mode": { "type": "string", "enum": ["dockerfile", "auto"], "description": "auto detects the language (go.mod, package.json, pom.xml, requirements.txt) of sources without a Dockerfile and generates one; without deploy ports the app is deployed on the detected port (default dockerfile)" }
             }
           },
           "deploy": {
             "type": "object",
             "properties": {
-              "container_port": { "type": "integer" }
+              "container_port": { "type": "integer", "description": "default 8080; auto builds without ports use the detected port" },
+              "ports": { "type": "array", "items": { "$ref": "#/components/schemas/DeployPort" } },
+              "env": { "type": "object", "additionalProperties": { "type": "string" } },
+              "env_from_secret": { "type": "object", "additionalProperties": { "$ref": "#/components/schemas/SecretEnv" } },
+              "config_files": { "type": "array", "items": { "$ref": "#/components/schemas/ConfigFile" } },
+              "replicas": { "type": "integer" },
+              "autoscale": { "$ref": "#/components/schemas/Autoscale" },
+              "command": { "type": "array", "items": { "type": "string" } },
+              "args": { "type": "array", "items": { "type": "string" } },
+              "working_dir": { "type": "string" },
+              "resources": { "$ref": "#/components/schemas/Resources" },
+              "readiness_probe": { "$ref": "#/components/schemas/Probe" },
+              "liveness_probe": { "$ref": "#/components/schemas/Probe" },
+              "strategy": { "type": "string", "enum": ["rolling","bluegreen","canary"] },
+              "canary_weight": { "type": "integer", "description": "Percent of external-port connections sent to the canary (default 10, 0 sends none). NodePort traffic always reaches the stable app" },
+              "smoke_path": { "type": "string", "description": "HTTP path checked on the new bluegreen slot before the switch" },
+              "type": { "type": "string", "enum": ["deployment","helm","manifests","kustomize"], "description": "How the app is deployed (default deployment)" },
+              "helm": { "$ref": "#/components/schemas/HelmChart" },
+              "manifests": { "$ref": "#/components/schemas/ManifestSpec" },
+              "kind": { "type": "string", "enum": ["deployment","statefulset","job","cronjob"], "description": "Workload kind for deploy.type=deployment (default deployment)" },
+              "schedule": { "type": "string", "description": "Cron schedule of a cronjob" },
+              "concurrency_policy": { "type": "string", "enum": ["Allow","Forbid","Replace"] },
+              "backoff_limit": { "type": "integer", "description": "Retries of a failed job (Kubernetes default 6)" },
+              "ttl_seconds_after_finished": { "type": "integer", "description": "Delete finished jobs after this many seconds" },
+              "active_deadline_seconds": { "type": "integer", "description": "Maximum run time of a job" },
+              "volumes": { "type": "array", "items": { "$ref": "#/components/schemas/Volume" } },
+              "smoke_tests": { "type": "array", "items": { "$ref": "#/components/schemas/SmokeTest" } },
+              "smoke_timeout_seconds": { "type": "integer", "description": "Time allowed for all smoke tests to pass (default 120)" },
+              "rollback_on_failure": { "type": "boolean", "description": "Roll back to the previous revision (or abort the canary) when the rollout or the smoke tests fail" }
+            }
+          }
+        }
+      },
+      "DeployPort": {
+        "type": "object",
+        "properties": {
+          "name": { "type": "string" },
+          "container_port": { "type": "integer" },
+          "protocol": { "type": "string", "enum": ["TCP","UDP"] },
+          "service_port": { "type": "integer" }
+        }
+      },
+      "WorkspaceRequest": {
+        "type": "object",
+        "required": ["workspace", "apps"],
+        "properties": {
+          "workspace": { "type": "string" },
+          "namespace": { "type": "string" },
+          "addons": { "type": "array", "items": { "$ref": "#/components/schemas/Addon" } },
+          "apps": {
+            "type": "array",
+            "items": {
+              "allOf": [
+                { "$ref": "#/components/schemas/RunRequest" },
+                { "type": "object", "properties": { "depends_on": { "type": "array", "items": { "type": "string" } } } }
+              ]
             }
           }
         }
       },
+      "ComposeImport": {
+        "type": "object",
+        "properties": {
+          "workspace": { "type": "string" },
+          "namespace": { "type": "string" },
+          "compose": { "type": "string", "description": "Compose file content; read from source when empty" },
+          "compose_path": { "type": "string", "description": "Path of the compose file, relative to the source root (default: compose.yaml, docker-compose.yml, ...)" },
+          "source": { "type": "object", "description": "git, zip or local source of services with a build section" },
+          "image": { "type": "object", "description": "registry and tag of built images" }
+        }
+      },
+      "HelmChart": {
+        "type": "object",
+        "properties": {
+          "chart": { "type": "string", "description": "oci:// reference, absolute .tgz path on the runner host, or chart directory in the git/zip source" },
+          "version": { "type": "string", "description": "Chart version for oci:// charts" },
+          "release": { "type": "string", "description": "Release name (default: app name)" },
+          "values": { "type": "object", "description": "Values overrides; not kept in the deploy history, rollbacks read them from the helm release revision" },
+          "image_repository_key": { "type": "string", "description": "Value key set to the image repository (default image.repository)" },
+          "image_tag_key": { "type": "string", "description": "Value key set to the image tag (default image.tag)" },
+          "skip_image": { "type": "boolean", "description": "Do not set the image values" }
+        }
+      },
+      "ManifestSpec": {
+        "type": "object",
+        "properties": {
+          "path": { "type": "string", "description": "File or directory in the git/zip source (kustomize: directory with a kustomization)" },
+          "inline": { "type": "string", "description": "YAML objects, or a kustomization.yaml for kustomize; not kept in the deploy history" },
+          "images": { "type": "array", "items": { "type": "string" }, "description": "Image repositories replaced by the deployed image (default: image.project and the app name)" }
+        }
+      },
+      "Volume": {
+        "type": "object",
+        "properties": {
+          "name": { "type": "string", "description": "PVC name, shared by apps of the workspace using the same name" },
+          "mount_path": { "type": "string" },
+          "size": { "type": "string", "description": "default 1Gi" },
+          "storage_class": { "type": "string", "description": "StorageClass of the claim (default: the cluster default, local-path in kind)" }
+        }
+      },
+      "Addon": {
+        "type": "object",
+        "required": ["type"],
+        "properties": {
+          "type": { "type": "string", "enum": ["postgres","mysql","redis","rabbitmq","minio"] },
+          "name": { "type": "string", "description": "Service name and env prefix (default: type)" },
+          "version": { "type": "string", "description": "Image tag, e.g. 16 (default: a pinned version per type)" },
+          "storage": { "type": "string", "description": "PVC size (default 1Gi)" }
+        }
+      },
+      "SmokeTest": {
+        "type": "object",
+        "properties": {
+          "name": { "type": "string" },
+          "method": { "type": "string" },
+          "path": { "type": "string" },
+          "port": { "type": "string", "description": "Port name (default: first TCP port)" },
+          "body": { "type": "string" },
+          "expect_status": { "type": "array", "items": { "type": "integer" } },
+          "expect_body": { "type": "array", "items": { "type": "string" } }
+        }
+      },
+      "Resources": {
+        "type": "object",
+        "properties": {
+          "cpu_request": { "type": "string" },
+          "cpu_limit": { "type": "string" },
+          "memory_request": { "type": "string" },
+          "memory_limit": { "type": "string" }
+        }
+      },
+      "Probe": {
+        "type": "object",
+        "properties": {
+          "type": { "type": "string", "enum": ["http","tcp","exec"] },
+          "path": { "type": "string" },
+          "port": { "type": "string" },
+          "command": { "type": "array", "items": { "type": "string" } },
+          "initial_delay_seconds": { "type": "integer" },
+          "period_seconds": { "type": "integer" },
+          "timeout_seconds": { "type": "integer" },
+          "failure_threshold": { "type": "integer" }
+        }
+      },
+      "SecretEnv": {
+        "type": "object",
+        "properties": {
+          "value": { "type": "string" },
+          "secret": { "type": "string", "description": "Secret in the runner namespace" },
+          "key": { "type": "string" }
+        }
+      },
+      "ConfigFile": {
+        "type": "object",
+        "properties": {
+          "path": { "type": "string" },
+          "content": { "type": "string" }
+        }
+      },
+      "Autoscale": {
+        "type": "object",
+        "properties": {
+          "min": { "type": "integer", "description": "default 1" },
+          "max": { "type": "integer" },
+          "target_cpu": { "type": "integer", "description": "Average CPU use in percent of resources.cpu_request (default 80)" }
+        }
+      },
+      "Pipeline": {
+        "type": "object",
+        "description": "Build with a PipelineRun: the source is fetched, then the stages run in order",
+        "properties": {
+          "stages": { "type": "array", "items": { "$ref": "#/components/schemas/Stage" } },
+          "workspace_size": { "type": "string", "description": "Size of the shared workspace PVC (default 1Gi)" }
+        }
+      },
+      "BuildCache": {
+        "type": "object",
+        "description": "Keep the build cache of the project between builds",
+        "properties": {
+          "type": { "type": "string", "enum": ["pvc", "registry"], "description": "pvc: a PVC bound to the cache workspace of the build; registry: kaniko layer cache in <registry>/<project>/<project>-cache (default pvc)" },
+          "size": { "type": "string", "description": "PVC size of pvc caches (default BUILD_CACHE_SIZE or 5Gi, at most BUILD_CACHE_MAX_SIZE or 20Gi)" }
+        }
+      },
+      "ScanPolicy": {
+        "type": "object",
+        "description": "Scan the image before deploy and block it on findings above max_severity",
+        "properties": {
+          "max_severity": { "type": "string", "enum": ["UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"], "description": "default HIGH" },
+          "ignore": { "type": "array", "items": { "type": "string" }, "description": "Vulnerability ids that never block" }
+        }
+      },
+      "Stage": {
+        "type": "object",
+        "required": ["type"],
+        "properties": {
+          "name": { "type": "string", "description": "default: type" },
+          "type": { "type": "string", "enum": ["test", "lint", "build", "scan", "sbom", "push", "sign"] },
+          "image": { "type": "string", "description": "Image of test/lint stages, scanner image of scan and sbom stages, cosign image of sign stages" },
+          "command": { "type": "array", "items": { "type": "string" }, "description": "test/lint command" },
+          "workdir": { "type": "string", "description": "test/lint working directory, a relative path inside the source of letters, digits, ., _, - and /" },
+          "env": { "type": "object", "additionalProperties": { "type": "string" } },
+          "reports": { "type": "string", "description": "test: glob of extra JUnit XML files, relative to the source; reports in $JUNIT_DIR are always read" },
+          "severity": { "type": "string", "deprecated": true, "description": "scan: severities that fail the scan, e.g. HIGH,CRITICAL; sets scan.max_severity below the lowest one when it is not given" }
+        }
+      },
+      "JobRun": {
+        "type": "object",
+        "properties": {
+          "command": { "type": "array", "items": { "type": "string" }, "description": "Replaces the app command" },
+          "args": { "type": "array", "items": { "type": "string" }, "description": "Replaces the app args" },
+          "env": { "type": "object", "additionalProperties": { "type": "string" }, "description": "Added to the app env" },
+          "timeout_seconds": { "type": "integer", "description": "activeDeadlineSeconds of the Job" }
+        }
+      },
+      "AppConfig": {
+        "type": "object",
+        "properties": {
+          "namespace": { "type": "string" },
+          "env": { "type": "object", "additionalProperties": { "type": "string" } },
+          "env_from_secret": { "type": "object", "additionalProperties": { "$ref": "#/components/schemas/SecretEnv" } },
+          "config_files": { "type": "array", "items": { "$ref": "#/components/schemas/ConfigFile" } }
+        }
+      },
       "ExternalPortEntry": {
         "type": "object",
         "properties": {
           "workspace": { "type": "string" },
           "app": { "type": "string" },
+          "port": { "type": "string" },
           "external_port": { "type": "integer" }
         }
       }
@@ -1256,13 +3125,13 @@ func (s *ExternalPortStore) upsert(in ExternalPortEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, e := range s.entries {
-		if e.ExternalPort == in.ExternalPort && (e.Workspace != in.Workspace || e.App != in.App) {
+		if e.ExternalPort == in.ExternalPort && (e.Workspace != in.Workspace || e.App != in.App || e.Port != in.Port) {
 			return errPortConflict
 		}
 	}
 	updated := false
 	for i, e := range s.entries {
-		if e.Workspace == in.Workspace && e.App == in.App {
+		if e.Workspace == in.Workspace && e.App == in.App && e.Port == in.Port {
 			s.entries[i] = in
 			updated = true
 			break
@@ -1282,12 +3151,12 @@ func (s *ExternalPortStore) upsert(in ExternalPortEntry) error {
 	return os.Rename(tmp, s.path)
 }
 
-func (s *ExternalPortStore) remove(workspace, app string) error {
+func (s *ExternalPortStore) remove(workspace, app, port string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	out := make([]ExternalPortEntry, 0, len(s.entries))
 	for _, e := range s.entries {
-		if e.Workspace == workspace && e.App == app {
+		if e.Workspace == workspace && e.App == app && e.Port == port {
 			continue
 		}
 		out = append(out, e)
@@ -1304,29 +3173,31 @@ func (s *ExternalPortStore) remove(workspace, app string) error {
 	return os.Rename(tmp, s.path)
 }
 
-func forwardKey(workspace, app string) string {
-	return workspace + "::" + app
+func forwardKey(workspace, app, port string) string {
+	return workspace + "::" + app + "::" + port
 }
 
-func ensureForward(workspace, app string, externalPort int) error {
+// ensureForward exposes a Service port of an app on the host. An empty port
+// name selects the first port of the Service.
+func ensureForward(workspace, app, port string, externalPort int) error {
 	if externalPort <= 0 {
 		return fmt.Errorf("invalid external port")
 	}
-	key := forwardKey(workspace, app)
+	key := forwardKey(workspace, app, port)
 
 	forwardMu.Lock()
-	if fwd, ok := forwards[key]; ok && fwd != nil && fwd.Cmd != nil && fwd.Cmd.Process != nil {
+	if fwd, ok := forwards[key]; ok && fwd != nil && (fwd.Proxy != nil || fwd.Cmd != nil && fwd.Cmd.Process != nil) {
 		if fwd.Port == externalPort {
 			forwardMu.Unlock()
 			return nil
 		}
-		_ = fwd.Cmd.Process.Kill()
+		fwd.stop()
 		delete(forwards, key)
 	}
 	forwardMu.Unlock()
 
 	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
-	nodePort, err := getServiceNodePort(kcfg, workspace, app)
+	svcPort, err := getServicePort(kcfg, workspace, app, port)
 	if err != nil {
 		return err
 	}
@@ -1335,16 +3206,42 @@ func ensureForward(workspace, app string, externalPort int) error {
 		return err
 	}
 
+	// With a canary running, connections are split in-process by weight.
+	if weight, ok := canaryWeight(kcfg, workspace, app); ok && svcPort.Protocol != "UDP" {
+		canaryPort, err := getServicePort(kcfg, workspace, app+"-canary", port)
+		if err != nil {
+			return err
+		}
+		p, err := startWeightedProxy(externalPort, []proxyBackend{
+			{Addr: fmt.Sprintf("%s:%d", nodeIP, svcPort.NodePort), Weight: 100 - weight},
+			{Addr: fmt.Sprintf("%s:%d", nodeIP, canaryPort.NodePort), Weight: weight},
+		})
+		if err != nil {
+			return err
+		}
+		forwardMu.Lock()
+		forwards[key] = &Forward{Port: externalPort, Proxy: p}
+		forwardMu.Unlock()
+		return nil
+	}
+
 	if _, err := exec.LookPath("socat"); err != nil {
 		return fmt.Errorf("socat not found")
 	}
 
+	proto := "TCP"
+	if svcPort.Protocol == "UDP" {
+		proto = "UDP"
+	}
 	args := []string{
-		fmt.Sprintf("TCP-LISTEN:%d,bind=0.0.0.0,fork,reuseaddr", externalPort),
-		fmt.Sprintf("TCP:%s:%d", nodeIP, nodePort),
+		fmt.Sprintf("%s-LISTEN:%d,bind=0.0.0.0,fork,reuseaddr", proto, externalPort),
+		fmt.Sprintf("%s:%s:%d", proto, nodeIP, svcPort.NodePort),
 	}
 	cmd := exec.Command("socat", args...)
 	logPath := fmt.Sprintf("/tmp/socat-%s-%s.log", workspace, app)
+	if port != "" {
+		logPath = fmt.Sprintf("/tmp/socat-%s-%s-%s.log", workspace, app, port)
+	}
 	f, _ := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
 	if f != nil {
 		cmd.Stdout = f
@@ -1359,6 +3256,38 @@ func ensureForward(workspace, app string, externalPort int) error {
 	return nil
 }
 
+// stop closes the forward and waits for socat to exit, so the external port
+// is free again and the process is reaped before the port is re-bound.
+func (f *Forward) stop() {
+	if f.Proxy != nil {
+		_ = f.Proxy.Close()
+	}
+	if f.Cmd != nil && f.Cmd.Process != nil {
+		_ = f.Cmd.Process.Kill()
+		_ = f.Cmd.Wait()
+	}
+}
+
+// restartForwards recreates the external port forwards of an app, e.g. after
+// a canary was added or removed.
+func restartForwards(workspace, app string) {
+	for _, e := range portStore.list() {
+		if e.Workspace != workspace || e.App != app {
+			continue
+		}
+		key := forwardKey(e.Workspace, e.App, e.Port)
+		forwardMu.Lock()
+		if fwd, ok := forwards[key]; ok && fwd != nil {
+			fwd.stop()
+			delete(forwards, key)
+		}
+		forwardMu.Unlock()
+		if err := ensureForward(e.Workspace, e.App, e.Port, e.ExternalPort); err != nil {
+			log.Printf("forward restart failed for %s: %v", endpointKey(e.Workspace, e.App, e.Port), err)
+		}
+	}
+}
+
 func getNodeInternalIP(kubeconfig, workspace string) (string, error) {
 	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "get", "node", "-o", "jsonpath={.items[0].status.addresses[?(@.type==\"InternalIP\")].address}")
 	out, err := cmd.Output()
@@ -1410,7 +3339,7 @@ func getWorkspaceStatus(workspace string) ([]byte, error) {
 		return nil, fmt.Errorf("get pods failed: %v", podsErr)
 	}
 
-	servicesCmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "get", "svc", "-o", `jsonpath={range .items[*]}{.metadata.name}|{.spec.ports[0].nodePort}{"\n"}{end}`)
+	servicesCmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "get", "svc", "-l", "!tekton-runner/role", "-o", `jsonpath={range .items[*]}{.metadata.name}|{range .spec.ports[*]}{.name}:{.protocol}:{.port}:{.nodePort},{end}{"\n"}{end}`)
 	svcOut, svcErr := servicesCmd.CombinedOutput()
 	if svcErr != nil {
 		return nil, fmt.Errorf("get services failed: %v", svcErr)
@@ -1440,19 +3369,28 @@ func getWorkspaceStatus(workspace string) ([]byte, error) {
 		if len(parts) != 2 {
 			continue
 		}
-		portStr := parts[1]
+		ports := parseServicePorts(parts[1])
 		var port int
-		fmt.Sscanf(portStr, "%d", &port)
+		if len(ports) > 0 {
+			port = ports[0].NodePort
+		}
 		svcs = append(svcs, map[string]any{
 			"name":     parts[0],
 			"nodePort": port,
+			"ports":    ports,
 		})
 	}
 
+	addons, err := listAddons(kcfg, workspace)
+	if err != nil {
+		return nil, err
+	}
+
 	out := map[string]any{
 		"workspace": workspace,
 		"pods":      pods,
 		"services":  svcs,
+		"addons":    addons,
 	}
 	return json.Marshal(out)
 }
@@ -1470,7 +3408,14 @@ func setDefaults(in *Input) {
 	if in.Image.Registry == "" {
 		in.Image.Registry = "lenovo:8443"
 	}
-	if in.Image.Tag == "" {
+	setPipelineDefaults(in.Pipeline)
+	setScanDefaults(in)
+	setSBOMDefaults(in)
+	setSignDefaults(in)
+	setCacheDefaults(in)
+	setBuildModeDefaults(in)
+	in.Image.Platforms = strings.Join(platformList(in.Image.Platforms), ",")
+	if in.Image.Tag == "" && in.Image.TagStrategy == "" {
 		in.Image.Tag = "latest"
 	}
 	if in.Source.NFS != nil && in.Source.NFS.Size == "" {
@@ -1482,15 +3427,65 @@ func setDefaults(in *Input) {
 	if in.Deploy.ContainerPort == 0 {
 		in.Deploy.ContainerPort = 8080
 	}
+	if len(in.Deploy.Ports) == 0 {
+		in.Deploy.Ports = defaultPorts(in.Deploy.ContainerPort)
+	}
+	for i := range in.Deploy.Ports {
+		p := &in.Deploy.Ports[i]
+		p.Protocol = strings.ToUpper(p.Protocol)
+		if p.Protocol == "" {
+			p.Protocol = "TCP"
+		}
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("port-%d", p.ContainerPort)
+		}
+		if p.ServicePort == 0 {
+			p.ServicePort = p.ContainerPort
+		}
+	}
+	setVolumeDefaults(in.Deploy.Volumes)
+	setAutoscaleDefaults(in.Deploy.Autoscale)
+	setHelmDefaults(in)
+	setAddonDefaults(in.Addons)
 }
 
 func validate(in *Input) error {
-	if in.Source.Type != "git" && in.Source.Type != "local" && in.Source.Type != "zip" {
-		return fmt.Errorf("source.type must be git, local, or zip")
+	if in.Source.Type != "git" && in.Source.Type != "local" && in.Source.Type != "zip" && in.Source.Type != "image" {
+		return fmt.Errorf("source.type must be git, local, zip, or image")
 	}
-	if in.Image.Project == "" {
+	if in.Image.Project == "" && (in.Source.Type != "image" || in.Source.Image == "") {
 		return fmt.Errorf("image.project is required")
 	}
+	if in.Image.Digest != "" && !digestRe.MatchString(in.Image.Digest) {
+		return fmt.Errorf("image.digest must be sha256:<64 hex chars>")
+	}
+	if err := validateTagStrategy(in); err != nil {
+		return err
+	}
+	if err := validateBuildOptions(in.Image); err != nil {
+		return err
+	}
+	if err := validatePlatforms(in); err != nil {
+		return err
+	}
+	if err := validatePipeline(in); err != nil {
+		return err
+	}
+	if err := validateScan(in); err != nil {
+		return err
+	}
+	if err := validateSBOM(in); err != nil {
+		return err
+	}
+	if err := validateSign(in); err != nil {
+		return err
+	}
+	if err := validateCache(in); err != nil {
+		return err
+	}
+	if err := validateBuildMode(in); err != nil {
+		return err
+	}
 	if in.Source.Type == "git" {
 		if in.Source.RepoURL == "" {
 			return fmt.Errorf("source.repo_url is required for git")
@@ -1504,6 +3499,14 @@ func validate(in *Input) error {
 			return fmt.Errorf("source.pvc_name or source.nfs/source.smb is required for local")
 		}
 	}
+	if in.Source.Type == "image" {
+		if in.AppName == "" {
+			return fmt.Errorf("app_name is required for image deployments")
+		}
+		if strings.ContainsAny(in.Source.Image, " \t\n") {
+			return fmt.Errorf("source.image is not a valid image reference")
+		}
+	}
 	if in.Source.Type == "zip" {
 		if in.Source.ZipURL == "" {
 			return fmt.Errorf("source.zip_url is required for zip")
@@ -1515,6 +3518,152 @@ func validate(in *Input) error {
 	if in.Workspace != "" && !strings.HasPrefix(in.Workspace, "ws-") {
 		return fmt.Errorf("workspace must start with ws-")
 	}
+	if err := validatePorts(in.Deploy.Ports); err != nil {
+		return err
+	}
+	if err := validateAppConfig(in.Deploy.Env, in.Deploy.EnvFromSecret, in.Deploy.ConfigFiles); err != nil {
+		return err
+	}
+	if err := validateVolumes(in.Deploy.Volumes, in.Deploy.ConfigFiles); err != nil {
+		return err
+	}
+	switch in.Deploy.Type {
+	case "", deployTypeDeployment:
+	case deployTypeHelm:
+		if err := validateHelm(in); err != nil {
+			return err
+		}
+	case deployTypeManifests, deployTypeKustomize:
+		if err := validateManifestSpec(in); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("deploy.type must be deployment, helm, manifests or kustomize")
+	}
+	if err := validateKind(in); err != nil {
+		return err
+	}
+	if err := validateAutoscale(in.Deploy); err != nil {
+		return err
+	}
+	if in.Deploy.Replicas < 0 {
+		return fmt.Errorf("deploy.replicas must not be negative")
+	}
+	if err := validateResources(in.Deploy.Resources); err != nil {
+		return err
+	}
+	if err := validateProbe("deploy.readiness_probe", in.Deploy.Readiness, in.Deploy.Ports); err != nil {
+		return err
+	}
+	if err := validateProbe("deploy.liveness_probe", in.Deploy.Liveness, in.Deploy.Ports); err != nil {
+		return err
+	}
+	switch in.Deploy.Strategy {
+	case "", strategyRolling, strategyBlueGreen, strategyCanary:
+	default:
+		return fmt.Errorf("deploy.strategy must be rolling, bluegreen or canary")
+	}
+	if w := in.Deploy.CanaryWeight; w != nil && (*w < 0 || *w > 100) {
+		return fmt.Errorf("deploy.canary_weight must be between 0 and 100")
+	}
+	if in.Deploy.SmokePath != "" && !strings.HasPrefix(in.Deploy.SmokePath, "/") {
+		return fmt.Errorf("deploy.smoke_path must start with /")
+	}
+	if err := validateSmokeTests(in.Deploy.SmokeTests, in.Deploy.Ports); err != nil {
+		return err
+	}
+	if in.Deploy.SmokeTimeoutSeconds < 0 {
+		return fmt.Errorf("deploy.smoke_timeout_seconds must not be negative")
+	}
+	if err := validateAddons(in.Addons, sanitizeName(in.AppName)); err != nil {
+		return err
+	}
+	return nil
+}
+
+var quantityRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(m|k|Ki|M|Mi|G|Gi|T|Ti)?$`)
+
+func validateResources(r *Resources) error {
+	if r == nil {
+		return nil
+	}
+	for name, v := range map[string]string{
+		"cpu_request":    r.CPURequest,
+		"cpu_limit":      r.CPULimit,
+		"memory_request": r.MemoryRequest,
+		"memory_limit":   r.MemoryLimit,
+	} {
+		if v != "" && !quantityRe.MatchString(v) {
+			return fmt.Errorf("deploy.resources.%s: invalid quantity %q", name, v)
+		}
+	}
+	return nil
+}
+
+func validateProbe(field string, p *Probe, ports []DeployPort) error {
+	if p == nil {
+		return nil
+	}
+	switch p.Type {
+	case "http", "tcp":
+		if p.Port == "" {
+			// Without deploy.ports the app gets a default TCP port.
+			if len(ports) > 0 && defaultProbePort(ports) == "" {
+				return fmt.Errorf("%s: deploy.ports has no TCP port to probe", field)
+			}
+			return nil
+		}
+		for _, dp := range ports {
+			if dp.Name == p.Port {
+				if dp.Protocol != "TCP" {
+					return fmt.Errorf("%s: port %s is not TCP", field, p.Port)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: unknown port %s", field, p.Port)
+	case "exec":
+		if len(p.Command) == 0 {
+			return fmt.Errorf("%s: command is required for exec probes", field)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: type must be http, tcp or exec", field)
+}
+
+var digestRe = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// portNameRe matches an IANA service name as Kubernetes wants it for named
+// ports: lowercase alphanumeric words joined by single hyphens. The name
+// also needs a letter, which portNameLetterRe checks.
+var (
+	portNameRe       = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	portNameLetterRe = regexp.MustCompile(`[a-z]`)
+)
+
+func validatePorts(ports []DeployPort) error {
+	names := map[string]bool{}
+	svcPorts := map[string]bool{}
+	for _, p := range ports {
+		if len(p.Name) > 15 || !portNameRe.MatchString(p.Name) || !portNameLetterRe.MatchString(p.Name) {
+			return fmt.Errorf("deploy.ports name %q must be a lowercase name of at most 15 characters with at least one letter", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("deploy.ports name %q is duplicated", p.Name)
+		}
+		names[p.Name] = true
+		if p.Protocol != "TCP" && p.Protocol != "UDP" {
+			return fmt.Errorf("deploy.ports %s: protocol must be TCP or UDP", p.Name)
+		}
+		if p.ContainerPort < 1 || p.ContainerPort > 65535 || p.ServicePort < 1 || p.ServicePort > 65535 {
+			return fmt.Errorf("deploy.ports %s: ports must be between 1 and 65535", p.Name)
+		}
+		key := fmt.Sprintf("%d/%s", p.ServicePort, p.Protocol)
+		if svcPorts[key] {
+			return fmt.Errorf("deploy.ports %s: service_port %s is duplicated", p.Name, key)
+		}
+		svcPorts[key] = true
+	}
 	return nil
 }
 
@@ -1683,23 +3832,25 @@ spec:
 
 func renderTaskRun(in Input) string {
 	ctx := RenderContext{
-		Namespace:  in.Namespace,
-		Task:       in.Task,
-		SourceType: in.Source.Type,
-		RepoURL:    in.Source.RepoURL,
-		Revision:   in.Source.Revision,
-		LocalPath:  in.Source.LocalPath,
-		Project:    in.Image.Project,
-		Tag:        in.Image.Tag,
-		Registry:   in.Image.Registry,
-		ZipURL:     in.Source.ZipURL,
+		Namespace:   in.Namespace,
+		Task:        in.Task,
+		SourceType:  in.Source.Type,
+		RepoURL:     in.Source.RepoURL,
+		Revision:    in.Source.Revision,
+		LocalPath:   in.Source.LocalPath,
+		Project:     in.Image.Project,
+		Tag:         in.Image.Tag,
+		Registry:    in.Image.Registry,
+		ZipURL:      in.Source.ZipURL,
 		ZipUsername: in.Source.ZipUsername,
 		ZipPassword: in.Source.ZipPassword,
-		GitSecret:  in.Source.GitSecret,
-		PVCName:    in.Source.PVCName,
-		HasGit:     in.Source.Type == "git" && in.Source.GitUsername != "" && in.Source.GitToken != "",
-		HasLocal:   in.Source.Type == "local",
-		HasZip:     in.Source.Type == "zip",
+		GitSecret:   in.Source.GitSecret,
+		PVCName:     in.Source.PVCName,
+		HasGit:      in.Source.Type == "git" && in.Source.GitUsername != "" && in.Source.GitToken != "",
+		HasLocal:    in.Source.Type == "local",
+		HasZip:      in.Source.Type == "zip",
+		BuildParams: buildParams(in.Image),
+		CacheClaim:  cacheClaim(in),
 	}
 
 	tpl := `apiVersion: tekton.dev/v1
@@ -1741,6 +3892,17 @@ spec:
 {{- if eq .SourceType "local" }}
     - name: local-path
       value: {{.LocalPath}}
+{{- end }}
+{{- range .BuildParams }}
+    - name: {{.Name}}
+{{- if .List }}
+      value:
+{{- range .List }}
+        - {{.}}
+{{- end }}
+{{- else }}
+      value: {{.Value}}
+{{- end }}
 {{- end }}
   workspaces:
     - name: source
@@ -1755,6 +3917,11 @@ spec:
       persistentVolumeClaim:
         claimName: {{.PVCName}}
 {{- end }}
+{{- if .CacheClaim }}
+    - name: cache
+      persistentVolumeClaim:
+        claimName: {{.CacheClaim}}
+{{- end }}
 `
 
 	return mustRender(tpl, ctx)
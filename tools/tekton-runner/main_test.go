@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestValidatePorts(t *testing.T) {
+	port := func(name, proto string, container, service int) DeployPort {
+		return DeployPort{Name: name, Protocol: proto, ContainerPort: container, ServicePort: service}
+	}
+	tests := []struct {
+		name    string
+		ports   []DeployPort
+		wantErr bool
+	}{
+		{"single", []DeployPort{port("http", "TCP", 8080, 80)}, false},
+		{"tcp and udp on one service port", []DeployPort{port("dns-tcp", "TCP", 53, 53), port("dns-udp", "UDP", 53, 53)}, false},
+		{"digits and letters", []DeployPort{port("h2c", "TCP", 8080, 80), port("9000-web", "TCP", 9000, 9000)}, false},
+		{"all digits", []DeployPort{port("8080", "TCP", 8080, 80)}, true},
+		{"uppercase", []DeployPort{port("HTTP", "TCP", 8080, 80)}, true},
+		{"leading hyphen", []DeployPort{port("-http", "TCP", 8080, 80)}, true},
+		{"double hyphen", []DeployPort{port("grpc--web", "TCP", 8080, 80)}, true},
+		{"too long", []DeployPort{port("metrics-exporter", "TCP", 9100, 9100)}, true},
+		{"duplicate name", []DeployPort{port("http", "TCP", 8080, 80), port("http", "TCP", 8081, 81)}, true},
+		{"bad protocol", []DeployPort{port("http", "SCTP", 8080, 80)}, true},
+		{"port out of range", []DeployPort{port("http", "TCP", 70000, 80)}, true},
+		{"duplicate service port", []DeployPort{port("http", "TCP", 8080, 80), port("admin", "TCP", 8081, 80)}, true},
+	}
+	for _, tt := range tests {
+		if err := validatePorts(tt.ports); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validatePorts() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	deployTypeManifests = "manifests"
+	deployTypeKustomize = "kustomize"
+)
+
+// ManifestSpec is the source of a manifests or kustomize deploy: a file or
+// directory in the git/zip source, or an inline body (YAML objects, or a
+// kustomization.yaml for kustomize). Containers whose image repository ends
+// in one of Images (default: image.project and the app name) get the
+// deployed image.
+type ManifestSpec struct {
+	Path   string   `json:"path"`
+	Inline string   `json:"inline"`
+	Images []string `json:"images"`
+	// Rendered holds the objects read at deploy time, so a recorded
+	// revision can be re-applied without the source. Requests cannot set
+	// it.
+	Rendered string `json:"rendered,omitempty"`
+}
+
+const manifestAppLabel = "tekton-runner/app"
+
+// clusterScopedKinds cannot be applied to a workspace namespace.
+var clusterScopedKinds = map[string]bool{
+	"Namespace": true, "Node": true, "PersistentVolume": true, "StorageClass": true,
+	"ClusterRole": true, "ClusterRoleBinding": true, "CustomResourceDefinition": true,
+	"MutatingWebhookConfiguration": true, "ValidatingWebhookConfiguration": true,
+	"PriorityClass": true, "IngressClass": true, "APIService": true, "RuntimeClass": true,
+	"CSIDriver": true,
+}
+
+// manifestPruneKinds are the kinds removed when a manifests app is deleted.
+const manifestPruneKinds = "deployment,statefulset,daemonset,replicaset,pod,job,cronjob,service,ingress,configmap,secret,serviceaccount,role,rolebinding,horizontalpodautoscaler,poddisruptionbudget,networkpolicy"
+
+func usesManifests(d Deploy) bool {
+	return d.Type == deployTypeManifests || d.Type == deployTypeKustomize
+}
+
+func validateManifestSpec(in *Input) error {
+	m := in.Deploy.Manifests
+	field := "deploy.manifests"
+	if m == nil || (m.Path == "" && m.Inline == "") {
+		return fmt.Errorf("%s.path or %s.inline is required for deploy.type=%s", field, field, in.Deploy.Type)
+	}
+	// Rendered is filled in by the runner; a request setting it would skip
+	// reading and checking its path or inline objects.
+	if m.Rendered != "" {
+		return fmt.Errorf("%s.rendered is set by the runner", field)
+	}
+	if m.Path != "" && m.Inline != "" {
+		return fmt.Errorf("%s: use either path or inline", field)
+	}
+	if m.Path != "" {
+		if in.Source.Type != "git" && in.Source.Type != "zip" {
+			return fmt.Errorf("%s.path needs a git or zip source", field)
+		}
+		if strings.HasPrefix(path.Clean(m.Path), "..") || path.IsAbs(m.Path) {
+			return fmt.Errorf("%s.path must be inside the source", field)
+		}
+	}
+	if in.Deploy.Strategy != "" && in.Deploy.Strategy != strategyRolling {
+		return fmt.Errorf("deploy.strategy is not supported for %s", in.Deploy.Type)
+	}
+	if len(in.Deploy.SmokeTests) > 0 {
+		return fmt.Errorf("deploy.smoke_tests is not supported for %s", in.Deploy.Type)
+	}
+	if m.Inline != "" && in.Deploy.Type == deployTypeManifests {
+		if _, err := parseManifests(m.Inline); err != nil {
+			return fmt.Errorf("%s.inline: %v", field, err)
+		}
+	}
+	return nil
+}
+
+// resolveDeploy reads what a helm, manifests or kustomize deploy needs from
+// the app source, so the recorded revision can be re-applied without it.
+func resolveDeploy(in Input) (Input, error) {
+	switch in.Deploy.Type {
+	case deployTypeHelm:
+		return resolveHelmChart(in)
+	case deployTypeManifests, deployTypeKustomize:
+		return resolveManifests(in)
+	}
+	return in, nil
+}
+
+func resolveManifests(in Input) (Input, error) {
+	m := *in.Deploy.Manifests
+	if m.Rendered != "" {
+		return in, nil
+	}
+	var out string
+	var err error
+	if m.Path != "" {
+		out, err = manifestsFromSource(in.Source, m.Path, in.Deploy.Type == deployTypeKustomize)
+	} else if in.Deploy.Type == deployTypeKustomize {
+		out, err = kustomizeInline(m.Inline)
+	} else {
+		out = m.Inline
+	}
+	if err != nil {
+		return in, err
+	}
+	m.Rendered = out
+	in.Deploy.Manifests = &m
+	return in, nil
+}
+
+func manifestsFromSource(src Source, p string, kustomize bool) (string, error) {
+	dir, err := fetchSource(src)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(sourceRoot(dir), filepath.FromSlash(path.Clean(p)))
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", fmt.Errorf("deploy.manifests.path %s not found in source", p)
+	}
+	if kustomize {
+		if !info.IsDir() {
+			target = filepath.Dir(target)
+		}
+		return kustomizeBuild(target)
+	}
+	if !info.IsDir() {
+		b, err := os.ReadFile(target)
+		return string(b), err
+	}
+	var files []string
+	err = filepath.WalkDir(target, func(f string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(f)) {
+		case ".yaml", ".yml", ".json":
+			if !d.IsDir() {
+				files = append(files, f)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	var docs []string
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		docs = append(docs, string(b))
+	}
+	if len(docs) == 0 {
+		return "", fmt.Errorf("deploy.manifests.path %s has no YAML files", p)
+	}
+	return strings.Join(docs, "\n---\n"), nil
+}
+
+func kustomizeInline(kustomization string) (string, error) {
+	dir, err := os.MkdirTemp("", "kustomize-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(kustomization), 0o644); err != nil {
+		return "", err
+	}
+	return kustomizeBuild(dir)
+}
+
+func kustomizeBuild(dir string) (string, error) {
+	cmd := exec.Command("kubectl", "kustomize", dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("kustomize build: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// parseManifests decodes a multi-document YAML stream and checks that every
+// object can be applied to a workspace namespace.
+func parseManifests(data string) ([]map[string]any, error) {
+	dec := yaml.NewDecoder(strings.NewReader(data))
+	var objs []map[string]any
+	for {
+		var obj map[string]any
+		err := dec.Decode(&obj)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse manifests: %v", err)
+		}
+		if obj == nil {
+			continue
+		}
+		if obj["kind"] == "List" {
+			items, _ := obj["items"].([]any)
+			for _, it := range items {
+				if o, ok := it.(map[string]any); ok {
+					objs = append(objs, o)
+				}
+			}
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("no objects found")
+	}
+	for i, obj := range objs {
+		kind, _ := obj["kind"].(string)
+		meta, _ := obj["metadata"].(map[string]any)
+		if _, ok := obj["apiVersion"].(string); !ok || kind == "" || meta == nil || meta["name"] == nil {
+			return nil, fmt.Errorf("object %d: apiVersion, kind and metadata.name are required", i+1)
+		}
+		if clusterScopedKinds[kind] {
+			return nil, fmt.Errorf("%s %v: cluster-scoped objects are not allowed in a workspace", kind, meta["name"])
+		}
+	}
+	return objs, nil
+}
+
+// prepareManifests forces the workspace namespace and the app label on every
+// object and points matching containers at image.
+func prepareManifests(objs []map[string]any, ns, app, image string, wants []string) (string, error) {
+	replaced := 0
+	var docs []string
+	for _, obj := range objs {
+		meta := obj["metadata"].(map[string]any)
+		meta["namespace"] = ns
+		setLabel(meta, manifestAppLabel, app)
+		if spec, tmplMeta := podSpecOf(obj); spec != nil {
+			if tmplMeta != nil {
+				setLabel(tmplMeta, manifestAppLabel, app)
+			}
+			for _, key := range []string{"initContainers", "containers"} {
+				cs, _ := spec[key].([]any)
+				for _, c := range cs {
+					cm, ok := c.(map[string]any)
+					if !ok {
+						continue
+					}
+					if img, _ := cm["image"].(string); imageMatches(img, wants) {
+						cm["image"] = image
+						replaced++
+					}
+				}
+			}
+		}
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return "", err
+		}
+		docs = append(docs, string(b))
+	}
+	if replaced == 0 {
+		return "", fmt.Errorf("no container image matches %s; set deploy.manifests.images", strings.Join(wants, ", "))
+	}
+	return strings.Join(docs, "---\n"), nil
+}
+
+// redactManifestSecrets drops the data of the Secret objects in a
+// multi-document YAML stream, so rendered manifests can be kept in the deploy
+// history. restoreManifestSecrets puts it back.
+func redactManifestSecrets(data string) string {
+	objs, err := parseManifests(data)
+	if err != nil {
+		// Rendered manifests were parsed before the deploy; keep nothing
+		// that could not be checked.
+		return ""
+	}
+	var docs []string
+	for _, obj := range objs {
+		if obj["kind"] == "Secret" {
+			delete(obj, "data")
+			delete(obj, "stringData")
+		}
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return ""
+		}
+		docs = append(docs, string(b))
+	}
+	return strings.Join(docs, "---\n")
+}
+
+// restoreManifestSecrets fills the Secret objects of redacted manifests with
+// the data of the Secrets of the same name in the workspace.
+func restoreManifestSecrets(kubeconfig, ns, data string) (string, error) {
+	objs, err := parseManifests(data)
+	if err != nil {
+		return "", err
+	}
+	var docs []string
+	for _, obj := range objs {
+		if obj["kind"] == "Secret" {
+			name := fmt.Sprint(obj["metadata"].(map[string]any)["name"])
+			values, err := workspaceSecretData(kubeconfig, ns, name)
+			if err != nil {
+				return "", fmt.Errorf("secret data is not kept in the history: %v", err)
+			}
+			enc := make(map[string]any, len(values))
+			for k, v := range values {
+				enc[k] = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			obj["data"] = enc
+		}
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return "", err
+		}
+		docs = append(docs, string(b))
+	}
+	return strings.Join(docs, "---\n"), nil
+}
+
+// podSpecOf returns the pod spec of a workload object and the metadata of
+// its pod template, if it has one.
+func podSpecOf(obj map[string]any) (map[string]any, map[string]any) {
+	spec, _ := obj["spec"].(map[string]any)
+	if spec == nil {
+		return nil, nil
+	}
+	switch obj["kind"] {
+	case "Pod":
+		return spec, nil
+	case "CronJob":
+		jt, _ := spec["jobTemplate"].(map[string]any)
+		js, _ := jt["spec"].(map[string]any)
+		spec = js
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+	default:
+		return nil, nil
+	}
+	tmpl, _ := spec["template"].(map[string]any)
+	if tmpl == nil {
+		return nil, nil
+	}
+	ps, _ := tmpl["spec"].(map[string]any)
+	tm, _ := tmpl["metadata"].(map[string]any)
+	if tm == nil {
+		tm = map[string]any{}
+		tmpl["metadata"] = tm
+	}
+	return ps, tm
+}
+
+func setLabel(meta map[string]any, key, value string) {
+	labels, _ := meta["labels"].(map[string]any)
+	if labels == nil {
+		labels = map[string]any{}
+		meta["labels"] = labels
+	}
+	labels[key] = value
+}
+
+// imageMatches reports whether the repository of img is one of wants, or ends
+// in /<want>.
+func imageMatches(img string, wants []string) bool {
+	repo, _ := splitImageRef(img)
+	for _, w := range wants {
+		if w != "" && (repo == w || strings.HasSuffix(repo, "/"+w)) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderAppManifests returns the objects of a manifests or kustomize app as
+// they are applied to the workspace.
+func renderAppManifests(ns, app, image string, in Input) (string, error) {
+	m := in.Deploy.Manifests
+	if m == nil || m.Rendered == "" {
+		return "", fmt.Errorf("deploy.manifests: nothing to apply")
+	}
+	objs, err := parseManifests(m.Rendered)
+	if err != nil {
+		return "", err
+	}
+	wants := m.Images
+	if len(wants) == 0 {
+		wants = []string{strings.ToLower(in.Image.Project), app}
+	}
+	return prepareManifests(objs, ns, app, image, wants)
+}
+
+// podImages returns the container images of the workload objects in a
+// multi-document YAML stream.
+func podImages(data string) ([]string, error) {
+	dec := yaml.NewDecoder(strings.NewReader(data))
+	var images []string
+	for {
+		var obj map[string]any
+		err := dec.Decode(&obj)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse manifests: %v", err)
+		}
+		spec, _ := podSpecOf(obj)
+		if spec == nil {
+			continue
+		}
+		for _, key := range []string{"initContainers", "containers"} {
+			cs, _ := spec[key].([]any)
+			for _, c := range cs {
+				cm, _ := c.(map[string]any)
+				if img, _ := cm["image"].(string); img != "" {
+					images = append(images, img)
+				}
+			}
+		}
+	}
+	return images, nil
+}
+
+// deployManifests applies the objects of a manifests or kustomize app and
+// prunes objects of the app that are no longer part of it.
+func deployManifests(kubeconfig, ns, app, image string, in Input) error {
+	out, err := renderAppManifests(ns, app, image, in)
+	if err != nil {
+		return err
+	}
+	if err := kubectlApplyTo(kubeconfig, mustRender("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: {{.}}\n", ns)); err != nil {
+		return err
+	}
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "apply", "--prune", "-l", manifestAppLabel+"="+app, "-f", "-")
+	cmd.Stdin = strings.NewReader(out)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("apply manifests: %v", err)
+	}
+	return nil
+}
+
+// manifestsApp reports whether an app was last deployed from manifests.
+func manifestsApp(workspace, app string) bool {
+	revs := historyStore.list(workspace, app)
+	return len(revs) > 0 && usesManifests(revs[0].Deploy)
+}
+
+func deleteManifestsApp(kubeconfig, workspace, app string) error {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "delete", manifestPruneKinds, "-l", manifestAppLabel+"="+app, "--ignore-not-found")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("delete %s: %v", app, err)
+	}
+	return nil
+}
+
+// getManifestsAppStatus reports the workloads and pods labelled with the app.
+func getManifestsAppStatus(kubeconfig, workspace, app string) ([]byte, error) {
+	sel := manifestAppLabel + "=" + app
+	podsCmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "get", "pods", "-l", sel, "-o", "jsonpath={range .items[*]}{.metadata.name}|{.status.phase}|{.status.containerStatuses[0].ready}|{.status.containerStatuses[0].restartCount}{\"\\n\"}{end}")
+	podsOut, err := podsCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("get app pods failed: %v", err)
+	}
+	wlCmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "get", "deployment,statefulset", "-l", sel, "-o", "jsonpath={range .items[*]}{.kind}|{.metadata.name}|{.spec.replicas}|{.status.readyReplicas}{\"\\n\"}{end}")
+	wlOut, err := wlCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("get app workloads failed: %v", err)
+	}
+
+	pods := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(string(podsOut)), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) != 4 {
+			continue
+		}
+		var restarts int
+		fmt.Sscanf(parts[3], "%d", &restarts)
+		pods = append(pods, map[string]any{
+			"name":     parts[0],
+			"phase":    parts[1],
+			"ready":    parts[2] == "true",
+			"restarts": restarts,
+		})
+	}
+	ready := true
+	workloads := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(string(wlOut)), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) != 4 {
+			continue
+		}
+		var desired, readyReplicas int
+		fmt.Sscanf(parts[2], "%d", &desired)
+		fmt.Sscanf(parts[3], "%d", &readyReplicas)
+		if readyReplicas < desired {
+			ready = false
+		}
+		workloads = append(workloads, map[string]any{
+			"kind":    parts[0],
+			"name":    parts[1],
+			"desired": desired,
+			"ready":   readyReplicas,
+		})
+	}
+	return json.Marshal(map[string]any{
+		"workspace": workspace,
+		"app":       app,
+		"ready":     ready && len(workloads) > 0,
+		"workloads": workloads,
+		"pods":      pods,
+	})
+}
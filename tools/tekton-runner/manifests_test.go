@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseManifests(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    int
+		wantErr bool
+	}{
+		{"single", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\n", 1, false},
+		{"multi document", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: b\n", 2, false},
+		{"list", "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: a\n- apiVersion: v1\n  kind: Secret\n  metadata:\n    name: b\n", 2, false},
+		{"empty", "", 0, true},
+		{"comments only", "# nothing\n---\n", 0, true},
+		{"invalid yaml", "kind: [", 0, true},
+		{"missing name", "apiVersion: v1\nkind: ConfigMap\nmetadata: {}\n", 0, true},
+		{"missing kind", "apiVersion: v1\nmetadata:\n  name: a\n", 0, true},
+		{"cluster-scoped", "apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: admin\n", 0, true},
+	}
+	for _, tt := range tests {
+		objs, err := parseManifests(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseManifests() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(objs) != tt.want {
+			t.Errorf("%s: parseManifests() returned %d objects, want %d", tt.name, len(objs), tt.want)
+		}
+	}
+}
+
+const testDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: other
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: migrate
+        image: lenovo:8443/team/web:old
+      containers:
+      - name: web
+        image: lenovo:8443/team/web:old
+      - name: proxy
+        image: envoyproxy/envoy:v1.31
+`
+
+func TestPrepareManifests(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wants   []string
+		images  []string
+		wantErr bool
+	}{
+		{"repository suffix", testDeployment, []string{"web"}, []string{"new", "new", "envoyproxy/envoy:v1.31"}, false},
+		{"full repository", testDeployment, []string{"lenovo:8443/team/web"}, []string{"new", "new", "envoyproxy/envoy:v1.31"}, false},
+		{"several images", testDeployment, []string{"web", "envoy"}, []string{"new", "new", "new"}, false},
+		{"partial name", testDeployment, []string{"eb"}, nil, true},
+		{"no workload", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n", []string{"web"}, nil, true},
+	}
+	for _, tt := range tests {
+		objs, err := parseManifests(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		out, err := prepareManifests(objs, "ws-team", "web", "new", tt.wants)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: prepareManifests() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		images, err := podImages(out)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if strings.Join(images, ",") != strings.Join(tt.images, ",") {
+			t.Errorf("%s: images = %v, want %v", tt.name, images, tt.images)
+		}
+		objs, err = parseManifests(out)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		meta := objs[0]["metadata"].(map[string]any)
+		if meta["namespace"] != "ws-team" || meta["labels"].(map[string]any)[manifestAppLabel] != "web" {
+			t.Errorf("%s: metadata = %v", tt.name, meta)
+		}
+		tmpl := objs[0]["spec"].(map[string]any)["template"].(map[string]any)["metadata"].(map[string]any)
+		if tmpl["labels"].(map[string]any)[manifestAppLabel] != "web" {
+			t.Errorf("%s: pod template metadata = %v", tt.name, tmpl)
+		}
+	}
+}
+
+func TestRedactManifestSecrets(t *testing.T) {
+	data := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\ndata:\n  password: cw==\nstringData:\n  user: admin\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cfg\ndata:\n  level: debug\n"
+	objs, err := parseManifests(redactManifestSecrets(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("got %d objects, want 2", len(objs))
+	}
+	if _, ok := objs[0]["data"]; ok {
+		t.Errorf("secret data kept: %v", objs[0])
+	}
+	if _, ok := objs[0]["stringData"]; ok {
+		t.Errorf("secret stringData kept: %v", objs[0])
+	}
+	if objs[1]["data"].(map[string]any)["level"] != "debug" {
+		t.Errorf("configmap data changed: %v", objs[1])
+	}
+	if got := redactManifestSecrets("kind: ["); got != "" {
+		t.Errorf("unparsable manifests kept: %q", got)
+	}
+}
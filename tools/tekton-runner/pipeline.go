@@ -0,0 +1,668 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Pipeline builds the app with a Tekton PipelineRun instead of a single
+// TaskRun. The source is fetched first, then the stages run in order on a
+// shared workspace.
+type Pipeline struct {
+	Stages        []Stage `json:"stages"`
+	WorkspaceSize string  `json:"workspace_size"`
+}
+
+// Stage is one step of a pipeline. test and lint run Command in Image; build,
+// scan, sbom, push and sign run the pipeline Tasks and take their settings
+// from the request's image, scan policy and sbom options. test stages collect
+// the JUnit reports written to $JUNIT_DIR and to the Reports glob.
+type Stage struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Image   string            `json:"image"`
+	Command []string          `json:"command"`
+	Workdir string            `json:"workdir"`
+	Env     map[string]string `json:"env"`
+	Reports string            `json:"reports"`
+	// Severity is the severity list of scan stages that fail the scan
+	// (e.g. HIGH,CRITICAL). Deprecated: it sets scan.max_severity to the
+	// severity below its lowest entry when the request has none.
+	Severity string `json:"severity"`
+}
+
+// StageStatus is the state of a pipeline stage in the run record.
+type StageStatus struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	TaskRun string `json:"task_run,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	stageSource = "source"
+	stageTest   = "test"
+	stageLint   = "lint"
+	stageBuild  = "build"
+	stageScan   = "scan"
+	stageSBOM   = "sbom"
+	stageSign   = "sign"
+	stagePush   = "push"
+
+	stagePending   = "pending"
+	stageRunning   = "running"
+	stageSucceeded = "succeeded"
+	stageFailed    = "failed"
+	stageSkipped   = "skipped"
+
+	defaultPipelineWorkspace = "1Gi"
+)
+
+// stageNameRe matches a DNS label; stage names become Tekton task names.
+var stageNameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// pipelineTasks are the Tasks the stages run. test and lint stages are
+// rendered inline.
+var pipelineTasks = map[string]string{
+	stageSource: "source-fetch",
+	stageBuild:  "image-build",
+	stageScan:   "image-scan",
+	stageSBOM:   "image-sbom",
+	stageSign:   "image-sign",
+	stagePush:   "image-push",
+}
+
+func setPipelineDefaults(p *Pipeline) {
+	if p == nil {
+		return
+	}
+	if p.WorkspaceSize == "" {
+		p.WorkspaceSize = defaultPipelineWorkspace
+	}
+	used := map[string]int{}
+	for i := range p.Stages {
+		s := &p.Stages[i]
+		if s.Name != "" {
+			continue
+		}
+		used[s.Type]++
+		s.Name = s.Type
+		if n := used[s.Type]; n > 1 {
+			s.Name = fmt.Sprintf("%s-%d", s.Type, n)
+		}
+	}
+}
+
+func validatePipeline(in *Input) error {
+	p := in.Pipeline
+	if p == nil {
+		return nil
+	}
+	if in.Source.Type == "image" {
+		return fmt.Errorf("pipeline needs a git, local or zip source")
+	}
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("pipeline.stages is required")
+	}
+	if !quantityRe.MatchString(p.WorkspaceSize) {
+		return fmt.Errorf("pipeline.workspace_size: invalid size %q", p.WorkspaceSize)
+	}
+	names := map[string]bool{stageSource: true}
+	var build, push bool
+	for i, s := range p.Stages {
+		field := fmt.Sprintf("pipeline.stages[%d]", i)
+		if !stageNameRe.MatchString(s.Name) || len(s.Name) > 63 {
+			return fmt.Errorf("%s.name must be a lowercase DNS label", field)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("%s: stage name %s is used twice", field, s.Name)
+		}
+		names[s.Name] = true
+		switch s.Type {
+		case stageTest, stageLint:
+			if s.Image == "" || len(s.Command) == 0 {
+				return fmt.Errorf("%s: %s stages need image and command", field, s.Type)
+			}
+			if s.Workdir != "" && (!buildPathRe.MatchString(s.Workdir) || path.IsAbs(s.Workdir) || strings.HasPrefix(path.Clean(s.Workdir), "..")) {
+				return fmt.Errorf("%s.workdir must be a relative path inside the source of letters, digits, '.', '_', '-' and '/'", field)
+			}
+			for k := range s.Env {
+				if !envNameRe.MatchString(k) {
+					return fmt.Errorf("%s.env: invalid name %q", field, k)
+				}
+			}
+			if err := validateReportGlob(s.Reports); err != nil {
+				return fmt.Errorf("%s.%v", field, err)
+			}
+		case stageBuild:
+			if build {
+				return fmt.Errorf("%s: pipeline has more than one build stage", field)
+			}
+			build = true
+		case stageScan:
+			if !build || push {
+				return fmt.Errorf("%s: scan must come after build and before push", field)
+			}
+			if s.Severity != "" {
+				if _, ok := severityThreshold(s.Severity); !ok {
+					return fmt.Errorf("%s.severity: must be a list of UNKNOWN, LOW, MEDIUM, HIGH or CRITICAL", field)
+				}
+			}
+		case stageSBOM:
+			if !build {
+				return fmt.Errorf("%s: sbom must come after build", field)
+			}
+		case stageSign:
+			if !push {
+				return fmt.Errorf("%s: sign must come after push", field)
+			}
+		case stagePush:
+			if !build {
+				return fmt.Errorf("%s: push must come after build", field)
+			}
+			if push {
+				return fmt.Errorf("%s: pipeline has more than one push stage", field)
+			}
+			push = true
+		default:
+			return fmt.Errorf("%s.type must be test, lint, build, scan, sbom, push or sign", field)
+		}
+		if s.Type != stageTest && s.Type != stageLint && (len(s.Command) > 0 || s.Workdir != "" || len(s.Env) > 0) {
+			return fmt.Errorf("%s: command, workdir and env are only used by test and lint stages", field)
+		}
+		if s.Type != stageTest && s.Reports != "" {
+			return fmt.Errorf("%s: reports is only used by test stages", field)
+		}
+		if s.Type != stageScan && s.Severity != "" {
+			return fmt.Errorf("%s: severity is only used by scan stages", field)
+		}
+		if (s.Type == stageBuild || s.Type == stagePush) && s.Image != "" {
+			return fmt.Errorf("%s: the image of %s stages is set by the request's image", field, s.Type)
+		}
+	}
+	if !build {
+		return fmt.Errorf("pipeline needs a build stage")
+	}
+	if in.AppName != "" && !push {
+		return fmt.Errorf("pipeline needs a push stage to deploy app_name")
+	}
+	return nil
+}
+
+// buildTask returns the Task that builds the image of a request.
+func buildTask(in Input) string {
+	if in.Pipeline != nil {
+		return pipelineTasks[stageBuild]
+	}
+	return in.Task
+}
+
+// pipelineStages returns the initial stage list of a pipeline run.
+func pipelineStages(in Input) []StageStatus {
+	if in.Pipeline == nil {
+		return nil
+	}
+	stages := []StageStatus{{Name: stageSource, Type: stageSource, Status: stagePending}}
+	for _, s := range in.Pipeline.Stages {
+		stages = append(stages, StageStatus{Name: s.Name, Type: s.Type, Status: stagePending})
+	}
+	return stages
+}
+
+type pipelineTask struct {
+	Name      string
+	Task      string
+	After     string
+	Fetch     bool
+	Params    []buildParam
+	Image     string
+	Command   []string
+	Workdir   string
+	Env       []kv
+	Report    string
+	ReportDir string
+	Cache     bool
+}
+
+func renderPipelineRun(in Input) string {
+	src := in.Source
+	fetch := pipelineTask{Name: stageSource, Task: pipelineTasks[stageSource], Fetch: true}
+	fetch.Params = append(fetch.Params, buildParam{Name: "source-type", Value: yamlQuote(src.Type)})
+	switch src.Type {
+	case "git":
+		fetch.Params = append(fetch.Params,
+			buildParam{Name: "repo-url", Value: yamlQuote(src.RepoURL)},
+			buildParam{Name: "revision", Value: yamlQuote(src.Revision)})
+	case "zip":
+		fetch.Params = append(fetch.Params, buildParam{Name: "zip-url", Value: yamlQuote(src.ZipURL)})
+		if src.ZipUsername != "" {
+			fetch.Params = append(fetch.Params, buildParam{Name: "zip-username", Value: yamlQuote(src.ZipUsername)})
+		}
+		if src.ZipPassword != "" {
+			fetch.Params = append(fetch.Params, buildParam{Name: "zip-password", Value: yamlQuote(src.ZipPassword)})
+		}
+	case "local":
+		fetch.Params = append(fetch.Params, buildParam{Name: "local-path", Value: yamlQuote(src.LocalPath)})
+	}
+	fetch.Params = append(fetch.Params, buildModeParam(in.Image)...)
+	imageParams := []buildParam{
+		{Name: "project", Value: yamlQuote(in.Image.Project)},
+		{Name: "registry", Value: yamlQuote(in.Image.Registry)},
+		{Name: "tag", Value: yamlQuote(in.Image.Tag)},
+	}
+
+	claim := cacheClaim(in)
+	tasks := []pipelineTask{fetch}
+	push, build := "", ""
+	for _, s := range in.Pipeline.Stages {
+		t := pipelineTask{Name: s.Name, Task: pipelineTasks[s.Type], After: tasks[len(tasks)-1].Name}
+		switch s.Type {
+		case stageTest, stageLint:
+			t.Image = yamlQuote(s.Image)
+			for _, c := range s.Command {
+				t.Command = append(t.Command, yamlQuote(c))
+			}
+			t.Workdir = yamlQuote(path.Join("/workspace/source", path.Clean(s.Workdir)))
+			t.Env = sortedKV(s.Env)
+			if claim != "" {
+				t.Cache = true
+				t.Env = sortedKV(withCacheEnv(s.Env))
+			}
+			if s.Type == stageTest {
+				t.ReportDir = path.Join("/workspace/source", junitDir, s.Name)
+				t.Env = append([]kv{{Key: "JUNIT_DIR", Value: yamlQuote(t.ReportDir)}}, t.Env...)
+				t.Report = strings.TrimRight(indentLines(renderReportScript(s.Name, s.Reports), 16), "\n")
+			}
+		case stageBuild:
+			t.Params = append(append(t.Params, imageParams...), buildParams(in.Image)...)
+			t.Cache = claim != ""
+			build = s.Name
+		case stageScan:
+			scanner := s.Image
+			if scanner == "" {
+				scanner = scannerImage()
+			}
+			t.Params = append(t.Params, scanParams(*in.Scan, scanner)...)
+		case stageSBOM:
+			generator := s.Image
+			if generator == "" {
+				generator = scannerImage()
+			}
+			t.Params = append(t.Params, sbomParams(*in.SBOM, generator)...)
+		case stageSign:
+			signer := s.Image
+			if signer == "" {
+				signer = signerImage()
+			}
+			image := fmt.Sprintf("$(tasks.%s.results.IMAGE_URL)@$(tasks.%s.results.IMAGE_DIGEST)", push, push)
+			t.Params = append(t.Params, signParams(image, signer)...)
+		case stagePush:
+			t.Params = append(t.Params, imageParams...)
+			push = s.Name
+		}
+		tasks = append(tasks, t)
+	}
+
+	tpl := `apiVersion: tekton.dev/v1
+kind: PipelineRun
+metadata:
+  generateName: {{.Project}}-pipeline-
+  namespace: {{.Namespace}}
+spec:
+  taskRunTemplate:
+    serviceAccountName: build-bot
+  pipelineSpec:
+    workspaces:
+      - name: source
+{{- if .HasGit }}
+      - name: git-credentials
+{{- end }}
+{{- if .HasLocal }}
+      - name: local-source
+{{- end }}
+{{- if .CacheClaim }}
+      - name: cache
+{{- end }}
+{{- if or .Push .Detect }}
+    results:
+{{- end }}
+{{- if .Push }}
+      - name: IMAGE_DIGEST
+        value: $(tasks.{{.Push}}.results.IMAGE_DIGEST)
+      - name: IMAGE_URL
+        value: $(tasks.{{.Push}}.results.IMAGE_URL)
+{{- end }}
+{{- if .Detect }}
+      - name: DETECTED_LANGUAGE
+        value: $(tasks.{{.Detect}}.results.DETECTED_LANGUAGE)
+      - name: DETECTED_PORT
+        value: $(tasks.{{.Detect}}.results.DETECTED_PORT)
+{{- end }}
+    tasks:
+{{- range .Tasks }}
+      - name: {{.Name}}
+{{- if .After }}
+        runAfter:
+          - {{.After}}
+{{- end }}
+{{- if .Task }}
+        taskRef:
+          name: {{.Task}}
+{{- else }}
+        taskSpec:
+          workspaces:
+            - name: source
+{{- if .Cache }}
+            - name: cache
+              mountPath: /workspace/cache
+{{- end }}
+          steps:
+{{- if .Report }}
+            - name: prepare
+              image: {{$.ReportImage}}
+              script: |
+                mkdir -p {{.ReportDir}}
+{{- end }}
+            - name: run
+              image: {{.Image}}
+              workingDir: {{.Workdir}}
+{{- if .Report }}
+              onError: continue
+{{- end }}
+              command:
+{{- range .Command }}
+                - {{.}}
+{{- end }}
+{{- if .Env }}
+              env:
+{{- range .Env }}
+                - name: {{.Key}}
+                  value: {{.Value}}
+{{- end }}
+{{- end }}
+{{- if .Report }}
+            - name: report
+              image: {{$.ReportImage}}
+              workingDir: /workspace/source
+              script: |
+{{.Report}}
+{{- end }}
+{{- end }}
+{{- if .Params }}
+        params:
+{{- range .Params }}
+          - name: {{.Name}}
+{{- if .List }}
+            value:
+{{- range .List }}
+              - {{.}}
+{{- end }}
+{{- else }}
+            value: {{.Value}}
+{{- end }}
+{{- end }}
+{{- end }}
+        workspaces:
+          - name: source
+            workspace: source
+{{- if and .Fetch $.HasGit }}
+          - name: git-credentials
+            workspace: git-credentials
+{{- end }}
+{{- if and .Fetch $.HasLocal }}
+          - name: local-source
+            workspace: local-source
+{{- end }}
+{{- if .Cache }}
+          - name: cache
+            workspace: cache
+{{- end }}
+{{- end }}
+  workspaces:
+    - name: source
+      volumeClaimTemplate:
+        spec:
+          accessModes:
+            - ReadWriteOnce
+          resources:
+            requests:
+              storage: {{.WorkspaceSize}}
+{{- if .HasGit }}
+    - name: git-credentials
+      secret:
+        secretName: {{.GitSecret}}
+{{- end }}
+{{- if .HasLocal }}
+    - name: local-source
+      persistentVolumeClaim:
+        claimName: {{.PVCName}}
+{{- end }}
+{{- if .CacheClaim }}
+    - name: cache
+      persistentVolumeClaim:
+        claimName: {{.CacheClaim}}
+{{- end }}
+`
+	return mustRender(tpl, map[string]any{
+		"Project":       strings.ToLower(in.Image.Project),
+		"Namespace":     in.Namespace,
+		"HasGit":        src.Type == "git" && src.GitUsername != "" && src.GitToken != "",
+		"HasLocal":      src.Type == "local",
+		"GitSecret":     src.GitSecret,
+		"PVCName":       src.PVCName,
+		"CacheClaim":    claim,
+		"Push":          push,
+		"Detect":        detectTask(in, build),
+		"ReportImage":   reportStepImage(),
+		"Tasks":         tasks,
+		"WorkspaceSize": in.Pipeline.WorkspaceSize,
+	})
+}
+
+// detectTask is the build stage whose detection results an auto build reads.
+func detectTask(in Input, build string) string {
+	if in.Image.BuildMode != buildModeAuto {
+		return ""
+	}
+	return build
+}
+
+func isBuildRun(m string) bool {
+	return isTaskRun(m) || strings.Contains(m, "\nkind: PipelineRun\n") || strings.HasPrefix(m, "kind: PipelineRun\n")
+}
+
+// setBuildRun records the TaskRun or PipelineRun that builds a run.
+func setBuildRun(r *Run, in Input, name string) {
+	if in.Pipeline != nil {
+		r.PipelineRun = name
+		return
+	}
+	r.TaskRun = name
+}
+
+// buildRunName returns the TaskRun or PipelineRun of a run.
+func buildRunName(r Run) string {
+	if r.PipelineRun != "" {
+		return r.PipelineRun
+	}
+	return r.TaskRun
+}
+
+// waitForBuild waits for the TaskRun or PipelineRun that builds a request.
+func waitForBuild(in Input, name, runID string) error {
+	if in.Pipeline == nil {
+		return waitForTaskRun(in.Namespace, name, 45*time.Minute)
+	}
+	err := waitForPipelineRun(in.Namespace, name, runID, 45*time.Minute)
+	// Failed tests fail the run even if the test command exited with 0.
+	if terr := collectTestReports(in, name, runID); terr != nil {
+		if err == nil {
+			return terr
+		}
+		err = fmt.Errorf("%v (%v)", err, terr)
+	}
+	if serr := collectPipelineScan(in, name, runID); serr != nil {
+		if err == nil {
+			return serr
+		}
+		err = fmt.Errorf("%v (%v)", err, serr)
+	}
+	if err == nil {
+		err = collectPipelineSBOM(in, name, runID)
+	}
+	return err
+}
+
+// finishBuild waits for the build of a request, records its duration and
+// detection result and returns the image to deploy. Without a pipeline the
+// pushed image is scanned, its SBOM is generated and it is signed here if the
+// request asks for them. The cache of the build, acquired when it was
+// submitted, is released when it returns.
+func finishBuild(in *Input, name, runID string) (string, error) {
+	defer releaseCache(*in)
+	if err := waitForBuild(*in, name, runID); err != nil {
+		return "", err
+	}
+	recordBuild(*in, name, runID)
+	image := pinBuiltImage(in, name, runID)
+	applyDetection(in, name, runID)
+	if in.Scan != nil && in.Pipeline == nil {
+		if err := scanImage(*in, image, runID); err != nil {
+			return "", err
+		}
+	}
+	if in.SBOM != nil && in.Pipeline == nil {
+		if err := generateSBOM(*in, image, runID); err != nil {
+			return "", err
+		}
+	}
+	switch {
+	case in.Image.Sign && in.Pipeline != nil:
+		markSigned(runID)
+	case in.Image.Sign:
+		if err := signImage(*in, image, runID); err != nil {
+			return "", err
+		}
+	}
+	return image, nil
+}
+
+// waitForPipelineRun waits for a PipelineRun and keeps the stage list of the
+// run up to date while it runs.
+func waitForPipelineRun(ns, name, runID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		status, message, err := pipelineRunStatus(ns, name)
+		if err != nil {
+			log.Printf("run %s: %v", runID, err)
+		}
+		stages := pipelineStageStatus(ns, name, status != "" && status != "Unknown")
+		if stages != nil {
+			if err := runStore.update(runID, func(r *Run) { mergeStages(r.Stages, stages) }); err != nil && err != errRunNotFound {
+				logRunError(runID, err)
+			}
+		}
+		if status == "True" {
+			return nil
+		}
+		if status == "False" {
+			for _, s := range stages {
+				if s.Status == stageFailed {
+					return fmt.Errorf("pipelinerun failed at stage %s: %s", s.Name, s.Message)
+				}
+			}
+			return fmt.Errorf("pipelinerun failed: %s", message)
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("pipelinerun timeout: %s", name)
+}
+
+func pipelineRunStatus(ns, name string) (string, string, error) {
+	out, err := kubectlCmd("-n", ns, "get", "pipelinerun", name, "-o", "json").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("get pipelinerun %s: %v", name, err)
+	}
+	var pr struct {
+		Status struct {
+			Conditions []struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &pr); err != nil {
+		return "", "", fmt.Errorf("parse pipelinerun %s: %v", name, err)
+	}
+	if len(pr.Status.Conditions) == 0 {
+		return "", "", nil
+	}
+	return pr.Status.Conditions[0].Status, pr.Status.Conditions[0].Message, nil
+}
+
+// pipelineStageStatus reads the TaskRuns of a PipelineRun by stage name.
+// Stages without a TaskRun are skipped once the PipelineRun is done.
+func pipelineStageStatus(ns, name string, done bool) map[string]StageStatus {
+	out, err := kubectlCmd("-n", ns, "get", "taskrun", "-l", "tekton.dev/pipelineRun="+name, "-o", "json").Output()
+	if err != nil {
+		return nil
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Status struct {
+				Conditions []struct {
+					Status  string `json:"status"`
+					Message string `json:"message"`
+				} `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil
+	}
+	stages := map[string]StageStatus{}
+	for _, tr := range list.Items {
+		s := StageStatus{TaskRun: tr.Metadata.Name, Status: stageRunning}
+		if len(tr.Status.Conditions) > 0 {
+			switch c := tr.Status.Conditions[0]; c.Status {
+			case "True":
+				s.Status = stageSucceeded
+			case "False":
+				s.Status = stageFailed
+				s.Message = c.Message
+			}
+		}
+		stages[tr.Metadata.Labels["tekton.dev/pipelineTask"]] = s
+	}
+	if done {
+		stages[""] = StageStatus{Status: stageSkipped}
+	}
+	return stages
+}
+
+// mergeStages copies the TaskRun states into the stage list of a run. The
+// entry with an empty name is the state of stages that have no TaskRun.
+func mergeStages(list []StageStatus, stages map[string]StageStatus) {
+	for i := range list {
+		s, ok := stages[list[i].Name]
+		if !ok {
+			s, ok = stages[""]
+			if !ok || list[i].Status != stagePending {
+				continue
+			}
+		}
+		list[i].TaskRun = s.TaskRun
+		list[i].Status = s.Status
+		list[i].Message = s.Message
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestValidatePipelineStages(t *testing.T) {
+	test := func(name, workdir string) Stage {
+		return Stage{Name: name, Type: stageTest, Image: "golang:1.23", Command: []string{"go", "test", "./..."}, Workdir: workdir}
+	}
+	tests := []struct {
+		name    string
+		stage   Stage
+		wantErr bool
+	}{
+		{"plain", test("unit", ""), false},
+		{"digits only", test("2024", ""), false},
+		{"workdir", test("unit", "services/api"), false},
+		{"uppercase name", test("Unit", ""), true},
+		{"name with dot", test("unit.fast", ""), true},
+		{"source name", test("source", ""), true},
+		{"absolute workdir", test("unit", "/etc"), true},
+		{"parent workdir", test("unit", "../other"), true},
+		{"workdir with space", test("unit", "my dir"), true},
+		{"workdir injection", test("unit", "x\n              securityContext: {privileged: true}"), true},
+	}
+	for _, tt := range tests {
+		in := Input{
+			Source:   Source{Type: "git"},
+			Pipeline: &Pipeline{Stages: []Stage{tt.stage, {Type: stageBuild}}},
+		}
+		setPipelineDefaults(in.Pipeline)
+		if err := validatePipeline(&in); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validatePipeline() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
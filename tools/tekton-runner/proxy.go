@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+type proxyBackend struct {
+	Addr   string
+	Weight int
+}
+
+// weightedProxy is a TCP forwarder that spreads connections over backends by
+// weight. It replaces socat for external ports of apps with a canary.
+type weightedProxy struct {
+	ln       net.Listener
+	backends []proxyBackend
+}
+
+func startWeightedProxy(port int, backends []proxyBackend) (*weightedProxy, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("proxy listen: %v", err)
+	}
+	p := &weightedProxy{ln: ln, backends: backends}
+	go p.serve()
+	return p, nil
+}
+
+func (p *weightedProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *weightedProxy) pick() string {
+	total := 0
+	for _, b := range p.backends {
+		total += b.Weight
+	}
+	if total <= 0 {
+		return p.backends[0].Addr
+	}
+	n := rand.Intn(total)
+	for _, b := range p.backends {
+		if n < b.Weight {
+			return b.Addr
+		}
+		n -= b.Weight
+	}
+	return p.backends[0].Addr
+}
+
+func (p *weightedProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	addr := p.pick()
+	up, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		log.Printf("proxy dial %s: %v", addr, err)
+		return
+	}
+	defer up.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(up, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, up)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *weightedProxy) Close() error {
+	return p.ln.Close()
+}
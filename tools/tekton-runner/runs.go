@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Run is the record of one /run request (or rollback) from submission to
+// deploy. The apps of a workspace request get their own runs with Parent set
+// to the workspace run.
+type Run struct {
+	ID        string    `json:"id"`
+	Parent    string    `json:"parent,omitempty"`
+	Source    string    `json:"source"`
+	Workspace string    `json:"workspace,omitempty"`
+	App       string    `json:"app,omitempty"`
+	TaskRun   string    `json:"task_run,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+
+	SmokeResults []SmokeResult `json:"smoke_results,omitempty"`
+
+	// Platforms lists the images of a multi-platform build.
+	Platforms []PlatformImage `json:"platforms,omitempty"`
+
+	// PipelineRun and Stages are set for requests with a pipeline.
+	PipelineRun string        `json:"pipeline_run,omitempty"`
+	Stages      []StageStatus `json:"stages,omitempty"`
+	Tests       []TestReport  `json:"tests,omitempty"`
+
+	Scan *ScanSummary `json:"scan,omitempty"`
+	SBOM *SBOMInfo    `json:"sbom,omitempty"`
+
+	Signature *SignatureStatus `json:"signature,omitempty"`
+
+	// BuildSeconds is how long the build ran, with the cache type it used.
+	BuildSeconds int    `json:"build_seconds,omitempty"`
+	Cache        string `json:"cache,omitempty"`
+
+	Detection *BuildDetection `json:"detection,omitempty"`
+}
+
+const (
+	runSubmitted = "submitted"
+	runBuilding  = "building"
+	runScanning  = "scanning"
+	runDeploying = "deploying"
+	runVerifying = "verifying"
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+)
+
+const maxRuns = 1000
+
+type RunStore struct {
+	mu   sync.Mutex
+	path string
+	runs []Run
+}
+
+var runStore = &RunStore{path: "/home/beko/runs.json"}
+
+var errRunNotFound = fmt.Errorf("run not found")
+
+func newRunID() string {
+	return "run-" + time.Now().UTC().Format("20060102-150405") + "-" + randSuffix()
+}
+
+func (s *RunStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.runs = []Run{}
+			return nil
+		}
+		return err
+	}
+	if len(data) == 0 {
+		s.runs = []Run{}
+		return nil
+	}
+	var runs []Run
+	if err := json.Unmarshal(data, &runs); err != nil {
+		return err
+	}
+	s.runs = runs
+	return nil
+}
+
+// list returns runs newest first, optionally filtered by workspace and app.
+func (s *RunStore) list(workspace, app string) []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Run, 0, len(s.runs))
+	for _, r := range s.runs {
+		if (workspace == "" || r.Workspace == workspace) && (app == "" || r.App == app) {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+func (s *RunStore) get(id string) (Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.runs {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return Run{}, errRunNotFound
+}
+
+// children returns the runs started by a workspace run, oldest first.
+func (s *RunStore) children(parent string) []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Run{}
+	for _, r := range s.runs {
+		if r.Parent == parent {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (s *RunStore) create(r Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	r.Created = now
+	r.Updated = now
+	if r.Status == "" {
+		r.Status = runSubmitted
+	}
+	s.runs = append(s.runs, r)
+	if len(s.runs) > maxRuns {
+		removeSBOMs(s.runs[:len(s.runs)-maxRuns])
+		s.runs = s.runs[len(s.runs)-maxRuns:]
+	}
+	return s.save()
+}
+
+// update applies fn to the run with the given id. Updates for an empty id are
+// ignored so CLI deploys, which have no run, can share the code path.
+func (s *RunStore) update(id string, fn func(*Run)) error {
+	if id == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.runs {
+		if s.runs[i].ID == id {
+			fn(&s.runs[i])
+			s.runs[i].Updated = time.Now().UTC()
+			return s.save()
+		}
+	}
+	return errRunNotFound
+}
+
+func (s *RunStore) setStatus(id, status string) {
+	if err := s.update(id, func(r *Run) { r.Status = status }); err != nil {
+		logRunError(id, err)
+	}
+}
+
+// finish marks a run succeeded, or failed with err.
+func (s *RunStore) finish(id string, err error) {
+	uerr := s.update(id, func(r *Run) {
+		if err != nil {
+			r.Status = runFailed
+			r.Error = err.Error()
+			return
+		}
+		r.Status = runSucceeded
+	})
+	if uerr != nil {
+		logRunError(id, uerr)
+	}
+}
+
+func (s *RunStore) save() error {
+	b, err := json.MarshalIndent(s.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func logRunError(id string, err error) {
+	log.Printf("run %s: %v", id, err)
+}
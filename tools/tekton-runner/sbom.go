@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOMOptions asks for an SBOM of the built image. Format is spdx (SPDX JSON)
+// or cyclonedx (CycloneDX JSON).
+type SBOMOptions struct {
+	Format string `json:"format"`
+}
+
+// SBOMInfo describes the SBOM archived for a run. The document itself is
+// kept in sbomDir and served by GET /runs/{id}/sbom.
+type SBOMInfo struct {
+	Format    string `json:"format"`
+	Image     string `json:"image"`
+	Generator string `json:"generator"`
+	Packages  int    `json:"packages"`
+	Size      int    `json:"size"`
+}
+
+// SBOMPackage is a package of an SBOM as compared by the diff endpoint.
+type SBOMPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+type SBOMChange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	PURL string `json:"purl,omitempty"`
+}
+
+const (
+	sbomDir       = "/home/beko/sboms"
+	sbomTask      = "image-sbom"
+	sbomBegin     = "--- sbom"
+	sbomSPDX      = "spdx"
+	sbomCycloneDX = "cyclonedx"
+)
+
+// sbomFormats maps the request formats to the Trivy output formats.
+var sbomFormats = map[string]string{sbomSPDX: "spdx-json", sbomCycloneDX: "cyclonedx"}
+
+// setSBOMDefaults turns on SBOMs for pipelines with an sbom stage.
+func setSBOMDefaults(in *Input) {
+	if in.SBOM == nil && in.Pipeline != nil {
+		for _, s := range in.Pipeline.Stages {
+			if s.Type == stageSBOM {
+				in.SBOM = &SBOMOptions{}
+			}
+		}
+	}
+	if in.SBOM == nil {
+		return
+	}
+	in.SBOM.Format = strings.ToLower(in.SBOM.Format)
+	if in.SBOM.Format == "" {
+		in.SBOM.Format = sbomSPDX
+	}
+}
+
+func validateSBOM(in *Input) error {
+	if in.SBOM == nil {
+		return nil
+	}
+	if _, ok := sbomFormats[in.SBOM.Format]; !ok {
+		return fmt.Errorf("sbom.format must be spdx or cyclonedx")
+	}
+	if in.Source.Type == "image" {
+		return fmt.Errorf("sbom is only generated for images the runner builds")
+	}
+	if in.Pipeline != nil {
+		for _, s := range in.Pipeline.Stages {
+			if s.Type == stageSBOM {
+				return nil
+			}
+		}
+		return fmt.Errorf("sbom needs an sbom stage in pipeline.stages")
+	}
+	return nil
+}
+
+// sbomParams are the params of the SBOM Task.
+func sbomParams(o SBOMOptions, generator string) []buildParam {
+	return []buildParam{
+		{Name: "generator-image", Value: yamlQuote(generator)},
+		{Name: "format", Value: yamlQuote(sbomFormats[o.Format])},
+	}
+}
+
+func renderSBOMTaskRun(in Input, image string) string {
+	params := append([]buildParam{{Name: "image", Value: yamlQuote(image)}}, sbomParams(*in.SBOM, scannerImage())...)
+	tpl := `apiVersion: tekton.dev/v1
+kind: TaskRun
+metadata:
+  generateName: {{.Name}}-sbom-
+  namespace: {{.Namespace}}
+spec:
+  serviceAccountName: build-bot
+  taskRef:
+    name: {{.Task}}
+  params:
+{{- range .Params }}
+    - name: {{.Name}}
+      value: {{.Value}}
+{{- end }}
+  workspaces:
+    - name: source
+      emptyDir: {}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      scanRunName(in),
+		"Namespace": in.Namespace,
+		"Task":      sbomTask,
+		"Params":    params,
+	})
+}
+
+// generateSBOM creates the SBOM of a pushed image with a TaskRun of the SBOM
+// Task and archives it for the run.
+func generateSBOM(in Input, image, runID string) error {
+	name, err := kubectlCreateName(renderSBOMTaskRun(in, image), in.Namespace)
+	if err != nil {
+		return fmt.Errorf("create sbom taskrun: %v", err)
+	}
+	if err := waitForTaskRun(in.Namespace, name, 30*time.Minute); err != nil {
+		return fmt.Errorf("sbom: %v", err)
+	}
+	return archiveSBOM(in, name, image, scannerImage(), runID)
+}
+
+// archiveSBOM reads the SBOM that a finished TaskRun printed to its log,
+// writes it to sbomDir and records it on the run. The archive is a record of
+// the build, so failing to write it is logged and does not fail the run.
+func archiveSBOM(in Input, taskRun, image, generator, runID string) error {
+	doc, err := readStepReport(in.Namespace, taskRun, "sbom", sbomBegin)
+	if err != nil {
+		return fmt.Errorf("sbom: %v", err)
+	}
+	pkgs, err := sbomPackages([]byte(doc))
+	if err != nil {
+		return fmt.Errorf("sbom: %v", err)
+	}
+	info := SBOMInfo{Format: in.SBOM.Format, Image: image, Generator: generator, Packages: len(pkgs), Size: len(doc)}
+	if runID == "" {
+		log.Printf("sbom of %s: %d packages", image, info.Packages)
+		return nil
+	}
+	if err := os.MkdirAll(sbomDir, 0o755); err != nil {
+		log.Printf("run %s: archive sbom: %v", runID, err)
+		return nil
+	}
+	if err := os.WriteFile(sbomPath(runID), []byte(doc), 0o644); err != nil {
+		log.Printf("run %s: archive sbom: %v", runID, err)
+		return nil
+	}
+	if err := runStore.update(runID, func(r *Run) { r.SBOM = &info }); err != nil {
+		logRunError(runID, err)
+	}
+	return nil
+}
+
+func sbomPath(runID string) string {
+	return filepath.Join(sbomDir, runID+".json")
+}
+
+// collectPipelineSBOM archives the SBOM written by the sbom stage of a
+// finished PipelineRun, for the digest the pipeline pushed.
+func collectPipelineSBOM(in Input, pipelineRun, runID string) error {
+	if in.Pipeline == nil || in.SBOM == nil {
+		return nil
+	}
+	stages := pipelineStageStatus(in.Namespace, pipelineRun, true)
+	for _, s := range in.Pipeline.Stages {
+		st, ok := stages[s.Name]
+		if s.Type != stageSBOM || !ok || st.Status != stageSucceeded {
+			continue
+		}
+		generator := s.Image
+		if generator == "" {
+			generator = scannerImage()
+		}
+		return archiveSBOM(in, st.TaskRun, pipelineImage(in, pipelineRun), generator, runID)
+	}
+	return nil
+}
+
+// sbomPackages returns the packages of an SPDX or CycloneDX JSON document.
+func sbomPackages(doc []byte) ([]SBOMPackage, error) {
+	var d struct {
+		SPDXVersion string `json:"spdxVersion"`
+		BOMFormat   string `json:"bomFormat"`
+		Packages    []struct {
+			Name         string `json:"name"`
+			VersionInfo  string `json:"versionInfo"`
+			ExternalRefs []struct {
+				Type    string `json:"referenceType"`
+				Locator string `json:"referenceLocator"`
+			} `json:"externalRefs"`
+		} `json:"packages"`
+		Components []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			PURL    string `json:"purl"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, fmt.Errorf("parse sbom: %v", err)
+	}
+	pkgs := []SBOMPackage{}
+	switch {
+	case d.SPDXVersion != "":
+		for _, p := range d.Packages {
+			pkg := SBOMPackage{Name: p.Name, Version: p.VersionInfo}
+			for _, ref := range p.ExternalRefs {
+				if ref.Type == "purl" {
+					pkg.PURL = ref.Locator
+				}
+			}
+			// The image and its OS are packages of an SPDX document too;
+			// only packages with a purl are compared.
+			if pkg.PURL != "" {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+	case d.BOMFormat == "CycloneDX":
+		for _, c := range d.Components {
+			if c.PURL != "" {
+				pkgs = append(pkgs, SBOMPackage{Name: c.Name, Version: c.Version, PURL: c.PURL})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("not an SPDX or CycloneDX document")
+	}
+	return pkgs, nil
+}
+
+// sbomKey identifies a package independent of its version: the purl without
+// version and qualifiers.
+func sbomKey(p SBOMPackage) string {
+	key := p.PURL
+	if i := strings.IndexAny(key, "?#"); i >= 0 {
+		key = key[:i]
+	}
+	if i := strings.LastIndex(key, "@"); i >= 0 {
+		key = key[:i]
+	}
+	return key
+}
+
+// diffSBOMs compares the packages of two SBOMs. A package whose only version
+// differs is reported as changed.
+func diffSBOMs(from, to []SBOMPackage) map[string]any {
+	versions := func(pkgs []SBOMPackage) map[string]map[string]SBOMPackage {
+		m := map[string]map[string]SBOMPackage{}
+		for _, p := range pkgs {
+			k := sbomKey(p)
+			if m[k] == nil {
+				m[k] = map[string]SBOMPackage{}
+			}
+			m[k][p.Version] = p
+		}
+		return m
+	}
+	a, b := versions(from), versions(to)
+	added, removed, changed := []SBOMPackage{}, []SBOMPackage{}, []SBOMChange{}
+	unchanged := 0
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range keys {
+		var gone, fresh []SBOMPackage
+		for v, p := range a[k] {
+			if _, ok := b[k][v]; ok {
+				unchanged++
+			} else {
+				gone = append(gone, p)
+			}
+		}
+		for v, p := range b[k] {
+			if _, ok := a[k][v]; !ok {
+				fresh = append(fresh, p)
+			}
+		}
+		if len(gone) == 1 && len(fresh) == 1 {
+			changed = append(changed, SBOMChange{Name: fresh[0].Name, From: gone[0].Version, To: fresh[0].Version, PURL: k})
+			continue
+		}
+		removed = append(removed, gone...)
+		added = append(added, fresh...)
+	}
+	sortPkgs := func(p []SBOMPackage) {
+		sort.Slice(p, func(i, j int) bool {
+			if p[i].Name != p[j].Name {
+				return p[i].Name < p[j].Name
+			}
+			return p[i].Version < p[j].Version
+		})
+	}
+	sortPkgs(added)
+	sortPkgs(removed)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].PURL < changed[j].PURL })
+	return map[string]any{
+		"added":     added,
+		"removed":   removed,
+		"changed":   changed,
+		"unchanged": unchanged,
+	}
+}
+
+// readRunSBOM returns the archived SBOM of a run.
+func readRunSBOM(run Run) ([]byte, error) {
+	if run.SBOM == nil {
+		return nil, fmt.Errorf("run %s has no sbom", run.ID)
+	}
+	return os.ReadFile(sbomPath(run.ID))
+}
+
+// sbomDiff is the reply of GET /sbom/diff.
+func sbomDiff(fromID, toID string) (map[string]any, error) {
+	var pkgs [2][]SBOMPackage
+	for i, id := range []string{fromID, toID} {
+		run, err := runStore.get(id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", id, err)
+		}
+		doc, err := readRunSBOM(run)
+		if err != nil {
+			return nil, err
+		}
+		if pkgs[i], err = sbomPackages(doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", id, err)
+		}
+	}
+	diff := diffSBOMs(pkgs[0], pkgs[1])
+	diff["from"] = fromID
+	diff["to"] = toID
+	return diff, nil
+}
+
+// removeSBOMs deletes the archived SBOMs of runs that are no longer kept.
+func removeSBOMs(runs []Run) {
+	for _, r := range runs {
+		if r.SBOM == nil {
+			continue
+		}
+		if err := os.Remove(sbomPath(r.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("run %s: remove sbom: %v", r.ID, err)
+		}
+	}
+}
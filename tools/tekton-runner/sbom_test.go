@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSBOMPackages(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    []SBOMPackage
+		wantErr bool
+	}{
+		{
+			"spdx",
+			`{"spdxVersion": "SPDX-2.3", "packages": [
+				{"name": "web", "versionInfo": "sha256:abc"},
+				{"name": "openssl", "versionInfo": "3.0.1", "externalRefs": [
+					{"referenceType": "cpe23Type", "referenceLocator": "cpe:2.3:a:openssl"},
+					{"referenceType": "purl", "referenceLocator": "pkg:deb/debian/openssl@3.0.1?arch=amd64"}
+				]}
+			]}`,
+			[]SBOMPackage{{Name: "openssl", Version: "3.0.1", PURL: "pkg:deb/debian/openssl@3.0.1?arch=amd64"}},
+			false,
+		},
+		{
+			"cyclonedx",
+			`{"bomFormat": "CycloneDX", "components": [
+				{"name": "debian", "version": "12"},
+				{"name": "golang.org/x/net", "version": "v0.1.0", "purl": "pkg:golang/golang.org/x/net@v0.1.0"}
+			]}`,
+			[]SBOMPackage{{Name: "golang.org/x/net", Version: "v0.1.0", PURL: "pkg:golang/golang.org/x/net@v0.1.0"}},
+			false,
+		},
+		{"empty spdx", `{"spdxVersion": "SPDX-2.3"}`, []SBOMPackage{}, false},
+		{"unknown format", `{"packages": []}`, nil, true},
+		{"not json", `<bom/>`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := sbomPackages([]byte(tt.doc))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: sbomPackages() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sbomPackages() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffSBOMs(t *testing.T) {
+	pkg := func(name, version, purl string) SBOMPackage {
+		return SBOMPackage{Name: name, Version: version, PURL: purl}
+	}
+	from := []SBOMPackage{
+		pkg("openssl", "3.0.1", "pkg:deb/debian/openssl@3.0.1?arch=amd64"),
+		pkg("zlib", "1.2", "pkg:deb/debian/zlib@1.2"),
+		pkg("curl", "8.0", "pkg:deb/debian/curl@8.0"),
+		pkg("x/net", "v0.1.0", "pkg:golang/golang.org/x/net@v0.1.0"),
+		pkg("x/net", "v0.2.0", "pkg:golang/golang.org/x/net@v0.2.0"),
+	}
+	to := []SBOMPackage{
+		pkg("openssl", "3.0.2", "pkg:deb/debian/openssl@3.0.2?arch=amd64"),
+		pkg("zlib", "1.2", "pkg:deb/debian/zlib@1.2"),
+		pkg("bash", "5.2", "pkg:deb/debian/bash@5.2"),
+		pkg("x/net", "v0.3.0", "pkg:golang/golang.org/x/net@v0.3.0"),
+		pkg("x/net", "v0.4.0", "pkg:golang/golang.org/x/net@v0.4.0"),
+	}
+	got := diffSBOMs(from, to)
+	want := map[string]any{
+		"added": []SBOMPackage{
+			pkg("bash", "5.2", "pkg:deb/debian/bash@5.2"),
+			pkg("x/net", "v0.3.0", "pkg:golang/golang.org/x/net@v0.3.0"),
+			pkg("x/net", "v0.4.0", "pkg:golang/golang.org/x/net@v0.4.0"),
+		},
+		"removed": []SBOMPackage{
+			pkg("curl", "8.0", "pkg:deb/debian/curl@8.0"),
+			pkg("x/net", "v0.1.0", "pkg:golang/golang.org/x/net@v0.1.0"),
+			pkg("x/net", "v0.2.0", "pkg:golang/golang.org/x/net@v0.2.0"),
+		},
+		"changed": []SBOMChange{
+			{Name: "openssl", From: "3.0.1", To: "3.0.2", PURL: "pkg:deb/debian/openssl"},
+		},
+		"unchanged": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSBOMs() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ScanPolicy decides whether a scanned image may be deployed: findings above
+// MaxSeverity block it unless their ID is in Ignore.
+type ScanPolicy struct {
+	MaxSeverity string   `json:"max_severity"`
+	Ignore      []string `json:"ignore"`
+}
+
+// ScanSummary is the scan result stored on a run. Findings lists the
+// findings that blocked the deploy.
+type ScanSummary struct {
+	Image       string         `json:"image"`
+	Scanner     string         `json:"scanner"`
+	MaxSeverity string         `json:"max_severity"`
+	Counts      map[string]int `json:"counts"`
+	Ignored     int            `json:"ignored"`
+	Blocked     int            `json:"blocked"`
+	Passed      bool           `json:"passed"`
+	Findings    []ScanFinding  `json:"findings,omitempty"`
+}
+
+type ScanFinding struct {
+	ID        string `json:"id"`
+	Severity  string `json:"severity"`
+	Package   string `json:"package"`
+	Installed string `json:"installed"`
+	Fixed     string `json:"fixed,omitempty"`
+	Target    string `json:"target"`
+	Title     string `json:"title,omitempty"`
+}
+
+const (
+	defaultMaxSeverity = "HIGH"
+	defaultScanner     = "lenovo:8443/library/trivy:0.53.0"
+	scanTask           = "image-scan"
+	scanBegin          = "--- scan"
+	maxScanFindings    = 100
+)
+
+// severityRank orders the Trivy severities.
+var severityRank = map[string]int{"UNKNOWN": 0, "LOW": 1, "MEDIUM": 2, "HIGH": 3, "CRITICAL": 4}
+
+func scannerImage() string {
+	if v := strings.TrimSpace(os.Getenv("SCANNER_IMAGE")); v != "" {
+		return v
+	}
+	return defaultScanner
+}
+
+// setScanDefaults turns on the default policy for pipelines with a scan
+// stage. The deprecated severity of a scan stage sets the threshold when the
+// request gives no scan.max_severity.
+func setScanDefaults(in *Input) {
+	stageSeverity := ""
+	if in.Pipeline != nil {
+		for _, s := range in.Pipeline.Stages {
+			if s.Type != stageScan {
+				continue
+			}
+			if in.Scan == nil {
+				in.Scan = &ScanPolicy{}
+			}
+			if s.Severity != "" {
+				stageSeverity = s.Severity
+			}
+		}
+	}
+	if in.Scan == nil {
+		return
+	}
+	in.Scan.MaxSeverity = strings.ToUpper(in.Scan.MaxSeverity)
+	if in.Scan.MaxSeverity == "" {
+		in.Scan.MaxSeverity = defaultMaxSeverity
+		if max, ok := severityThreshold(stageSeverity); ok {
+			in.Scan.MaxSeverity = max
+		}
+	}
+}
+
+// severityThreshold maps a list of severities that fail a scan to the
+// highest severity that still passes. UNKNOWN findings cannot be blocked by
+// a threshold, so a list that starts at UNKNOWN maps to UNKNOWN.
+func severityThreshold(list string) (string, bool) {
+	lowest := -1
+	for _, sev := range strings.Split(list, ",") {
+		rank, ok := severityRank[strings.ToUpper(strings.TrimSpace(sev))]
+		if !ok {
+			return "", false
+		}
+		if lowest < 0 || rank < lowest {
+			lowest = rank
+		}
+	}
+	if lowest > 0 {
+		lowest--
+	}
+	for sev, rank := range severityRank {
+		if rank == lowest {
+			return sev, true
+		}
+	}
+	return "", false
+}
+
+func validateScan(in *Input) error {
+	if in.Scan == nil {
+		return nil
+	}
+	if _, ok := severityRank[in.Scan.MaxSeverity]; !ok {
+		return fmt.Errorf("scan.max_severity must be UNKNOWN, LOW, MEDIUM, HIGH or CRITICAL")
+	}
+	for _, id := range in.Scan.Ignore {
+		if !labelKeyRe.MatchString(id) {
+			return fmt.Errorf("scan.ignore: invalid id %q", id)
+		}
+	}
+	if in.Pipeline != nil {
+		for _, s := range in.Pipeline.Stages {
+			if s.Type == stageScan {
+				return nil
+			}
+		}
+		return fmt.Errorf("scan needs a scan stage in pipeline.stages")
+	}
+	return nil
+}
+
+// blockSeverities returns the severities above the policy's maximum, as
+// passed to the scanner.
+func blockSeverities(p ScanPolicy) string {
+	var out []string
+	for _, sev := range []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"} {
+		if severityRank[sev] > severityRank[p.MaxSeverity] {
+			out = append(out, sev)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// scanParams are the params of the scan Task for a policy.
+func scanParams(p ScanPolicy, image string) []buildParam {
+	params := []buildParam{
+		{Name: "scanner-image", Value: yamlQuote(image)},
+		{Name: "block-severities", Value: yamlQuote(blockSeverities(p))},
+	}
+	if len(p.Ignore) > 0 {
+		ids := make([]string, 0, len(p.Ignore))
+		for _, id := range p.Ignore {
+			ids = append(ids, yamlQuote(id))
+		}
+		params = append(params, buildParam{Name: "ignore", List: ids})
+	}
+	return params
+}
+
+func renderScanTaskRun(in Input, image string) string {
+	params := append([]buildParam{{Name: "image", Value: yamlQuote(image)}}, scanParams(*in.Scan, scannerImage())...)
+	tpl := `apiVersion: tekton.dev/v1
+kind: TaskRun
+metadata:
+  generateName: {{.Name}}-scan-
+  namespace: {{.Namespace}}
+spec:
+  serviceAccountName: build-bot
+  taskRef:
+    name: {{.Task}}
+  params:
+{{- range .Params }}
+    - name: {{.Name}}
+{{- if .List }}
+      value:
+{{- range .List }}
+        - {{.}}
+{{- end }}
+{{- else }}
+      value: {{.Value}}
+{{- end }}
+{{- end }}
+  workspaces:
+    - name: source
+      emptyDir: {}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      scanRunName(in),
+		"Namespace": in.Namespace,
+		"Task":      scanTask,
+		"Params":    params,
+	})
+}
+
+func scanRunName(in Input) string {
+	if in.Image.Project != "" {
+		return strings.ToLower(in.Image.Project)
+	}
+	if in.AppName != "" {
+		return sanitizeName(in.AppName)
+	}
+	return "image"
+}
+
+// scanImage scans a pushed image with a TaskRun of the scan Task and applies
+// the policy of the request. It returns an error if the image is blocked.
+func scanImage(in Input, image, runID string) error {
+	runStore.setStatus(runID, runScanning)
+	name, err := kubectlCreateName(renderScanTaskRun(in, image), in.Namespace)
+	if err != nil {
+		return fmt.Errorf("create scan taskrun: %v", err)
+	}
+	werr := waitForTaskRun(in.Namespace, name, 30*time.Minute)
+	return applyScanReport(in, name, image, scannerImage(), runID, werr)
+}
+
+// applyScanReport reads the scan report of a finished TaskRun, stores the
+// summary on the run and applies the policy. taskErr is the error of the
+// TaskRun; the scan Task fails when the image is blocked.
+func applyScanReport(in Input, taskRun, image, scanner, runID string, taskErr error) error {
+	report, err := readScanReport(in.Namespace, taskRun)
+	if err != nil {
+		if taskErr != nil {
+			return fmt.Errorf("scan failed: %v", taskErr)
+		}
+		return fmt.Errorf("scan report: %v", err)
+	}
+	summary := evaluateScan(report, *in.Scan)
+	summary.Image = image
+	summary.Scanner = scanner
+	if err := runStore.update(runID, func(r *Run) { r.Scan = &summary }); err != nil {
+		logRunError(runID, err)
+	}
+	if !summary.Passed {
+		ids := make([]string, 0, 5)
+		for i, f := range summary.Findings {
+			if i == 5 {
+				ids = append(ids, "...")
+				break
+			}
+			ids = append(ids, f.ID)
+		}
+		return fmt.Errorf("scan: %d findings above %s: %s", summary.Blocked, summary.MaxSeverity, strings.Join(ids, ", "))
+	}
+	return nil
+}
+
+type trivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Severity         string `json:"Severity"`
+			Title            string `json:"Title"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// readScanReport reads the Trivy JSON report that the scan step prints to
+// its log.
+func readScanReport(ns, taskRun string) (trivyReport, error) {
+	var report trivyReport
+	doc, err := readStepReport(ns, taskRun, "scan", scanBegin)
+	if err != nil {
+		return report, err
+	}
+	if err := json.Unmarshal([]byte(doc), &report); err != nil {
+		return report, fmt.Errorf("parse scan report: %v", err)
+	}
+	return report, nil
+}
+
+// readStepReport returns the document that a step of a finished TaskRun
+// printed to its log between begin and the end marker.
+func readStepReport(ns, taskRun, step, begin string) (string, error) {
+	pod, err := kubectlCmd("-n", ns, "get", "taskrun", taskRun, "-o", "jsonpath={.status.podName}").Output()
+	if err != nil || strings.TrimSpace(string(pod)) == "" {
+		return "", fmt.Errorf("get pod of taskrun %s: %v", taskRun, err)
+	}
+	cmd := kubectlCmd("-n", ns, "logs", strings.TrimSpace(string(pod)), "-c", "step-"+step)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	doc, perr := logReport(out, begin)
+	io.Copy(io.Discard, out)
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("logs of taskrun %s: %v", taskRun, err)
+	}
+	return doc, perr
+}
+
+func logReport(r io.Reader, begin string) (string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 1<<20), 64<<20)
+	var doc strings.Builder
+	in := false
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case !in && line == begin:
+			in = true
+		case in && line == reportEnd:
+			return doc.String(), nil
+		case in:
+			doc.WriteString(line)
+			doc.WriteByte('\n')
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no %s report in log", strings.TrimPrefix(begin, "--- "))
+}
+
+// evaluateScan counts the findings of a report by severity and lists those
+// that the policy blocks. A vulnerability found in several targets is
+// counted once.
+func evaluateScan(report trivyReport, p ScanPolicy) ScanSummary {
+	ignore := map[string]bool{}
+	for _, id := range p.Ignore {
+		ignore[id] = true
+	}
+	s := ScanSummary{MaxSeverity: p.MaxSeverity, Counts: map[string]int{}}
+	seen := map[string]bool{}
+	for _, res := range report.Results {
+		for _, v := range res.Vulnerabilities {
+			key := v.VulnerabilityID + "|" + v.PkgName + "|" + v.InstalledVersion
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if ignore[v.VulnerabilityID] {
+				s.Ignored++
+				continue
+			}
+			sev := strings.ToUpper(v.Severity)
+			if _, ok := severityRank[sev]; !ok {
+				sev = "UNKNOWN"
+			}
+			s.Counts[sev]++
+			if severityRank[sev] <= severityRank[p.MaxSeverity] {
+				continue
+			}
+			s.Blocked++
+			s.Findings = append(s.Findings, ScanFinding{
+				ID:        v.VulnerabilityID,
+				Severity:  sev,
+				Package:   v.PkgName,
+				Installed: v.InstalledVersion,
+				Fixed:     v.FixedVersion,
+				Target:    res.Target,
+				Title:     v.Title,
+			})
+		}
+	}
+	sort.SliceStable(s.Findings, func(i, j int) bool {
+		return severityRank[s.Findings[i].Severity] > severityRank[s.Findings[j].Severity]
+	})
+	if len(s.Findings) > maxScanFindings {
+		s.Findings = s.Findings[:maxScanFindings]
+	}
+	s.Passed = s.Blocked == 0
+	return s
+}
+
+// collectPipelineScan applies the scan policy to the report of the scan stage
+// of a finished PipelineRun.
+func collectPipelineScan(in Input, pipelineRun, runID string) error {
+	if in.Pipeline == nil || in.Scan == nil {
+		return nil
+	}
+	stages := pipelineStageStatus(in.Namespace, pipelineRun, true)
+	for _, s := range in.Pipeline.Stages {
+		st, ok := stages[s.Name]
+		if s.Type != stageScan || !ok || st.TaskRun == "" {
+			continue
+		}
+		var taskErr error
+		if st.Status == stageFailed {
+			taskErr = fmt.Errorf("%s", st.Message)
+		}
+		scanner := s.Image
+		if scanner == "" {
+			scanner = scannerImage()
+		}
+		return applyScanReport(in, st.TaskRun, pipelineImage(in, pipelineRun), scanner, runID, taskErr)
+	}
+	return nil
+}
+
+// pipelineImage is the image a pipeline pushed, by digest. Pipelines that
+// stopped before their push stage only have the tag.
+func pipelineImage(in Input, pipelineRun string) string {
+	results, err := buildResults(in, pipelineRun)
+	if err != nil {
+		return imageRef(in)
+	}
+	if ref, ok := pushedImage(in, results); ok {
+		return ref
+	}
+	return imageRef(in)
+}
+
+// scanResult is the reply of GET /runs/{id}/scan.
+func scanResult(run Run) map[string]any {
+	if run.Scan == nil {
+		return map[string]any{"run_id": run.ID, "scanned": false}
+	}
+	return map[string]any{"run_id": run.ID, "scanned": true, "scan": run.Scan}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSeverityThreshold(t *testing.T) {
+	tests := []struct {
+		list   string
+		want   string
+		wantOK bool
+	}{
+		{"CRITICAL", "HIGH", true},
+		{"HIGH,CRITICAL", "MEDIUM", true},
+		{"critical, high", "MEDIUM", true},
+		{"LOW", "UNKNOWN", true},
+		{"UNKNOWN,LOW", "UNKNOWN", true},
+		{"", "", false},
+		{"HIGH,SEVERE", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := severityThreshold(tt.list)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("severityThreshold(%q) = %q, %v, want %q, %v", tt.list, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+const testTrivyReport = `{"Results": [
+  {"Target": "app (debian 12)", "Vulnerabilities": [
+    {"VulnerabilityID": "CVE-1", "PkgName": "openssl", "InstalledVersion": "3.0.1", "FixedVersion": "3.0.2", "Severity": "CRITICAL"},
+    {"VulnerabilityID": "CVE-2", "PkgName": "zlib", "InstalledVersion": "1.2", "Severity": "HIGH"},
+    {"VulnerabilityID": "CVE-3", "PkgName": "curl", "InstalledVersion": "8.0", "Severity": "MEDIUM"},
+    {"VulnerabilityID": "CVE-4", "PkgName": "bash", "InstalledVersion": "5.2", "Severity": "weird"}
+  ]},
+  {"Target": "app/go.mod", "Vulnerabilities": [
+    {"VulnerabilityID": "CVE-1", "PkgName": "openssl", "InstalledVersion": "3.0.1", "Severity": "CRITICAL"},
+    {"VulnerabilityID": "CVE-5", "PkgName": "x/net", "InstalledVersion": "0.1", "Severity": "LOW"}
+  ]}
+]}`
+
+func TestEvaluateScan(t *testing.T) {
+	var report trivyReport
+	if err := json.Unmarshal([]byte(testTrivyReport), &report); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{"CRITICAL": 1, "HIGH": 1, "MEDIUM": 1, "LOW": 1, "UNKNOWN": 1}
+	tests := []struct {
+		name    string
+		policy  ScanPolicy
+		blocked []string
+		ignored int
+		counts  map[string]int
+	}{
+		{"high", ScanPolicy{MaxSeverity: "HIGH"}, []string{"CVE-1"}, 0, counts},
+		{"medium", ScanPolicy{MaxSeverity: "MEDIUM"}, []string{"CVE-1", "CVE-2"}, 0, counts},
+		{"low", ScanPolicy{MaxSeverity: "LOW"}, []string{"CVE-1", "CVE-2", "CVE-3"}, 0, counts},
+		{"critical", ScanPolicy{MaxSeverity: "CRITICAL"}, nil, 0, counts},
+		{
+			"ignored",
+			ScanPolicy{MaxSeverity: "MEDIUM", Ignore: []string{"CVE-1"}},
+			[]string{"CVE-2"},
+			1,
+			map[string]int{"HIGH": 1, "MEDIUM": 1, "LOW": 1, "UNKNOWN": 1},
+		},
+	}
+	for _, tt := range tests {
+		s := evaluateScan(report, tt.policy)
+		var ids []string
+		for _, f := range s.Findings {
+			ids = append(ids, f.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.blocked) || s.Blocked != len(tt.blocked) || s.Passed != (len(tt.blocked) == 0) {
+			t.Errorf("%s: blocked %v (%d, passed %v), want %v", tt.name, ids, s.Blocked, s.Passed, tt.blocked)
+		}
+		if s.Ignored != tt.ignored || !reflect.DeepEqual(s.Counts, tt.counts) {
+			t.Errorf("%s: ignored %d, counts %v, want %d, %v", tt.name, s.Ignored, s.Counts, tt.ignored, tt.counts)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SignatureStatus is the signing and verification state of the image of a
+// run.
+type SignatureStatus struct {
+	Signed   bool   `json:"signed"`
+	Verified bool   `json:"verified"`
+	Key      string `json:"key,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+const (
+	signTask      = "image-sign"
+	defaultSigner = "lenovo:8443/library/cosign:v2.2.4"
+)
+
+// cosignKeyDir holds the public keys (*.pub) that deployed images are
+// verified against. Without keys images are not verified.
+var cosignKeyDir = "/home/beko/cosign-keys"
+
+func signerImage() string {
+	if v := strings.TrimSpace(os.Getenv("SIGNER_IMAGE")); v != "" {
+		return v
+	}
+	return defaultSigner
+}
+
+// signingKeySecret is the Secret in the runner namespace with the private
+// key (cosign.key) and its password (cosign.password).
+func signingKeySecret() string {
+	if v := strings.TrimSpace(os.Getenv("COSIGN_KEY_SECRET")); v != "" {
+		return v
+	}
+	return "cosign-key"
+}
+
+// internalRegistries are the registries whose unsigned images may still be
+// deployed unless REQUIRE_SIGNATURES is set.
+func internalRegistries() []string {
+	v := strings.TrimSpace(os.Getenv("INTERNAL_REGISTRIES"))
+	if v == "" {
+		return []string{"lenovo:8443"}
+	}
+	var out []string
+	for _, r := range strings.Split(v, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func requireSignatures() bool {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv("REQUIRE_SIGNATURES")))
+	return v == "1" || v == "true" || v == "yes"
+}
+
+// setSignDefaults turns on signing for pipelines with a sign stage.
+func setSignDefaults(in *Input) {
+	if in.Pipeline == nil {
+		return
+	}
+	for _, s := range in.Pipeline.Stages {
+		if s.Type == stageSign {
+			in.Image.Sign = true
+		}
+	}
+}
+
+func validateSign(in *Input) error {
+	if !in.Image.Sign {
+		return nil
+	}
+	if in.Source.Type == "image" {
+		return fmt.Errorf("image.sign is only used when the image is built")
+	}
+	if in.Pipeline != nil {
+		for _, s := range in.Pipeline.Stages {
+			if s.Type == stageSign {
+				return nil
+			}
+		}
+		return fmt.Errorf("image.sign needs a sign stage in pipeline.stages")
+	}
+	return nil
+}
+
+// signParams are the params of the sign Task.
+func signParams(image, signer string) []buildParam {
+	return []buildParam{
+		{Name: "image", Value: yamlQuote(image)},
+		{Name: "signer-image", Value: yamlQuote(signer)},
+		{Name: "key-secret", Value: yamlQuote(signingKeySecret())},
+	}
+}
+
+func renderSignTaskRun(in Input, image string) string {
+	tpl := `apiVersion: tekton.dev/v1
+kind: TaskRun
+metadata:
+  generateName: {{.Name}}-sign-
+  namespace: {{.Namespace}}
+spec:
+  serviceAccountName: build-bot
+  taskRef:
+    name: {{.Task}}
+  params:
+{{- range .Params }}
+    - name: {{.Name}}
+      value: {{.Value}}
+{{- end }}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":      scanRunName(in),
+		"Namespace": in.Namespace,
+		"Task":      signTask,
+		"Params":    signParams(image, signerImage()),
+	})
+}
+
+// signImage signs a pushed image with a TaskRun of the sign Task.
+func signImage(in Input, image, runID string) error {
+	if imageDigest(image) == "" {
+		log.Printf("run %s: signing %s by tag, the build wrote no digest", runID, image)
+	}
+	name, err := kubectlCreateName(renderSignTaskRun(in, image), in.Namespace)
+	if err != nil {
+		return fmt.Errorf("create sign taskrun: %v", err)
+	}
+	if err := waitForTaskRun(in.Namespace, name, 10*time.Minute); err != nil {
+		return fmt.Errorf("sign: %v", err)
+	}
+	markSigned(runID)
+	return nil
+}
+
+func markSigned(runID string) {
+	if err := runStore.update(runID, func(r *Run) {
+		if r.Signature == nil {
+			r.Signature = &SignatureStatus{}
+		}
+		r.Signature.Signed = true
+	}); err != nil {
+		logRunError(runID, err)
+	}
+}
+
+// publicKeys returns the key files in cosignKeyDir, sorted by name.
+func publicKeys() []string {
+	keys, _ := filepath.Glob(filepath.Join(cosignKeyDir, "*.pub"))
+	sort.Strings(keys)
+	return keys
+}
+
+// imageRegistry returns the registry host of an image reference.
+func imageRegistry(ref string) string {
+	host, _, ok := strings.Cut(ref, "/")
+	if !ok || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "docker.io"
+	}
+	return host
+}
+
+// verifySignature checks the signature of image against the public keys and
+// returns the file name of the key that verified it.
+func verifySignature(image string, keys []string) (string, error) {
+	var last string
+	for _, key := range keys {
+		cmd := exec.Command("cosign", "verify", "--key", key, "--insecure-ignore-tlog=true", "--allow-insecure-registry", image)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			return filepath.Base(key), nil
+		}
+		last = lastLine(string(out))
+		if last == "" {
+			last = err.Error()
+		}
+	}
+	return "", fmt.Errorf("%s", last)
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// imageAllowed decides whether an image of registry may be deployed.
+// Verified images always may; unverified ones only when they come from an
+// internal registry and signatures are not required.
+func imageAllowed(registry string, verified, require bool, internal []string) bool {
+	if verified {
+		return true
+	}
+	if require {
+		return false
+	}
+	for _, r := range internal {
+		if r == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyImages verifies the images against the public keys. Without keys
+// nothing is verified unless REQUIRE_SIGNATURES is set, in which case every
+// image is refused. The status describes the first image, or the first one
+// that failed.
+func verifyImages(images []string) (SignatureStatus, error) {
+	keys := publicKeys()
+	require := requireSignatures()
+	if len(keys) == 0 && !require {
+		return SignatureStatus{}, nil
+	}
+	status := SignatureStatus{Verified: true}
+	var refused error
+	seen := map[string]bool{}
+	for _, image := range images {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		key, err := "", fmt.Errorf("no public keys in %s", cosignKeyDir)
+		if len(keys) > 0 {
+			key, err = verifySignature(image, keys)
+		}
+		if err == nil {
+			if status.Key == "" {
+				status.Key = key
+			}
+			continue
+		}
+		if status.Verified {
+			status.Verified = false
+			status.Message = image + ": " + err.Error()
+		}
+		registry := imageRegistry(image)
+		if !imageAllowed(registry, false, require, internalRegistries()) {
+			if refused == nil {
+				refused = fmt.Errorf("image %s has no valid signature: %v", image, err)
+			}
+			continue
+		}
+		log.Printf("deploying unverified image %s of %s: %v", image, registry, err)
+	}
+	return status, refused
+}
+
+// checkSignature verifies every image a deploy of in runs (the app image, or
+// the images of its chart or manifests) and records the result on the run.
+// Images without a valid signature are refused, except images of the
+// internal registries when REQUIRE_SIGNATURES is not set.
+func checkSignature(in Input, image, runID string) error {
+	if len(publicKeys()) == 0 && !requireSignatures() {
+		return nil
+	}
+	images, err := deployImages(in, image)
+	if err != nil {
+		return fmt.Errorf("check signatures: %v", err)
+	}
+	status, err := verifyImages(images)
+	if uerr := runStore.update(runID, func(r *Run) {
+		if r.Signature != nil {
+			status.Signed = r.Signature.Signed
+		}
+		r.Signature = &status
+	}); uerr != nil {
+		logRunError(runID, uerr)
+	}
+	return err
+}
+
+// deployImages returns the images a deploy of in runs. Addon images are
+// checked when the addons are applied.
+func deployImages(in Input, image string) ([]string, error) {
+	ns := workspaceName(in)
+	var out string
+	var err error
+	switch {
+	case in.Deploy.Type == deployTypeHelm:
+		out, err = renderHelm(ns, image, *in.Deploy.Helm)
+	case usesManifests(in.Deploy):
+		out, err = renderAppManifests(ns, sanitizeName(in.AppName), image, in)
+	default:
+		return []string{image}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return podImages(out)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageRegistry(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"nginx", "docker.io"},
+		{"nginx:1.27", "docker.io"},
+		{"library/nginx:1.27", "docker.io"},
+		{"minio/minio:latest", "docker.io"},
+		{"lenovo:8443/library/app:v1", "lenovo:8443"},
+		{"ghcr.io/org/app@sha256:abc", "ghcr.io"},
+		{"localhost/app:dev", "localhost"},
+		{"localhost:5000/app", "localhost:5000"},
+	}
+	for _, tt := range tests {
+		if got := imageRegistry(tt.ref); got != tt.want {
+			t.Errorf("imageRegistry(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestImageAllowed(t *testing.T) {
+	internal := []string{"lenovo:8443"}
+	tests := []struct {
+		name     string
+		registry string
+		verified bool
+		require  bool
+		want     bool
+	}{
+		{"verified external", "docker.io", true, false, true},
+		{"verified when required", "docker.io", true, true, true},
+		{"unverified internal", "lenovo:8443", false, false, true},
+		{"unverified internal when required", "lenovo:8443", false, true, false},
+		{"unverified external", "docker.io", false, false, false},
+		{"unverified external when required", "ghcr.io", false, true, false},
+	}
+	for _, tt := range tests {
+		if got := imageAllowed(tt.registry, tt.verified, tt.require, internal); got != tt.want {
+			t.Errorf("%s: imageAllowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyImagesWithoutKeys(t *testing.T) {
+	old := cosignKeyDir
+	cosignKeyDir = t.TempDir()
+	t.Cleanup(func() { cosignKeyDir = old })
+	tests := []struct {
+		require string
+		wantErr bool
+	}{
+		{"", false},
+		{"false", false},
+		{"true", true},
+		{"1", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("REQUIRE_SIGNATURES", tt.require)
+		status, err := verifyImages([]string{"lenovo:8443/library/app:v1"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("REQUIRE_SIGNATURES=%q: err = %v, want error %v", tt.require, err, tt.wantErr)
+		}
+		if tt.wantErr && status.Verified {
+			t.Errorf("REQUIRE_SIGNATURES=%q: image reported as verified", tt.require)
+		}
+	}
+}
+
+// fakeCosign puts a cosign on PATH that stands in for cosign and the
+// registry: an image verifies against a key if signed lists the key's file
+// name for it. It also points cosignKeyDir at keys.
+func fakeCosign(t *testing.T, keys []string, signed map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	var sigs strings.Builder
+	for image, key := range signed {
+		sigs.WriteString(image + " " + key + "\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "signatures"), []byte(sigs.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+# cosign verify --key KEY [flags] IMAGE
+key=$(basename "$3")
+for a; do image=$a; done
+if grep -qxF "$image $key" "` + filepath.Join(dir, "signatures") + `"; then
+  echo "Verification for $image --"
+  exit 0
+fi
+echo "Error: no matching signatures: $image" >&2
+exit 1
+`
+	if err := os.WriteFile(filepath.Join(dir, "cosign"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	keyDir := filepath.Join(dir, "keys")
+	if err := os.Mkdir(keyDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if err := os.WriteFile(filepath.Join(keyDir, k), []byte("key"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := cosignKeyDir
+	cosignKeyDir = keyDir
+	t.Cleanup(func() { cosignKeyDir = old })
+}
+
+func TestVerifySignature(t *testing.T) {
+	fakeCosign(t, []string{"a.pub", "b.pub"}, map[string]string{
+		"lenovo:8443/library/app@sha256:1": "b.pub",
+	})
+	key, err := verifySignature("lenovo:8443/library/app@sha256:1", publicKeys())
+	if err != nil || key != "b.pub" {
+		t.Errorf("signed image: key = %q, err = %v, want b.pub", key, err)
+	}
+	_, err = verifySignature("lenovo:8443/library/app@sha256:2", publicKeys())
+	if err == nil || !strings.Contains(err.Error(), "no matching signatures") {
+		t.Errorf("unsigned image: err = %v, want the cosign error", err)
+	}
+}
+
+func TestVerifyImages(t *testing.T) {
+	fakeCosign(t, []string{"team.pub"}, map[string]string{
+		"lenovo:8443/library/app:v1": "team.pub",
+		"docker.io/library/nginx:1":  "team.pub",
+	})
+	tests := []struct {
+		name         string
+		images       []string
+		require      string
+		wantVerified bool
+		wantErr      bool
+	}{
+		{"signed", []string{"lenovo:8443/library/app:v1", "docker.io/library/nginx:1"}, "", true, false},
+		{"unsigned internal", []string{"lenovo:8443/library/app:v1", "lenovo:8443/library/other:v1"}, "", false, false},
+		{"unsigned internal when required", []string{"lenovo:8443/library/other:v1"}, "true", false, true},
+		{"unsigned external", []string{"lenovo:8443/library/app:v1", "ghcr.io/org/tool:v1"}, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("REQUIRE_SIGNATURES", tt.require)
+		status, err := verifyImages(tt.images)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if status.Verified != tt.wantVerified {
+			t.Errorf("%s: verified = %v, want %v", tt.name, status.Verified, tt.wantVerified)
+		}
+		if tt.wantVerified && status.Key != "team.pub" {
+			t.Errorf("%s: key = %q, want team.pub", tt.name, status.Key)
+		}
+		if !tt.wantVerified && !strings.Contains(status.Message, "no matching signatures") {
+			t.Errorf("%s: message = %q", tt.name, status.Message)
+		}
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	fakeCosign(t, []string{"team.pub"}, map[string]string{"lenovo:8443/library/app:v1": "team.pub"})
+	old := runStore
+	runStore = &RunStore{path: filepath.Join(t.TempDir(), "runs.json")}
+	t.Cleanup(func() { runStore = old })
+
+	tests := []struct {
+		image        string
+		wantVerified bool
+		wantErr      bool
+	}{
+		{"lenovo:8443/library/app:v1", true, false},
+		{"docker.io/library/redis:7", false, true},
+	}
+	for _, tt := range tests {
+		run := Run{ID: newRunID(), Signature: &SignatureStatus{Signed: true}}
+		if err := runStore.create(run); err != nil {
+			t.Fatal(err)
+		}
+		err := checkSignature(Input{AppName: "web"}, tt.image, run.ID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.image, err, tt.wantErr)
+		}
+		got, err := runStore.get(run.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Signature == nil || got.Signature.Verified != tt.wantVerified || !got.Signature.Signed {
+			t.Errorf("%s: signature = %+v, want verified %v and signed kept", tt.image, got.Signature, tt.wantVerified)
+		}
+	}
+}
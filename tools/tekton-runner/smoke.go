@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SmokeTest is an HTTP request run against a deployed app. The app counts as
+// ready only when every test passes.
+type SmokeTest struct {
+	Name         string   `json:"name"`
+	Method       string   `json:"method"`
+	Path         string   `json:"path"`
+	Port         string   `json:"port"`
+	Body         string   `json:"body"`
+	ExpectStatus []int    `json:"expect_status"`
+	ExpectBody   []string `json:"expect_body"`
+}
+
+type SmokeResult struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Status     int    `json:"status,omitempty"`
+	Passed     bool   `json:"passed"`
+	Error      string `json:"error,omitempty"`
+	Attempts   int    `json:"attempts"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+const defaultSmokeTimeout = 2 * time.Minute
+
+func validateSmokeTests(tests []SmokeTest, ports []DeployPort) error {
+	for i, t := range tests {
+		field := fmt.Sprintf("deploy.smoke_tests[%d]", i)
+		if !strings.HasPrefix(t.Path, "/") {
+			return fmt.Errorf("%s: path must start with /", field)
+		}
+		switch strings.ToUpper(t.Method) {
+		case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodHead, http.MethodDelete, http.MethodPatch:
+		default:
+			return fmt.Errorf("%s: unsupported method %s", field, t.Method)
+		}
+		if err := validateProbe(field, &Probe{Type: "http", Port: t.Port}, ports); err != nil {
+			return err
+		}
+		for _, code := range t.ExpectStatus {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("%s: invalid expect_status %d", field, code)
+			}
+		}
+	}
+	return nil
+}
+
+// runSmokeTests runs the tests against a workspace Service until each passes
+// or the timeout is used up. Tests start from the first one that has not
+// passed yet, so a slow start only delays the run.
+func runSmokeTests(kubeconfig, ns, service string, tests []SmokeTest, timeout time.Duration) ([]SmokeResult, error) {
+	nodeIP, err := getNodeInternalIP(kubeconfig, ns)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := getServicePorts(kubeconfig, ns, service)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = defaultSmokeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	results := make([]SmokeResult, 0, len(tests))
+	failed := false
+	for i, t := range tests {
+		res := SmokeResult{Name: t.Name}
+		if res.Name == "" {
+			res.Name = fmt.Sprintf("test-%d", i+1)
+		}
+		port, ok := smokePort(ports, t.Port)
+		if !ok {
+			res.Error = "port not found: " + t.Port
+			results = append(results, res)
+			failed = true
+			continue
+		}
+		res.URL = fmt.Sprintf("http://%s:%d%s", nodeIP, port.NodePort, t.Path)
+		start := time.Now()
+		for {
+			res.Attempts++
+			res.Status, res.Error = smokeRequest(client, res.URL, t)
+			if res.Error == "" || !time.Now().Before(deadline) {
+				break
+			}
+			time.Sleep(2 * time.Second)
+		}
+		res.Passed = res.Error == ""
+		res.DurationMS = time.Since(start).Milliseconds()
+		if !res.Passed {
+			failed = true
+		}
+		results = append(results, res)
+	}
+	if failed {
+		return results, fmt.Errorf("smoke tests failed")
+	}
+	return results, nil
+}
+
+func smokePort(ports []ServicePort, name string) (ServicePort, bool) {
+	for _, p := range ports {
+		if p.Protocol == "UDP" {
+			continue
+		}
+		if name == "" || p.Name == name {
+			return p, true
+		}
+	}
+	return ServicePort{}, false
+}
+
+// smokeRequest performs one test request and returns the status code and a
+// description of the first failed expectation.
+func smokeRequest(client *http.Client, url string, t SmokeTest) (int, string) {
+	method := strings.ToUpper(t.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if t.Body != "" {
+		body = strings.NewReader(t.Body)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, err.Error()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	if len(t.ExpectStatus) == 0 {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return resp.StatusCode, fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		}
+	} else {
+		ok := false
+		for _, code := range t.ExpectStatus {
+			if resp.StatusCode == code {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return resp.StatusCode, fmt.Sprintf("unexpected status %d, want %v", resp.StatusCode, t.ExpectStatus)
+		}
+	}
+	for _, sub := range t.ExpectBody {
+		if !strings.Contains(string(data), sub) {
+			return resp.StatusCode, fmt.Sprintf("body does not contain %q", sub)
+		}
+	}
+	return resp.StatusCode, ""
+}
+
+// deployAndVerify deploys image, runs the smoke tests of the deploy spec and
+// records the revision once they pass. When the rollout or the tests fail
+// the run fails and, if asked, the app goes back to its previous revision
+// (or drops the canary).
+func deployAndVerify(in Input, image, runID string) error {
+	in, err := resolveDeploy(in)
+	if err != nil {
+		return err
+	}
+	if err := checkSignature(in, image, runID); err != nil {
+		return err
+	}
+	if err := deployApp(in, image); err != nil {
+		return rollbackFailedDeploy(in, err)
+	}
+	if len(in.Deploy.SmokeTests) == 0 {
+		_, err := recordDeploy(in, image, runID)
+		return err
+	}
+
+	ws := workspaceName(in)
+	app := sanitizeName(in.AppName)
+	kcfg := filepath.Join("/home/beko/kubeconfigs", ws+".yaml")
+	service := app
+	if isCanaryDeploy(kcfg, in) {
+		service = app + "-canary"
+	}
+	runStore.setStatus(runID, runVerifying)
+	results, err := runSmokeTests(kcfg, ws, service, in.Deploy.SmokeTests, time.Duration(in.Deploy.SmokeTimeoutSeconds)*time.Second)
+	_ = runStore.update(runID, func(r *Run) { r.SmokeResults = results })
+	if err == nil {
+		_, err := recordDeploy(in, image, runID)
+		return err
+	}
+	return rollbackFailedDeploy(in, err)
+}
+
+// isCanaryDeploy reports whether the deploy of in runs next to the stable
+// app as a canary. The first canary deploy of an app is applied rolling.
+func isCanaryDeploy(kubeconfig string, in Input) bool {
+	if in.Deploy.Strategy != strategyCanary {
+		return false
+	}
+	_, ok := canaryWeight(kubeconfig, workspaceName(in), sanitizeName(in.AppName))
+	return ok
+}
+
+// rollbackFailedDeploy returns err, the failure of a rollout or its smoke
+// tests. With rollback_on_failure a canary is dropped and any other app is
+// rolled back to its newest recorded revision: the failed deploy is not in
+// the history, so that is the one that was running before.
+func rollbackFailedDeploy(in Input, err error) error {
+	if !in.Deploy.RollbackOnFailure {
+		return err
+	}
+	ws := workspaceName(in)
+	app := sanitizeName(in.AppName)
+	kcfg := filepath.Join("/home/beko/kubeconfigs", ws+".yaml")
+	if isCanaryDeploy(kcfg, in) {
+		if _, aerr := abortApp(ws, app); aerr != nil {
+			return fmt.Errorf("%v; canary abort failed: %v", err, aerr)
+		}
+		return fmt.Errorf("%v; canary aborted", err)
+	}
+	revs := historyStore.list(ws, app)
+	if len(revs) == 0 {
+		return fmt.Errorf("%v; no previous revision to roll back to", err)
+	}
+	_, n, rerr := rollbackApp(ws, app, revs[0].Revision)
+	if rerr != nil {
+		return fmt.Errorf("%v; rollback failed: %v", err, rerr)
+	}
+	return fmt.Errorf("%v; rolled back to revision %d as revision %d", err, revs[0].Revision, n)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fetchSource checks out a git or zip source into a new temporary directory
+// on the runner host. The caller removes the directory.
+func fetchSource(src Source) (string, error) {
+	dir, err := os.MkdirTemp("", "source-")
+	if err != nil {
+		return "", err
+	}
+	switch src.Type {
+	case "git":
+		err = cloneGit(src, dir)
+	case "zip":
+		err = extractZip(src, dir)
+	default:
+		err = fmt.Errorf("%s sources cannot be read by the runner", src.Type)
+	}
+	if err == nil {
+		err = checkSourceLinks(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkSourceLinks fails if a symlink in a fetched source points outside of
+// it, so that reading chart, manifest or compose files from the source never
+// reads files of the runner host.
+func checkSourceLinks(dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			// Dangling links cannot be read anyway.
+			return nil
+		}
+		if rel, err := filepath.Rel(root, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			rel, _ := filepath.Rel(root, p)
+			return fmt.Errorf("source: symlink %s points outside of the source", filepath.ToSlash(rel))
+		}
+		return nil
+	})
+}
+
+// sourceRoot returns the project root of a fetched source. Archives often
+// wrap the project in a single top-level directory.
+func sourceRoot(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err == nil && len(entries) == 1 && entries[0].IsDir() && entries[0].Name() != ".git" {
+		return filepath.Join(dir, entries[0].Name())
+	}
+	return dir
+}
+
+// gitRemote returns the repo URL with the credentials of the source, and the
+// revision to check out.
+func gitRemote(src Source) (string, string, error) {
+	if src.RepoURL == "" {
+		return "", "", fmt.Errorf("source.repo_url is required")
+	}
+	repo := src.RepoURL
+	if src.GitUsername != "" && src.GitToken != "" {
+		u, err := url.Parse(repo)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid repo_url: %v", err)
+		}
+		u.User = url.UserPassword(src.GitUsername, src.GitToken)
+		repo = u.String()
+	}
+	rev := src.Revision
+	if rev == "" {
+		rev = "main"
+	}
+	return repo, rev, nil
+}
+
+func gitError(src Source, op, rev string, err error, out []byte) error {
+	msg := strings.TrimSpace(string(out))
+	if src.GitToken != "" {
+		msg = strings.ReplaceAll(msg, src.GitToken, "***")
+	}
+	return fmt.Errorf("git %s %s@%s: %v: %s", op, src.RepoURL, rev, err, msg)
+}
+
+func cloneGit(src Source, dir string) error {
+	repo, rev, err := gitRemote(src)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "clone", "--depth", "1", "--branch", rev, repo, dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return gitError(src, "clone", rev, err, out)
+	}
+	return nil
+}
+
+// gitCommit returns the commit the revision of a git source points to.
+func gitCommit(src Source) (string, error) {
+	repo, rev, err := gitRemote(src)
+	if err != nil {
+		return "", err
+	}
+	if commitRe.MatchString(rev) {
+		return rev, nil
+	}
+	out, err := exec.Command("git", "ls-remote", repo, rev).CombinedOutput()
+	if err != nil {
+		return "", gitError(src, "ls-remote", rev, err, out)
+	}
+	// Annotated tags are listed twice; the peeled ^{} line has the commit.
+	var sha string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !commitRe.MatchString(fields[0]) {
+			continue
+		}
+		if sha == "" || fields[1] == "refs/heads/"+rev || strings.HasSuffix(fields[1], "^{}") {
+			sha = fields[0]
+		}
+	}
+	if sha == "" {
+		return "", fmt.Errorf("git ls-remote %s: revision %s not found", src.RepoURL, rev)
+	}
+	return sha, nil
+}
+
+// Limits of an extracted zip source, so an archive that inflates to far more
+// than it downloads cannot fill the runner disk.
+const (
+	maxZipBytes = 2 << 30
+	maxZipFiles = 50000
+)
+
+func extractZip(src Source, dir string) error {
+	if src.ZipURL == "" {
+		return fmt.Errorf("source.zip_url is required")
+	}
+	req, err := http.NewRequest(http.MethodGet, src.ZipURL, nil)
+	if err != nil {
+		return err
+	}
+	if src.ZipUsername != "" {
+		req.SetBasicAuth(src.ZipUsername, src.ZipPassword)
+	}
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download zip: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download zip: status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 512<<20))
+	if err != nil {
+		return fmt.Errorf("download zip: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return fmt.Errorf("open zip: %v", err)
+	}
+	if len(zr.File) > maxZipFiles {
+		return fmt.Errorf("zip has %d entries, the limit is %d", len(zr.File), maxZipFiles)
+	}
+	budget := int64(maxZipBytes)
+	for _, f := range zr.File {
+		target := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("zip entry %s escapes the archive", f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		n, err := extractZipFile(f, target, budget)
+		if err != nil {
+			return err
+		}
+		budget -= n
+	}
+	return nil
+}
+
+// extractZipFile writes one entry to target and returns its size. Entries
+// that would go over budget bytes fail the extraction.
+func extractZipFile(f *zip.File, target string, budget int64) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, io.LimitReader(rc, budget+1))
+	if err != nil {
+		out.Close()
+		return n, err
+	}
+	if n > budget {
+		out.Close()
+		return n, fmt.Errorf("zip extracts to more than %d bytes", int64(maxZipBytes))
+	}
+	return n, out.Close()
+}
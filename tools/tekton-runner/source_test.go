@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSourceLinks(t *testing.T) {
+	outside := t.TempDir()
+	tests := []struct {
+		name, target string
+		wantErr      bool
+	}{
+		{"inside", "chart/values.yaml", false},
+		{"inside absolute", "", false},
+		{"dangling", "missing.yaml", false},
+		{"parent", "../../secret", true},
+		{"outside absolute", filepath.Join(outside, "secret"), true},
+		{"etc", "/etc/passwd", true},
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		src := filepath.Join(dir, "src")
+		if err := os.MkdirAll(filepath.Join(src, "chart"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, "chart", "values.yaml"), []byte("a: 1\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("s"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		target := tt.target
+		if target == "" {
+			target = filepath.Join(src, "chart", "values.yaml")
+		}
+		if err := os.Symlink(target, filepath.Join(src, "chart", "link.yaml")); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkSourceLinks(src); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkSourceLinks() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StackApp is one app of a workspace request: a regular /run request plus
+// the apps that have to be deployed before it.
+type StackApp struct {
+	Input
+	DependsOn []string `json:"depends_on"`
+}
+
+// StackRequest is the body of POST /workspace/run. Workspace, namespace and
+// addons apply to every app.
+type StackRequest struct {
+	Workspace string     `json:"workspace"`
+	Namespace string     `json:"namespace"`
+	Addons    []Addon    `json:"addons"`
+	Apps      []StackApp `json:"apps"`
+}
+
+// stackPlan is a validated StackRequest: the manifests of every app and the
+// deploy order as groups of app indexes that can run in parallel.
+type stackPlan struct {
+	Manifests [][]string
+	Order     [][]int
+}
+
+// prepareStack fills in defaults, validates every app and orders the apps by
+// depends_on.
+func prepareStack(req *StackRequest) (stackPlan, error) {
+	var plan stackPlan
+	if !strings.HasPrefix(req.Workspace, "ws-") {
+		return plan, fmt.Errorf("workspace must start with ws-")
+	}
+	if len(req.Apps) == 0 {
+		return plan, fmt.Errorf("apps is required")
+	}
+	setAddonDefaults(req.Addons)
+	if err := validateAddons(req.Addons, ""); err != nil {
+		return plan, err
+	}
+
+	index := map[string]int{}
+	for i := range req.Apps {
+		app := &req.Apps[i]
+		if app.AppName == "" {
+			return plan, fmt.Errorf("apps[%d]: app_name is required", i)
+		}
+		if app.Workspace != "" && app.Workspace != req.Workspace {
+			return plan, fmt.Errorf("apps[%d]: workspace is set on the request", i)
+		}
+		if len(app.Addons) > 0 {
+			return plan, fmt.Errorf("apps[%d]: addons are set on the request", i)
+		}
+		app.Workspace = req.Workspace
+		if app.Namespace == "" {
+			app.Namespace = req.Namespace
+		}
+		name := sanitizeName(app.AppName)
+		if _, dup := index[name]; dup {
+			return plan, fmt.Errorf("apps[%d]: app %s is duplicated", i, name)
+		}
+		for _, a := range req.Addons {
+			if a.Name == name {
+				return plan, fmt.Errorf("apps[%d]: name %s is used by an addon", i, name)
+			}
+		}
+		index[name] = i
+		app.RunID = newRunID()
+		manifests, err := buildManifests(&app.Input)
+		if err != nil {
+			return plan, fmt.Errorf("apps[%d]: %v", i, err)
+		}
+		if err := checkTaskParams(app.Input); err != nil {
+			return plan, fmt.Errorf("apps[%d]: %v", i, err)
+		}
+		plan.Manifests = append(plan.Manifests, manifests)
+	}
+
+	deps := make([][]int, len(req.Apps))
+	for i, app := range req.Apps {
+		for _, d := range app.DependsOn {
+			j, ok := index[sanitizeName(d)]
+			if !ok {
+				return plan, fmt.Errorf("apps[%d]: depends_on %s is not an app of the request", i, d)
+			}
+			if j == i {
+				return plan, fmt.Errorf("apps[%d]: app depends on itself", i)
+			}
+			deps[i] = append(deps[i], j)
+		}
+	}
+	order, err := stackOrder(deps)
+	if err != nil {
+		return plan, err
+	}
+	plan.Order = order
+	return plan, nil
+}
+
+// stackOrder groups apps into deploy waves. Every app comes in a later wave
+// than all of its dependencies.
+func stackOrder(deps [][]int) ([][]int, error) {
+	done := make([]bool, len(deps))
+	var order [][]int
+	for left := len(deps); left > 0; {
+		var wave []int
+		for i, ds := range deps {
+			if done[i] {
+				continue
+			}
+			ready := true
+			for _, d := range ds {
+				if !done[d] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, i)
+			}
+		}
+		if len(wave) == 0 {
+			return nil, fmt.Errorf("depends_on has a cycle")
+		}
+		for _, i := range wave {
+			done[i] = true
+		}
+		left -= len(wave)
+		order = append(order, wave)
+	}
+	return order, nil
+}
+
+// submitStack creates the workspace run and one run per app, and starts the
+// builds. The rest of the stack runs in the background.
+func submitStack(req StackRequest, plan stackPlan) (Run, []Run, error) {
+	parent := Run{ID: newRunID(), Source: "workspace", Workspace: req.Workspace}
+	if err := runStore.create(parent); err != nil {
+		return Run{}, nil, err
+	}
+	runs := make([]Run, len(req.Apps))
+	for i, app := range req.Apps {
+		run := Run{
+			ID:        app.RunID,
+			Parent:    parent.ID,
+			Source:    app.Source.Type,
+			Workspace: req.Workspace,
+			App:       sanitizeName(app.AppName),
+			Image:     imageRef(app.Input),
+			Stages:    pipelineStages(app.Input),
+		}
+		if err := runStore.create(run); err != nil {
+			return Run{}, nil, err
+		}
+		runs[i] = run
+	}
+	// finishBuild releases the caches once the builds are done. When a
+	// submit fails, release the cache of the failed app and of the builds
+	// submitted before it.
+	release := func(failed int) {
+		for j := 0; j <= failed; j++ {
+			if j == failed || buildRunName(runs[j]) != "" {
+				releaseCache(req.Apps[j].Input)
+			}
+		}
+	}
+	for i, app := range req.Apps {
+		acquireCache(app.Input)
+		for _, m := range plan.Manifests[i] {
+			if isBuildRun(m) {
+				name, err := kubectlCreateName(m, app.Namespace)
+				if err != nil {
+					release(i)
+					err = fmt.Errorf("%s: kubectl create: %v", runs[i].App, err)
+					failStack(parent.ID, runs, err)
+					return Run{}, nil, err
+				}
+				setBuildRun(&runs[i], app.Input, name)
+				_ = runStore.update(runs[i].ID, func(r *Run) { setBuildRun(r, app.Input, name) })
+			} else if err := kubectlApply(m); err != nil {
+				release(i)
+				err = fmt.Errorf("%s: kubectl apply: %v", runs[i].App, err)
+				failStack(parent.ID, runs, err)
+				return Run{}, nil, err
+			}
+		}
+		if buildRunName(runs[i]) == "" {
+			releaseCache(app.Input)
+		}
+	}
+	go func() {
+		err := runStack(req, plan, parent.ID, runs)
+		if err != nil {
+			log.Printf("workspace run %s: %v", parent.ID, err)
+		}
+		runStore.finish(parent.ID, err)
+	}()
+	return parent, runs, nil
+}
+
+// runStack waits for all builds, then deploys the apps wave by wave. Apps
+// after a failure are not deployed.
+func runStack(req StackRequest, plan stackPlan, parentID string, runs []Run) error {
+	runStore.setStatus(parentID, runBuilding)
+	errs := make([]error, len(runs))
+	images := make([]string, len(runs))
+	var wg sync.WaitGroup
+	for i, app := range req.Apps {
+		images[i] = imageRef(app.Input)
+		if buildRunName(runs[i]) == "" && app.Scan == nil {
+			continue
+		}
+		wg.Add(1)
+		// The build may set the deploy port of the app, so it works on the
+		// request itself.
+		go func(i int, in *Input) {
+			defer wg.Done()
+			if buildRunName(runs[i]) == "" {
+				errs[i] = scanImage(*in, images[i], runs[i].ID)
+			} else {
+				runStore.setStatus(runs[i].ID, runBuilding)
+				images[i], errs[i] = finishBuild(in, buildRunName(runs[i]), runs[i].ID)
+			}
+			if errs[i] != nil {
+				runStore.finish(runs[i].ID, errs[i])
+			}
+		}(i, &req.Apps[i].Input)
+	}
+	wg.Wait()
+	if failed := stackFailures(runs, errs); len(failed) > 0 {
+		err := fmt.Errorf("build failed: %s", strings.Join(failed, ", "))
+		failStack("", runs, err)
+		return err
+	}
+
+	runStore.setStatus(parentID, runDeploying)
+	// provisionAddons creates the cluster and writes its kubeconfig once;
+	// the apps of a wave deploy in parallel and must not do it again.
+	if err := provisionAddons(req.Workspace, req.Addons); err != nil {
+		failStack("", runs, err)
+		return err
+	}
+	for i := range req.Apps {
+		req.Apps[i].ClusterReady = true
+	}
+	for _, wave := range plan.Order {
+		for _, i := range wave {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				runStore.setStatus(runs[i].ID, runDeploying)
+				errs[i] = deployAndVerify(req.Apps[i].Input, images[i], runs[i].ID)
+				runStore.finish(runs[i].ID, errs[i])
+			}(i)
+		}
+		wg.Wait()
+		if failed := stackFailures(runs, errs); len(failed) > 0 {
+			err := fmt.Errorf("deploy failed: %s", strings.Join(failed, ", "))
+			failStack("", runs, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// stackResponse is the reply to a submitted workspace request.
+func stackResponse(parent Run, runs []Run, plan stackPlan) map[string]any {
+	apps := map[string]map[string]string{}
+	for _, run := range runs {
+		apps[run.App] = map[string]string{"run_id": run.ID, "task_run": run.TaskRun}
+		if run.PipelineRun != "" {
+			apps[run.App] = map[string]string{"run_id": run.ID, "pipeline_run": run.PipelineRun}
+		}
+	}
+	order := make([][]string, 0, len(plan.Order))
+	for _, wave := range plan.Order {
+		names := make([]string, 0, len(wave))
+		for _, i := range wave {
+			names = append(names, runs[i].App)
+		}
+		order = append(order, names)
+	}
+	return map[string]any{"status": "submitted", "run_id": parent.ID, "apps": apps, "order": order}
+}
+
+func stackFailures(runs []Run, errs []error) []string {
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, runs[i].App)
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// failStack fails the workspace run (if parentID is set) and every app run
+// that has not finished yet.
+func failStack(parentID string, runs []Run, err error) {
+	for _, r := range runs {
+		cur, gerr := runStore.get(r.ID)
+		if gerr != nil || cur.Status == runSucceeded || cur.Status == runFailed {
+			continue
+		}
+		runStore.finish(r.ID, fmt.Errorf("not deployed: %v", err))
+	}
+	if parentID != "" {
+		runStore.finish(parentID, err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStackOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		deps    [][]int
+		want    [][]int
+		wantErr bool
+	}{
+		{"no apps", nil, nil, false},
+		{"independent", [][]int{{}, {}, {}}, [][]int{{0, 1, 2}}, false},
+		{"chain", [][]int{{1}, {2}, {}}, [][]int{{2}, {1}, {0}}, false},
+		{"diamond", [][]int{{}, {0}, {0}, {1, 2}}, [][]int{{0}, {1, 2}, {3}}, false},
+		{"later wave waits for all", [][]int{{}, {0}, {0, 1}}, [][]int{{0}, {1}, {2}}, false},
+		{"cycle", [][]int{{1}, {0}}, nil, true},
+		{"self", [][]int{{0}}, nil, true},
+		{"cycle behind a ready app", [][]int{{}, {2}, {1}}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := stackOrder(tt.deps)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: stackOrder() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: stackOrder() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
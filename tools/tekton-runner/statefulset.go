@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const kindStatefulSet = "statefulset"
+
+func validateStatefulSet(d Deploy) error {
+	if !usesDeployment(d) {
+		return fmt.Errorf("deploy.kind is only used with deploy.type=deployment")
+	}
+	if d.Strategy != "" && d.Strategy != strategyRolling {
+		return fmt.Errorf("deploy.strategy is not supported for statefulset")
+	}
+	return nil
+}
+
+// appWorkload returns the resource type and name of the workload serving an
+// app.
+func appWorkload(kubeconfig, ns, app string) (string, string) {
+	if appKind(ns, app) == kindStatefulSet {
+		return "statefulset", app
+	}
+	return "deployment", activeDeployment(kubeconfig, ns, app)
+}
+
+// deployStatefulSet applies a statefulset app and waits for its rollout. The
+// claims of its pods outlive the StatefulSet, so data is kept across deploys.
+func deployStatefulSet(kubeconfig, ns, app, image string, d Deploy, secretEnv map[string]string) error {
+	// Objects of the same name are left when the app changed its kind.
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "delete", "deployment,cronjob,job", app, "--ignore-not-found")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("replace %s: %v", app, err)
+	}
+	if err := cleanupStrategyObjects(kubeconfig, ns, app); err != nil {
+		return err
+	}
+	if stderr, err := applyStatefulSet(kubeconfig, ns, app, image, d, secretEnv); err != nil {
+		if !strings.Contains(stderr, "Forbidden: updates to statefulset spec") {
+			return fmt.Errorf("apply statefulset %s: %v", app, err)
+		}
+		// volumeClaimTemplates and serviceName cannot be changed in place.
+		// Recreate the StatefulSet; its pods and claims are adopted by the
+		// new one.
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "delete", "statefulset", app, "--cascade=orphan", "--ignore-not-found")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("recreate statefulset %s: %v", app, err)
+		}
+		if _, err := applyStatefulSet(kubeconfig, ns, app, image, d, secretEnv); err != nil {
+			return fmt.Errorf("apply statefulset %s: %v", app, err)
+		}
+	}
+	cmd = exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "rollout", "status", "statefulset/"+app, "--timeout", rolloutTimeout.String())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rollout of %s not ready: %v", app, err)
+	}
+	return nil
+}
+
+// applyStatefulSet applies a statefulset app like applyDeployment and also
+// returns what kubectl wrote to stderr.
+func applyStatefulSet(kubeconfig, ns, app, image string, d Deploy, secretEnv map[string]string) (string, error) {
+	if len(d.Ports) == 0 {
+		d.Ports = defaultPorts(8080)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "apply", "-f", "-")
+	cmd.Stdin = strings.NewReader(renderDeployment(ns, app, image, d, secretEnv))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	err := cmd.Run()
+	return stderr.String(), err
+}
+
+// headlessServiceName is the governing Service of a statefulset app, which
+// gives its pods stable DNS names (<pod>.<app>-headless).
+func headlessServiceName(app string) string {
+	return app + "-headless"
+}
+
+func renderHeadlessService(ns, app string, ports []DeployPort) string {
+	tpl := `apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app: {{.App}}
+    tekton-runner/role: headless
+spec:
+  clusterIP: None
+  publishNotReadyAddresses: true
+  selector:
+    app: {{.App}}
+  ports:
+{{- range .Ports }}
+    - name: {{.Name}}
+      port: {{.ContainerPort}}
+      targetPort: {{.Name}}
+      protocol: {{.Protocol}}
+{{- end }}
+`
+	return mustRender(tpl, map[string]any{
+		"Namespace": ns,
+		"Name":      headlessServiceName(app),
+		"App":       app,
+		"Ports":     ports,
+	})
+}
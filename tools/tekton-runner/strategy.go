@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	strategyRolling   = "rolling"
+	strategyBlueGreen = "bluegreen"
+	strategyCanary    = "canary"
+)
+
+const (
+	defaultCanaryWeight = 10
+	rolloutTimeout      = 5 * time.Minute
+	canaryWeightKey     = "tekton-runner/canary-weight"
+)
+
+func kubectlApplyTo(kubeconfig, manifest string) error {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "apply", "-f", "-")
+	cmd.Stdin = strings.NewReader(manifest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// serviceSlot returns the blue/green slot selected by the app Service, or ""
+// for rolling apps.
+func serviceSlot(kubeconfig, ns, app string) string {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", "svc", app, "-o", "jsonpath={.spec.selector.slot}")
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// activeDeployment returns the name of the Deployment serving an app.
+func activeDeployment(kubeconfig, ns, app string) string {
+	if slot := serviceSlot(kubeconfig, ns, app); slot != "" {
+		return app + "-" + slot
+	}
+	return app
+}
+
+func otherSlot(slot string) string {
+	if slot == "blue" {
+		return "green"
+	}
+	return "blue"
+}
+
+func resourceExists(kubeconfig, ns, kind, name string) bool {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", kind, name, "-o", "name")
+	return cmd.Run() == nil
+}
+
+func waitRollout(kubeconfig, ns, name string, timeout time.Duration) error {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "rollout", "status", "deployment/"+name, "--timeout", timeout.String())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rollout of %s not ready: %v", name, err)
+	}
+	return nil
+}
+
+func scaleDeployment(kubeconfig, ns, name string, replicas int) error {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "scale", "deployment", name, "--replicas", strconv.Itoa(replicas))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("scale %s: %v", name, err)
+	}
+	return nil
+}
+
+// deployRolling applies the app in place, waits until the new pods are
+// ready and removes objects left over from blue/green or canary deploys.
+func deployRolling(kubeconfig, ns, app, image string, d Deploy, secretEnv map[string]string) error {
+	if err := applyDeployment(kubeconfig, ns, app, image, d, secretEnv); err != nil {
+		return err
+	}
+	if err := waitRollout(kubeconfig, ns, app, rolloutTimeout); err != nil {
+		return err
+	}
+	return cleanupStrategyObjects(kubeconfig, ns, app)
+}
+
+func cleanupStrategyObjects(kubeconfig, ns, app string) error {
+	cmds := [][]string{
+		{"delete", "deployment", "-l", "app=" + app + ",slot", "--ignore-not-found"},
+		{"delete", "deployment,service,configmap,secret", "-l", fmt.Sprintf("app in (%s-canary,%s-blue,%s-green)", app, app, app), "--ignore-not-found"},
+		{"delete", "service", "-l", "app=" + app + ",tekton-runner/role,tekton-runner/role!=headless", "--ignore-not-found"},
+	}
+	for _, args := range cmds {
+		cmd := exec.Command("kubectl", append([]string{"--kubeconfig", kubeconfig, "-n", ns}, args...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("cleanup %s: %v", app, err)
+		}
+	}
+	return nil
+}
+
+// deployBlueGreen rolls the new version out to the idle slot, checks it and
+// then points the app Service at it. The previous slot keeps running until
+// the deploy is promoted, so an abort is a selector flip.
+func deployBlueGreen(kubeconfig, ns, app, image string, d Deploy, secretEnv map[string]string) error {
+	active := serviceSlot(kubeconfig, ns, app)
+	next := otherSlot(active)
+	wl := workload{Name: app + "-" + next, App: app, Slot: next}
+	if err := kubectlApplyTo(kubeconfig, renderWorkload(ns, wl, image, d, secretEnv)); err != nil {
+		return err
+	}
+	if err := waitRollout(kubeconfig, ns, wl.Name, rolloutTimeout); err != nil {
+		_ = scaleDeployment(kubeconfig, ns, wl.Name, 0)
+		return err
+	}
+	if d.SmokePath != "" {
+		if err := previewSmokeCheck(kubeconfig, ns, app, next, d); err != nil {
+			_ = scaleDeployment(kubeconfig, ns, wl.Name, 0)
+			return err
+		}
+	}
+	if err := kubectlApplyTo(kubeconfig, renderService(ns, app, app, next, "", d.Ports)); err != nil {
+		return err
+	}
+	if active == "" {
+		// The app was deployed rolling before; its Deployment is replaced by the slot.
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "delete", "deployment", app, "--ignore-not-found")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("delete rolling deployment: %v", err)
+		}
+	}
+	return nil
+}
+
+// previewSmokeCheck exposes a slot through a temporary preview Service and
+// requests d.SmokePath on its first TCP port.
+func previewSmokeCheck(kubeconfig, ns, app, slot string, d Deploy) error {
+	name := app + "-preview"
+	if err := kubectlApplyTo(kubeconfig, renderService(ns, name, app, slot, "preview", d.Ports)); err != nil {
+		return err
+	}
+	defer exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "delete", "service", name, "--ignore-not-found").Run()
+
+	ports, err := getServicePorts(kubeconfig, ns, name)
+	if err != nil {
+		return err
+	}
+	nodeIP, err := getNodeInternalIP(kubeconfig, ns)
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if p.Protocol == "UDP" {
+			continue
+		}
+		url := fmt.Sprintf("http://%s:%d%s", nodeIP, p.NodePort, d.SmokePath)
+		return httpCheck(url, time.Minute)
+	}
+	return fmt.Errorf("smoke check: %s has no TCP port", app)
+}
+
+// httpCheck retries GET url until it answers below 400 or timeout passes.
+func httpCheck(url string, timeout time.Duration) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 400 {
+				return nil
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		lastErr = err
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("smoke check %s failed: %v", url, lastErr)
+}
+
+// deployCanary runs the new version next to the stable app as <app>-canary.
+// The runner's external port forwards split connections between the two by
+// deploy.canary_weight; a weight of 0 keeps the canary out of the split.
+// The app's NodePort Service only selects the stable pods, so traffic that
+// does not go through an external port never reaches the canary. The first
+// deploy of an app has nothing to compare against and is applied rolling.
+func deployCanary(kubeconfig, ns, app, image string, d Deploy, secretEnv map[string]string) error {
+	if !resourceExists(kubeconfig, ns, "service", app) {
+		return deployRolling(kubeconfig, ns, app, image, d, secretEnv)
+	}
+	weight := defaultCanaryWeight
+	if d.CanaryWeight != nil {
+		weight = *d.CanaryWeight
+	}
+	name := app + "-canary"
+	wl := workload{Name: name, App: name, Service: true, Role: "canary"}
+	if err := kubectlApplyTo(kubeconfig, renderWorkload(ns, wl, image, d, secretEnv)); err != nil {
+		return err
+	}
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "annotate", "service", name, fmt.Sprintf("%s=%d", canaryWeightKey, weight), "--overwrite")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("annotate canary: %v", err)
+	}
+	if err := waitRollout(kubeconfig, ns, name, rolloutTimeout); err != nil {
+		return err
+	}
+	restartForwards(ns, app)
+	return nil
+}
+
+// canaryWeight returns the traffic weight of the app canary, if one runs.
+func canaryWeight(kubeconfig, ns, app string) (int, bool) {
+	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", ns, "get", "service", app+"-canary", "-o", fmt.Sprintf("go-template={{index .metadata.annotations %q}}", canaryWeightKey))
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, false
+	}
+	w, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return defaultCanaryWeight, true
+	}
+	return w, true
+}
+
+// promoteApp finishes a canary or blue/green deploy. A canary's image and
+// spec replace the stable app (which becomes rolling); for blue/green the
+// previous slot is scaled down.
+func promoteApp(workspace, app string) (string, error) {
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	if _, ok := canaryWeight(kcfg, workspace, app); ok {
+		rev, err := latestCanaryRevision(workspace, app)
+		if err != nil {
+			return "", err
+		}
+		d, err := restoreDeploy(kcfg, workspace, app+"-canary", rev)
+		if err != nil {
+			return "", err
+		}
+		secretEnv, err := appSecretEnv(kcfg, workspace, rev.Namespace, d.Env, d.EnvFromSecret)
+		if err != nil {
+			return "", err
+		}
+		d.Strategy = strategyRolling
+		if err := applyDeployment(kcfg, workspace, app, rev.Image, d, secretEnv); err != nil {
+			return "", err
+		}
+		if err := waitRollout(kcfg, workspace, app, rolloutTimeout); err != nil {
+			return "", err
+		}
+		if err := cleanupStrategyObjects(kcfg, workspace, app); err != nil {
+			return "", err
+		}
+		restartForwards(workspace, app)
+		return "canary promoted", nil
+	}
+	active := serviceSlot(kcfg, workspace, app)
+	if active == "" {
+		return "", fmt.Errorf("%s has no canary or blue/green deploy to promote", app)
+	}
+	prev := app + "-" + otherSlot(active)
+	if resourceExists(kcfg, workspace, "deployment", prev) {
+		if err := scaleDeployment(kcfg, workspace, prev, 0); err != nil {
+			return "", err
+		}
+	}
+	return "bluegreen promoted", nil
+}
+
+// abortApp drops a canary, or points a blue/green app back at its previous
+// slot.
+func abortApp(workspace, app string) (string, error) {
+	kcfg := filepath.Join("/home/beko/kubeconfigs", workspace+".yaml")
+	if _, ok := canaryWeight(kcfg, workspace, app); ok {
+		name := app + "-canary"
+		cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "delete", "deployment,service,configmap,secret", "-l", "app="+name, "--ignore-not-found")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("delete canary: %v", err)
+		}
+		restartForwards(workspace, app)
+		return "canary aborted", nil
+	}
+	active := serviceSlot(kcfg, workspace, app)
+	if active == "" {
+		return "", fmt.Errorf("%s has no canary or blue/green deploy to abort", app)
+	}
+	prevSlot := otherSlot(active)
+	prev := app + "-" + prevSlot
+	if !resourceExists(kcfg, workspace, "deployment", prev) {
+		return "", fmt.Errorf("previous slot %s not found", prev)
+	}
+	out, err := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "get", "deployment", app+"-"+active, "-o", "jsonpath={.spec.replicas}").Output()
+	if err != nil {
+		return "", fmt.Errorf("get active replicas: %v", err)
+	}
+	replicas, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	if replicas < 1 {
+		replicas = 1
+	}
+	if err := scaleDeployment(kcfg, workspace, prev, replicas); err != nil {
+		return "", err
+	}
+	if err := waitRollout(kcfg, workspace, prev, rolloutTimeout); err != nil {
+		return "", err
+	}
+	patch := fmt.Sprintf(`{"spec":{"selector":{"app":%q,"slot":%q}}}`, app, prevSlot)
+	cmd := exec.Command("kubectl", "--kubeconfig", kcfg, "-n", workspace, "patch", "service", app, "-p", patch)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("flip service: %v", err)
+	}
+	if err := scaleDeployment(kcfg, workspace, app+"-"+active, 0); err != nil {
+		log.Printf("scale down aborted slot: %v", err)
+	}
+	return "bluegreen aborted", nil
+}
+
+func latestCanaryRevision(workspace, app string) (DeployRevision, error) {
+	for _, r := range historyStore.list(workspace, app) {
+		if r.Deploy.Strategy == strategyCanary {
+			return r, nil
+		}
+	}
+	return DeployRevision{}, fmt.Errorf("no canary revision recorded for %s/%s", workspace, app)
+}
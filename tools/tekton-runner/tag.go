@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	tagGitSHA    = "git-sha"
+	tagTimestamp = "timestamp"
+	tagRunID     = "run-id"
+	tagTemplate  = "template"
+
+	maxTagLen = 128
+)
+
+var (
+	tagRe      = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	tagCharsRe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	commitRe   = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// tagVars are the fields a tag template can use.
+type tagVars struct {
+	SHA       string
+	ShortSHA  string
+	Timestamp string
+	RunID     string
+	Revision  string
+	Project   string
+	App       string
+}
+
+func validateTagStrategy(in *Input) error {
+	img := in.Image
+	if img.TagStrategy == "" {
+		if img.TagTemplate != "" {
+			return fmt.Errorf("image.tag_template needs image.tag_strategy=template")
+		}
+		return nil
+	}
+	if in.Source.Type == "image" {
+		return fmt.Errorf("image.tag_strategy is only used when the image is built")
+	}
+	if img.Tag != "" {
+		return fmt.Errorf("image.tag is set by image.tag_strategy")
+	}
+	switch img.TagStrategy {
+	case tagGitSHA:
+		if in.Source.Type != "git" {
+			return fmt.Errorf("image.tag_strategy=git-sha needs a git source")
+		}
+	case tagTimestamp, tagRunID:
+	case tagTemplate:
+		if img.TagTemplate == "" {
+			return fmt.Errorf("image.tag_template is required for tag_strategy=template")
+		}
+		if _, err := renderTag(img.TagTemplate, tagVars{}); err != nil {
+			return fmt.Errorf("image.tag_template: %v", err)
+		}
+		if tagUsesSHA(img.TagTemplate) && in.Source.Type != "git" {
+			return fmt.Errorf("image.tag_template: SHA and ShortSHA need a git source")
+		}
+	default:
+		return fmt.Errorf("image.tag_strategy must be git-sha, timestamp, run-id or template")
+	}
+	if img.TagTemplate != "" && img.TagStrategy != tagTemplate {
+		return fmt.Errorf("image.tag_template needs image.tag_strategy=template")
+	}
+	return nil
+}
+
+// tagUsesSHA reports whether a tag template refers to the commit.
+func tagUsesSHA(tpl string) bool {
+	return strings.Contains(tpl, "SHA")
+}
+
+// resolveTag sets image.tag from the tag strategy of the request. The commit
+// is looked up when the request is submitted and the source revision is
+// pinned to it, so the build checks out the commit the tag names even if the
+// branch moves before the build starts.
+func resolveTag(in *Input) error {
+	strategy := in.Image.TagStrategy
+	if strategy == "" {
+		return nil
+	}
+	if in.RunID == "" {
+		in.RunID = newRunID()
+	}
+	vars := tagVars{
+		Timestamp: time.Now().UTC().Format("20060102-150405"),
+		RunID:     in.RunID,
+		Revision:  in.Source.Revision,
+		Project:   strings.ToLower(in.Image.Project),
+		App:       sanitizeName(in.AppName),
+	}
+	if in.Source.Type == "git" && (strategy == tagGitSHA || tagUsesSHA(in.Image.TagTemplate)) {
+		sha, err := gitCommit(in.Source)
+		if err != nil {
+			return err
+		}
+		vars.SHA = sha
+		vars.ShortSHA = sha[:12]
+		in.Source.Revision = sha
+	}
+	var tag string
+	switch strategy {
+	case tagGitSHA:
+		tag = vars.ShortSHA
+	case tagTimestamp:
+		tag = vars.Timestamp
+	case tagRunID:
+		tag = vars.RunID
+	case tagTemplate:
+		var err error
+		if tag, err = renderTag(in.Image.TagTemplate, vars); err != nil {
+			return fmt.Errorf("image.tag_template: %v", err)
+		}
+	}
+	tag = strings.TrimLeft(tagCharsRe.ReplaceAllString(tag, "-"), ".-")
+	if len(tag) > maxTagLen {
+		tag = tag[:maxTagLen]
+	}
+	if !tagRe.MatchString(tag) {
+		return fmt.Errorf("image.tag_strategy %s gave no valid tag", strategy)
+	}
+	in.Image.Tag = tag
+	return nil
+}
+
+func renderTag(tpl string, vars tagVars) (string, error) {
+	t, err := template.New("tag").Option("missingkey=error").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// imageRepo strips the tag and digest from an image reference.
+func imageRepo(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// imageDigest returns the digest of a pinned image reference.
+func imageDigest(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		return ref[i+1:]
+	}
+	return ""
+}
+
+// buildResults returns the string results of the TaskRun or PipelineRun that
+// built a request.
+func buildResults(in Input, name string) (map[string]string, error) {
+	kind := "taskrun"
+	if in.Pipeline != nil {
+		kind = "pipelinerun"
+	}
+	out, err := kubectlCmd("-n", in.Namespace, "get", kind, name, "-o", "json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("get %s %s: %v", kind, name, err)
+	}
+	type result struct {
+		Name  string          `json:"name"`
+		Value json.RawMessage `json:"value"`
+	}
+	var tr struct {
+		Status struct {
+			Results     []result `json:"results"`
+			TaskResults []result `json:"taskResults"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &tr); err != nil {
+		return nil, fmt.Errorf("parse %s %s: %v", kind, name, err)
+	}
+	results := map[string]string{}
+	for _, r := range append(tr.Status.Results, tr.Status.TaskResults...) {
+		var v string
+		if json.Unmarshal(r.Value, &v) == nil {
+			results[r.Name] = strings.TrimSpace(v)
+		}
+	}
+	return results, nil
+}
+
+// pushedImage returns the image a build pushed, pinned to the digest of its
+// IMAGE_DIGEST result.
+func pushedImage(in Input, results map[string]string) (string, bool) {
+	digest := results["IMAGE_DIGEST"]
+	if !digestRe.MatchString(digest) {
+		return "", false
+	}
+	if url := results["IMAGE_URL"]; url != "" {
+		return imageRepo(url) + "@" + digest, true
+	}
+	in.Image.Digest = digest
+	return imageRef(in), true
+}
+
+// pinBuiltImage reads the IMAGE_DIGEST and IMAGE_URL results of a finished
+// build and returns the image to deploy by digest. The digest, and the
+// platform images of a multi-platform build, are recorded on the run. Tasks
+// that do not write the results are deployed by tag.
+func pinBuiltImage(in *Input, buildRun, runID string) string {
+	results, err := buildResults(*in, buildRun)
+	if err != nil {
+		log.Printf("run %s: %v; deploying by tag", runID, err)
+		return imageRef(*in)
+	}
+	ref, ok := pushedImage(*in, results)
+	if !ok {
+		log.Printf("run %s: %s has no IMAGE_DIGEST result; deploying by tag", runID, buildRun)
+		return imageRef(*in)
+	}
+	digest := imageDigest(ref)
+	in.Image.Digest = digest
+	platforms := parsePlatformImages(results["IMAGE_PLATFORMS"])
+	if err := runStore.update(runID, func(r *Run) {
+		r.Image = ref
+		r.Digest = digest
+		r.Platforms = platforms
+	}); err != nil {
+		logRunError(runID, err)
+	}
+	return ref
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRenderTag(t *testing.T) {
+	vars := tagVars{SHA: "0123456789abcdef0123456789abcdef01234567", ShortSHA: "0123456789ab", RunID: "run-1", Revision: "main", Project: "shop", App: "web"}
+	tests := []struct {
+		tpl     string
+		want    string
+		wantErr bool
+	}{
+		{"{{.App}}-{{.ShortSHA}}", "web-0123456789ab", false},
+		{"{{.Project}}.{{.Revision}}.{{.RunID}}", "shop.main.run-1", false},
+		{"v1", "v1", false},
+		{"{{.Branch}}", "", true},
+		{"{{.App", "", true},
+	}
+	for _, tt := range tests {
+		got, err := renderTag(tt.tpl, vars)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("renderTag(%q) error = %v, want error %v", tt.tpl, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("renderTag(%q) = %q, want %q", tt.tpl, got, tt.want)
+		}
+	}
+}
+
+func TestResolveTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		template string
+		revision string
+		want     string
+		wantRe   string
+		wantErr  bool
+	}{
+		{"none", "", "", "", "", "", false},
+		{"run id", tagRunID, "", "", "run-42", "", false},
+		{"timestamp", tagTimestamp, "", "", "", `^\d{8}-\d{6}$`, false},
+		{"template", tagTemplate, "{{.App}}-{{.RunID}}", "", "web-run-42", "", false},
+		{"invalid characters replaced", tagTemplate, "{{.Revision}}", "feature/Login page", "feature-Login-page", "", false},
+		{"leading dots trimmed", tagTemplate, "..{{.App}}", "", "web", "", false},
+		{"too long", tagTemplate, strings.Repeat("a", 200), "", strings.Repeat("a", maxTagLen), "", false},
+		{"empty", tagTemplate, "{{.Revision}}", "", "", "", true},
+	}
+	for _, tt := range tests {
+		in := Input{
+			RunID:   "run-42",
+			AppName: "web",
+			Source:  Source{Type: "zip", Revision: tt.revision},
+			Image:   Image{Project: "Shop", TagStrategy: tt.strategy, TagTemplate: tt.template},
+		}
+		err := resolveTag(&in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: resolveTag() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if tt.wantRe != "" {
+			if !regexp.MustCompile(tt.wantRe).MatchString(in.Image.Tag) {
+				t.Errorf("%s: tag = %q, want a match of %s", tt.name, in.Image.Tag, tt.wantRe)
+			}
+		} else if in.Image.Tag != tt.want {
+			t.Errorf("%s: tag = %q, want %q", tt.name, in.Image.Tag, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Volume is a PersistentVolumeClaim mounted into the app container. The
+// claim is named after the volume, so apps of a workspace that use the same
+// name share it.
+type Volume struct {
+	Name         string `json:"name"`
+	MountPath    string `json:"mount_path"`
+	Size         string `json:"size"`
+	StorageClass string `json:"storage_class"`
+}
+
+const (
+	volumeLabel       = "tekton-runner/volume"
+	defaultVolumeSize = "1Gi"
+)
+
+var storageClassRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+func setVolumeDefaults(vols []Volume) {
+	for i := range vols {
+		if vols[i].Size == "" {
+			vols[i].Size = defaultVolumeSize
+		}
+	}
+}
+
+func validateVolumes(vols []Volume, files []ConfigFile) error {
+	names := map[string]bool{}
+	paths := map[string]bool{}
+	for _, f := range files {
+		paths[path.Clean(f.Path)] = true
+	}
+	for i, v := range vols {
+		field := fmt.Sprintf("deploy.volumes[%d]", i)
+		if len(v.Name) > 50 || !addonNameRe.MatchString(v.Name) {
+			return fmt.Errorf("%s: name must be a lowercase DNS label", field)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("%s: name %s is duplicated", field, v.Name)
+		}
+		names[v.Name] = true
+		if !path.IsAbs(v.MountPath) || strings.ContainsFunc(v.MountPath, unicode.IsControl) {
+			return fmt.Errorf("%s: mount_path must be absolute", field)
+		}
+		if paths[path.Clean(v.MountPath)] {
+			return fmt.Errorf("%s: mount_path %s is already mounted", field, v.MountPath)
+		}
+		paths[path.Clean(v.MountPath)] = true
+		if !quantityRe.MatchString(v.Size) {
+			return fmt.Errorf("%s: invalid size %q", field, v.Size)
+		}
+		if v.StorageClass != "" && !storageClassRe.MatchString(v.StorageClass) {
+			return fmt.Errorf("%s: invalid storage_class %q", field, v.StorageClass)
+		}
+	}
+	return nil
+}
+
+func renderVolumeClaim(ns string, v Volume) string {
+	tpl := `apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    {{.Label}}: {{.Name}}
+spec:
+  accessModes: ["ReadWriteOnce"]
+{{- if .StorageClass }}
+  storageClassName: {{.StorageClass}}
+{{- end }}
+  resources:
+    requests:
+      storage: {{.Size}}
+`
+	return mustRender(tpl, map[string]any{
+		"Name":         v.Name,
+		"Namespace":    ns,
+		"Label":        volumeLabel,
+		"Size":         v.Size,
+		"StorageClass": v.StorageClass,
+	})
+}
+
+// volumeName is the pod volume name of a claim.
+func volumeName(v Volume) string {
+	return "vol-" + v.Name
+}
+
+// purgeAppVolumes deletes the claims of a deleted app: the per-pod claims of
+// a StatefulSet or chart, claims of its manifests, and its named volumes
+// that no other app of the workspace mounts.
+func purgeAppVolumes(kubeconfig, workspace, app string) error {
+	selectors := []string{"app=" + app, manifestAppLabel + "=" + app}
+	if release, ok := helmRelease(workspace, app); ok {
+		selectors = append(selectors, "app.kubernetes.io/instance="+release)
+	}
+	for _, sel := range selectors {
+		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "-n", workspace, "delete", "pvc", "-l", sel, "--ignore-not-found")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("delete volumes: %v", err)
+		}
+	}
+	revs := historyStore.list(workspace, app)
+	if len(revs) == 0 || revs[0].Deploy.Kind == kindStatefulSet {
+		return nil
+	}
+	used := map[string]bool{}
+	for other, rev := range historyStore.latest(workspace) {
+		if other == app {
+			continue
+		}
+		for _, v := range rev.Deploy.Volumes {
+			used[v.Name] = true
+		}
+	}
+	var claims []string
+	for _, v := range revs[0].Deploy.Volumes {
+		if !used[v.Name] {
+			claims = append(claims, v.Name)
+		}
+	}
+	if len(claims) == 0 {
+		return nil
+	}
+	args := append([]string{"--kubeconfig", kubeconfig, "-n", workspace, "delete", "pvc", "--ignore-not-found"}, claims...)
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("delete volumes: %v", err)
+	}
+	return nil
+}